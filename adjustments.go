@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Types of adjustment
+const (
+	adjustCharge     = "charge"     // a fixed amount charged to the provider, the default
+	adjustCredit     = "credit"     // a fixed amount given back to the provider
+	adjustPercentage = "percentage" // a percentage of the service fees ex GST of the invoice
+)
+
+// How often an adjustment is charged
+const (
+	recurOnce    = ""        // once on every invoice it is sent with
+	recurWeekly  = "weekly"  // every 7 days from the date it is first due
+	recurMonthly = "monthly" // on the same day every month from the date it is first due
+)
+
+// Adjustments are charges and credits on the invoice of a provider next to the service fees,
+// e.g. a monthly room rental. The amount is ex GST unless GSTInclusive is set.
+// Recurring adjustments are charged for every time they fall due in the report period
+// and are usually stored with the provider, see POST /adjustments.
+type Adjustments struct {
+	Description  string `json:"description" firestore:"description"`
+	Amount       Money  `json:"amount" firestore:"amount"`             // cents, positive for charges and credits
+	Tax          string `json:"tax" firestore:"tax"`                   // blank if GST applies, gstFree or inputTaxed
+	Type         string `json:"type" firestore:"type"`                 // charge (default), credit or percentage
+	Percentage   string `json:"percentage" firestore:"percentage"`     // of the service fees, for the percentage type
+	GSTInclusive bool   `json:"gstInclusive" firestore:"gstInclusive"` // the amount includes the GST, like room rent
+	Recurrence   string `json:"recurrence" firestore:"recurrence"`     // weekly or monthly, blank for once
+	From         string `json:"from" firestore:"from"`                 // DD/MM/YYYY a recurring adjustment is first due
+	To           string `json:"to" firestore:"to"`                     // DD/MM/YYYY it ends, blank if it does not
+}
+
+// AdjustmentLine is an adjustment as charged on the invoice
+type AdjustmentLine struct {
+	Description  string `json:"description"`
+	Type         string `json:"type"`
+	Percentage   string `json:"percentage,omitempty"`
+	Recurrence   string `json:"recurrence,omitempty"`
+	Tax          string `json:"tax"`
+	GSTInclusive bool   `json:"gstInclusive"`
+	Times        int    `json:"times"`  // times a recurring adjustment fell due in the period
+	Amount       Money  `json:"amount"` // ex GST, negative for credits
+	GST          Money  `json:"gst"`    // the GST included in a GST-inclusive amount
+}
+
+func (a Adjustments) kind() string {
+	if strings.TrimSpace(a.Type) == "" {
+		return adjustCharge
+	}
+	return strings.TrimSpace(a.Type)
+}
+
+func (a Adjustments) validate() error {
+	switch a.kind() {
+	case adjustCharge:
+	case adjustCredit:
+		if a.Amount.Sign() < 0 {
+			return fmt.Errorf("the amount of a credit must not be negative")
+		}
+	case adjustPercentage:
+		rate, err := parseRate(a.Percentage)
+		if err != nil {
+			return fmt.Errorf("invalid percentage: %w", err)
+		}
+		if rate.Sign() < 0 {
+			return fmt.Errorf("percentage must not be negative: %v", a.Percentage)
+		}
+		if a.GSTInclusive {
+			return fmt.Errorf("a percentage of the service fees is ex GST")
+		}
+	default:
+		return fmt.Errorf("unknown type: %v", a.Type)
+	}
+	switch a.Recurrence {
+	case recurOnce:
+	case recurWeekly, recurMonthly:
+		if _, err := parseDate(a.From); err != nil {
+			return fmt.Errorf("a recurring adjustment needs the date it is first due: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown recurrence: %v", a.Recurrence)
+	}
+	if strings.TrimSpace(a.To) != "" {
+		if _, err := parseDate(a.To); err != nil {
+			return fmt.Errorf("invalid end date: %w", err)
+		}
+	}
+	return nil
+}
+
+func validateAdjustments(adjustMap map[string][]Adjustments) error {
+	for provider, adjustments := range adjustMap {
+		for _, adj := range adjustments {
+			if err := adj.validate(); err != nil {
+				return fmt.Errorf("adjustment: %v of provider: %v %w", adj.Description, provider, err)
+			}
+		}
+	}
+	return nil
+}
+
+// times returns how often the adjustment falls due in the period. Adjustments charged once,
+// and recurring adjustments when the period is not known, are charged once.
+func (a Adjustments) times(period ReportPeriod) int {
+	if a.Recurrence == recurOnce || !period.isSet() {
+		return 1
+	}
+	first, _ := parseDate(a.From) // checked by validate
+	end := period.End
+	if to, err := parseDate(a.To); err == nil && to.Before(end) {
+		end = to
+	}
+	times := 0
+	for n := 0; ; n++ {
+		due := first.AddDate(0, 0, 7*n)
+		if a.Recurrence == recurMonthly {
+			due = addMonths(first, n)
+		}
+		if due.After(end) {
+			return times
+		}
+		if !due.Before(period.Start) {
+			times++
+		}
+	}
+}
+
+// addMonths adds months to the date, a date past the end of the month is the last day of the month,
+// so a rent due on the 31st is due on the 30th in April
+func addMonths(date time.Time, months int) time.Time {
+	due := date.AddDate(0, months, 0)
+	if due.Day() != date.Day() {
+		// went into the next month, step back to the last day of the month before
+		due = due.AddDate(0, 0, -due.Day())
+	}
+	return due
+}
+
+// resolveAdjustments works out what the adjustments of a provider come to on the invoice:
+// the times recurring adjustments fell due, percentages of the service fees, credits
+// and the GST included in GST-inclusive amounts
+func resolveAdjustments(adjustments []Adjustments, serviceFees Money, period ReportPeriod, tax TaxConfig,
+	rounding RoundingPolicy) ([]AdjustmentLine, error) {
+	rate, err := tax.rate()
+	if err != nil {
+		return nil, err
+	}
+	lines := []AdjustmentLine{}
+	for _, adj := range adjustments {
+		line := AdjustmentLine{Description: adj.Description, Type: adj.kind(), Recurrence: adj.Recurrence, Tax: adj.Tax,
+			GSTInclusive: adj.GSTInclusive, Times: adj.times(period)}
+		if line.Times == 0 {
+			continue // a recurring adjustment not due in the period
+		}
+		amount := adj.Amount
+		switch adj.kind() {
+		case adjustCredit:
+			amount = amount.Neg()
+		case adjustPercentage:
+			line.Percentage = adj.Percentage
+			percentage, _ := parseRate(adj.Percentage) // checked by validate
+			if amount, err = rounding.money(exactFee(serviceFees, percentage), serviceFees.Currency); err != nil {
+				return nil, err
+			}
+		}
+		if line.Amount, err = amount.Mul(int64(line.Times)); err != nil {
+			return nil, err
+		}
+		if adj.GSTInclusive && adj.Tax == taxTaxable && !tax.NotRegistered {
+			// the GST is rate/(100+rate) of a GST-inclusive amount, 1/11th at 10%
+			included := new(big.Rat).Mul(rate, big.NewRat(100, 1))
+			included.Quo(included, new(big.Rat).Add(rate, big.NewRat(100, 1)))
+			if line.GST, err = rounding.money(exactFee(line.Amount, included), line.Amount.Currency); err != nil {
+				return nil, err
+			}
+			if line.Amount, err = line.Amount.Sub(line.GST); err != nil {
+				return nil, err
+			}
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+// setAdjustments puts the adjustments on the totals of the invoice
+func (p *PaymentTotals) setAdjustments(lines []AdjustmentLine) error {
+	p.Adjustments = lines
+	p.AdjustmentTotal = newMoney(0, p.ServiceCutTotal.Currency)
+	var sum moneySum
+	for _, line := range lines {
+		sum.add(&p.AdjustmentTotal, line.Amount)
+	}
+	return sum.err
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// AmountError is an amount which could not be read. Code is the code of the validation issue:
+// INVALID_AMOUNT, AMBIGUOUS_AMOUNT for amounts which could be read more than one way,
+// or AMOUNT_OUT_OF_RANGE.
+type AmountError struct {
+	Value  string
+	Code   string
+	Reason string
+	Err    error // ErrOverflow for amounts out of range
+}
+
+func (e *AmountError) Error() string {
+	return fmt.Sprintf("%v: %q", e.Reason, e.Value)
+}
+
+func (e *AmountError) Unwrap() error {
+	return e.Err
+}
+
+// amountIssueCode returns the code of the validation issue for an amount which could not be read
+func amountIssueCode(err error) string {
+	var amountErr *AmountError
+	if errors.As(err, &amountErr) {
+		return amountErr.Code
+	}
+	return issueInvalidAmount
+}
+
+// Unicode minus signs, as typed in or copied from Word and web pages
+var minusSigns = strings.NewReplacer("\u2212", "-", "\ufe63", "-", "\uff0d", "-")
+
+// The digits of an amount: plain, or with a comma between every three digits.
+// A comma followed by other than three digits is a decimal comma or a typo, we cannot tell.
+var (
+	plainDigits   = regexp.MustCompile(`^(\d+\.?\d*|\.\d+)$`)
+	groupedDigits = regexp.MustCompile(`^\d{1,3}(,\d{3})+(\.\d*)?$`)
+)
+
+// convertToInt returns the value in hundredths. It reads the amounts as Excel and the exports
+// write them: "1,234.50", "$1,234.50", "-$12.00", "$-12.00", "(12.00)", "$ (12.00)", "12.50-"
+// and Unicode minus signs. Values with more than two decimals are rounded half away from zero,
+// so 123.455 is 123.46. Amounts which could be read more than one way, like "12,50", "-(12.00)"
+// or "(12.00" without its closing bracket, are rejected rather than guessed.
+func convertToInt(value string) (int64, error) {
+	text := strings.TrimFunc(minusSigns.Replace(value), unicode.IsSpace)
+	if text == "" {
+		return 0, &AmountError{Value: value, Code: issueInvalidAmount, Reason: "field is blank"}
+	}
+	signs := 0
+	negative := false
+	bracket := false
+	currency := false
+	// the signs, the opening bracket and the dollar sign in front of the digits, in any order
+prefix:
+	for text != "" {
+		first, _ := utf8.DecodeRuneInString(text)
+		switch {
+		case first == '-' || first == '+':
+			signs++
+			negative = first == '-'
+			text = text[1:]
+		case first == '(':
+			signs++
+			negative, bracket = true, true
+			text = text[1:]
+		case !currency && (first == '$' || strings.HasPrefix(text, "A$")):
+			currency = true
+			text = text[strings.Index(text, "$")+1:]
+		case unicode.IsSpace(first):
+			text = strings.TrimLeftFunc(text, unicode.IsSpace)
+		default:
+			break prefix
+		}
+	}
+	// the closing bracket or a trailing minus after the digits
+suffix:
+	for text != "" {
+		last, _ := utf8.DecodeLastRuneInString(text)
+		switch {
+		case last == ')':
+			if !bracket {
+				return 0, &AmountError{Value: value, Code: issueInvalidAmount, Reason: "closing bracket without an opening bracket"}
+			}
+			bracket = false
+			text = text[:len(text)-1]
+		case last == '-':
+			signs++
+			negative = true
+			text = text[:len(text)-1]
+		case unicode.IsSpace(last):
+			text = strings.TrimRightFunc(text, unicode.IsSpace)
+		default:
+			break suffix
+		}
+	}
+	if bracket {
+		// a truncated cell, it may not be negative at all
+		return 0, &AmountError{Value: value, Code: issueAmbiguousAmount, Reason: "opening bracket without a closing bracket"}
+	}
+	if signs > 1 {
+		return 0, &AmountError{Value: value, Code: issueAmbiguousAmount, Reason: "more than one sign"}
+	}
+	switch {
+	case plainDigits.MatchString(text):
+	case groupedDigits.MatchString(text):
+		text = strings.ReplaceAll(text, ",", "")
+	case strings.Trim(text, "0123456789,.") == "" && (strings.Count(text, ".") > 1 || strings.Contains(text, ",")):
+		return 0, &AmountError{Value: value, Code: issueAmbiguousAmount,
+			Reason: "separators are not thousands separators and a decimal point"}
+	default:
+		return 0, &AmountError{Value: value, Code: issueInvalidAmount, Reason: "error converting value"}
+	}
+	num, ok := new(big.Rat).SetString(text)
+	if !ok {
+		return 0, &AmountError{Value: value, Code: issueInvalidAmount, Reason: "error converting value"}
+	}
+	if negative {
+		num.Neg(num)
+	}
+	hundredths := RoundingPolicy{Mode: roundHalfUp}.round(num.Mul(num, big.NewRat(100, 1)))
+	if !hundredths.IsInt64() || hundredths.Int64() == math.MinInt64 {
+		return 0, &AmountError{Value: value, Code: issueAmountRange, Reason: "amount out of range", Err: ErrOverflow}
+	}
+	return hundredths.Int64(), nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"cloud.google.com/go/firestore"
+)
+
+// How a company settles a provider whose total for the period is negative, e.g. after reversals,
+// or too small to be worth an invoice
+const (
+	balanceInvoice      = ""             // invoice the total whatever it is
+	balanceCreditNote   = "creditNote"   // a negative total gets a credit note rather than an invoice
+	balanceCarryForward = "carryForward" // negative totals and totals below the minimum go to the next period
+)
+
+// What is sent to the provider for the period
+const (
+	documentInvoice        = "invoice"
+	documentCreditNote     = "creditNote"
+	documentCarriedForward = "carriedForward" // nothing, the balance is carried forward to the next period
+)
+
+// BalancePolicy is how a company deals with negative and small totals of its providers.
+// Carried forward balances are kept in a ledger per provider and added to the next invoice.
+type BalancePolicy struct {
+	Mode    string `json:"mode"`    // creditNote or carryForward, invoice whatever the total if blank
+	Minimum Money  `json:"minimum"` // cents, totals below it are carried forward, carryForward only
+}
+
+func (b BalancePolicy) validate() error {
+	switch b.Mode {
+	case balanceInvoice, balanceCreditNote:
+		if !b.Minimum.IsZero() {
+			return fmt.Errorf("a minimum is only used when carrying balances forward")
+		}
+	case balanceCarryForward:
+		if b.Minimum.Sign() < 0 {
+			return fmt.Errorf("minimum must not be negative: %v", b.Minimum)
+		}
+	default:
+		return fmt.Errorf("unknown mode: %v", b.Mode)
+	}
+	return nil
+}
+
+// settle works out what the provider owes for the period with the balance brought forward,
+// and whether an invoice or a credit note is sent or the balance is carried forward
+func (b BalancePolicy) settle(details *PaymentTotals, broughtForward Money) error {
+	var sum moneySum
+	currency := details.ServiceCutTotal.Currency
+	details.BroughtForward = newMoney(0, currency)
+	details.AmountDue = newMoney(0, currency)
+	sum.add(&details.BroughtForward, broughtForward)
+	sum.add(&details.AmountDue, details.ServiceCutTotal)
+	sum.add(&details.AmountDue, details.AdjustmentTotal)
+	sum.add(&details.AmountDue, details.InvoiceGST)
+	sum.add(&details.AmountDue, broughtForward)
+	if sum.err != nil {
+		return sum.err
+	}
+	b.decide(details)
+	return nil
+}
+
+// decide works out from the amount due whether an invoice or a credit note is sent or the balance is carried forward
+func (b BalancePolicy) decide(details *PaymentTotals) {
+	details.Document = documentInvoice
+	details.CarriedForward = newMoney(0, details.AmountDue.Currency)
+	switch {
+	case b.Mode == balanceCarryForward && (details.AmountDue.Sign() < 0 || details.AmountDue.Amount < b.Minimum.Amount):
+		details.Document = documentCarriedForward
+		details.CarriedForward = details.AmountDue
+	case b.Mode == balanceCreditNote && details.AmountDue.Sign() < 0:
+		details.Document = documentCreditNote
+	}
+}
+
+// balanceIssue returns the warning for a total which is negative or below the minimum, if it is
+func (b BalancePolicy) balanceIssue(provider string, details PaymentTotals) (ValidationIssue, bool) {
+	issue := ValidationIssue{Value: provider, Severity: severityWarning}
+	switch {
+	case details.AmountDue.Sign() < 0:
+		issue.Code = issueNegativeTotal
+		issue.Message = fmt.Sprintf("provider: %v has a negative total: %v", provider, details.AmountDue)
+	case details.AmountDue.Amount < b.Minimum.Amount:
+		issue.Code = issueBelowMinimum
+		issue.Message = fmt.Sprintf("provider: %v has a total: %v below the minimum: %v", provider, details.AmountDue, b.Minimum)
+	default:
+		return issue, false
+	}
+	switch details.Document {
+	case documentCreditNote:
+		issue.Message += ", a credit note is sent"
+	case documentCarriedForward:
+		issue.Message += ", it is carried forward to the next period"
+	default:
+		issue.Message += ", the invoice shows a negative total"
+	}
+	return issue, true
+}
+
+// settled returns true if an invoice or a credit note was made or the balance was carried forward
+func settled(details PaymentTotals) bool {
+	if hasInvoice(details) || details.Document == documentCarriedForward {
+		return true
+	}
+	for _, location := range details.LocationSplit {
+		if location.Document == documentCarriedForward {
+			return true
+		}
+	}
+	return false
+}
+
+// LedgerEntry is the balance of a provider carried forward from a period
+type LedgerEntry struct {
+	Provider       string `json:"provider" firestore:"provider"`
+	Period         string `json:"period" firestore:"period"`                 // the report period it was carried forward from
+	BroughtForward Money  `json:"broughtForward" firestore:"broughtForward"` // from the periods before
+	Balance        Money  `json:"balance" firestore:"balance"`               // carried forward, negative for credits
+}
+
+// broughtForward returns the balance brought forward into the period. Processing the same
+// period again uses the balance it was first processed with, so it is not counted twice.
+func (e LedgerEntry) broughtForward(period string) Money {
+	if period != "" && e.Period == period {
+		return e.BroughtForward
+	}
+	return e.Balance
+}
+
+// balanceLedger keeps the balances carried forward per provider of a company
+type balanceLedger interface {
+	// entries returns the ledger entries of the providers, providers without one are left out
+	entries(providers []string) (map[string]LedgerEntry, error)
+	// record stores the entries of the providers
+	record(entries map[string]LedgerEntry) error
+}
+
+// broughtForward returns the balances brought forward into the period per provider
+func broughtForward(ledger balanceLedger, providers []string, period string) (map[string]Money, error) {
+	balances := map[string]Money{}
+	if ledger == nil {
+		return balances, nil
+	}
+	entries, err := ledger.entries(providers)
+	if err != nil {
+		return nil, err
+	}
+	for provider, entry := range entries {
+		balances[provider] = entry.broughtForward(period)
+	}
+	return balances, nil
+}
+
+// firestoreLedger keeps the balances under the user's company details
+type firestoreLedger struct {
+	ctx       context.Context
+	client    *firestore.Client
+	userId    string
+	companyId string
+}
+
+func (l firestoreLedger) entries(providers []string) (map[string]LedgerEntry, error) {
+	return getBalances(l.ctx, l.client, l.userId, l.companyId, providers)
+}
+
+func (l firestoreLedger) record(entries map[string]LedgerEntry) error {
+	return setBalances(l.ctx, l.client, l.userId, l.companyId, entries)
+}
@@ -2,97 +2,88 @@ package main
 
 import (
 	"fmt"
-	"math"
-	"strconv"
+	"math/big"
+	"regexp"
 	"strings"
 )
 
-func cents2DStr(v int) string {
-	if v < 0 {
-		return fmt.Sprintf("(%d.%02d)", -v/100, -v%100)
-	}
-	return fmt.Sprintf("%d.%02d", v/100, v%100)
-}
-
-func calcPayment(payment string, gst string, percentage string) (int, int, int, int, error) {
-	p, err := dollarStringToCents(payment)
+// calcExactPayment returns the payment ex GST, the service fee, the payment and the GST.
+// The fee is the exact percentage of the payment ex GST in cents, the rounding policy rounds it.
+func calcExactPayment(payment string, gst string, percentage string, currency string) (Money, *big.Rat, Money, Money, error) {
+	p, err := parseMoney(payment, currency)
 	if err != nil {
-		return 0, 0, 0, 0, fmt.Errorf("%w %w", ErrAmount, err)
+		return Money{}, nil, Money{}, Money{}, fmt.Errorf("%w %w", ErrAmount, err)
 	}
-	g, err := dollarStringToCents(gst)
+	g, err := parseMoney(gst, currency)
 	if err != nil {
-		return 0, 0, 0, 0, fmt.Errorf("%w %w", ErrAmount, err)
+		return Money{}, nil, Money{}, Money{}, fmt.Errorf("%w %w", ErrAmount, err)
 	}
-	perc, err := convertPercToFloat(percentage)
+	perc, err := parseRate(percentage)
 	if err != nil {
-		return 0, 0, 0, 0, fmt.Errorf("%w %w", ErrPercentage, err)
+		return Money{}, nil, Money{}, Money{}, fmt.Errorf("%w %w", ErrPercentage, err)
 	}
-	//partPay := p
-	if perc < 0 {
-		return 0, 0, 0, 0, fmt.Errorf("%w %w", ErrPercentage, fmt.Errorf("percentage value must not be negative"))
+	if perc.Sign() < 0 {
+		return Money{}, nil, Money{}, Money{}, fmt.Errorf("%w %w", ErrPercentage, fmt.Errorf("percentage value must not be negative"))
+	}
+	exGst, err := p.Sub(g)
+	if err != nil {
+		return Money{}, nil, Money{}, Money{}, fmt.Errorf("%w %w", ErrAmount, err)
 	}
-	exGst := p - g
-	partPay := float64((exGst)*perc) / 10000
-	return exGst, int(math.Round(partPay)), p, g, nil
+	return exGst, exactFee(exGst, perc), p, g, nil
 }
 
-func calcGST(num1 int, num2 int) int {
-	total := float64(num1 + num2)
-	tenPercent := total / 10
-	return int(math.Round(tenPercent))
+// calcGST returns the GST on the amount at the rate, a percentage
+func calcGST(amount Money, rate *big.Rat, rounding RoundingPolicy) (Money, error) {
+	return rounding.money(exactFee(amount, rate), amount.Currency)
 }
 
-func convertToInt(value string) (int, error) {
-	value = strings.TrimSpace(value)
-	if value == "" {
-		return 0, fmt.Errorf("field is blank")
-	}
-	factor := 1
-	if value[0] == '(' {
-		factor = -1
-		value = strings.ReplaceAll(value, "(", "")
-		value = strings.ReplaceAll(value, ")", "")
-	}
+// Percentages are plain decimals
+var decimalPattern = regexp.MustCompile(`^[-+]?(\d+\.?\d*|\.\d+)$`)
 
-	parts := strings.Split(value, ".")
-	if len(parts) > 2 {
-		return 0, fmt.Errorf("invalid number format")
-	}
+// Rates are percentages: decimals like "33.333", fractions like "100/3" and mixed numbers like "33 1/3"
+var (
+	fractionPattern = regexp.MustCompile(`^\d+/\d+$`)
+	mixedPattern    = regexp.MustCompile(`^(\d+)\s+(\d+/\d+)$`)
+)
 
-	integerPart := parts[0]
-	fractionalPart := "00"
-	if len(parts) == 2 {
-		fractionalPart = parts[1]
-		if len(fractionalPart) > 2 {
-			fractionalPart = fractionalPart[:2]
-		} else if len(fractionalPart) < 2 {
-			fractionalPart = fractionalPart + "0"
-		}
+// parseRate reads a percentage exactly, "33 1/3" or "100/3" is a third of the payment.
+// Nothing is rounded, the fee is rounded once it is calculated.
+func parseRate(value string) (*big.Rat, error) {
+	value = strings.TrimSpace(strings.ReplaceAll(value, "%", ""))
+	if value == "" {
+		return nil, fmt.Errorf("field is blank")
 	}
-
-	combined := integerPart + fractionalPart
-	num, err := strconv.Atoi(combined)
-	if err != nil {
-		return 0, fmt.Errorf("error converting value")
+	rate := new(big.Rat)
+	switch {
+	case decimalPattern.MatchString(value) || fractionPattern.MatchString(value):
+		if _, ok := rate.SetString(value); !ok {
+			return nil, fmt.Errorf("error converting value: %v", value)
+		}
+	case mixedPattern.MatchString(value):
+		parts := mixedPattern.FindStringSubmatch(value)
+		whole, okWhole := new(big.Rat).SetString(parts[1])
+		fraction, okFraction := new(big.Rat).SetString(parts[2])
+		if !okWhole || !okFraction {
+			return nil, fmt.Errorf("error converting value: %v", value)
+		}
+		rate.Add(whole, fraction)
+	default:
+		return nil, fmt.Errorf("error converting value: %v", value)
 	}
-	return num * factor, nil
+	return rate, nil
 }
 
-func convertPercToFloat(value string) (int, error) {
-	value = strings.ReplaceAll(value, "%", "")
-	return convertToInt(value)
+// exactFee returns the percentage of the amount in cents, not rounded
+func exactFee(amount Money, rate *big.Rat) *big.Rat {
+	fee := new(big.Rat).Mul(amount.rat(), rate)
+	return fee.Quo(fee, big.NewRat(100, 1))
 }
 
-func dollarStringToCents(dollarStr string) (int, error) {
-	// Remove any leading "$" sign if present
-	dollarStr = strings.TrimPrefix(dollarStr, "$")
-
-	// Parse the string to a int
-	value, err := convertToInt(dollarStr)
+// parseMoney reads a dollar amount like "$1,234.50" or "(224.50)" in the currency, see convertToInt
+func parseMoney(dollarStr string, currency string) (Money, error) {
+	cents, err := convertToInt(dollarStr)
 	if err != nil {
-		return 0, fmt.Errorf("invalid dollar amount: %v", err)
+		return Money{}, fmt.Errorf("invalid dollar amount: %w", err)
 	}
-
-	// convert to cents
-	return value, nil
+	return newMoney(cents, currency), nil
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Logical fields of a payment line. These are the keys used in PaymentFile.ColumnMap
+// to override the header title (or position) a field is read from.
+const (
+	colLocation      = "location"
+	colProvider      = "provider"
+	colBilledTo      = "billedTo"
+	colPatient       = "patient"
+	colInvoiceNo     = "invoiceNo"
+	colServiceID     = "serviceId"
+	colPaymentID     = "paymentId"
+	colItemNum       = "itemNo"
+	colDescription   = "description"
+	colStatus        = "status"
+	colTransDate     = "transDate"
+	colPaymentMethod = "paymentMethod"
+	colAccountType   = "accountType"
+	colGST           = "gst"
+	colPayment       = "payment"
+	colDeposit       = "deposit"
+)
+
+type columnSpec struct {
+	field    string
+	header   string
+	required bool
+}
+
+// The "Payments Export" layout, in the order the columns appear in the export.
+// The position in this list is used when the file has no header row.
+var paymentsExportColumns = []columnSpec{
+	{colLocation, "Location", false},
+	{colProvider, "Provider", true},
+	{colBilledTo, "Billed To", false},
+	{colPatient, "Patient Name", true},
+	{colInvoiceNo, "Invoice No.", true},
+	{colServiceID, "Service ID", false},
+	{colPaymentID, "Payment ID", false},
+	{colItemNum, "Item No.", true},
+	{colDescription, "Description", true},
+	{colStatus, "Status", false},
+	{colTransDate, "Transaction Date", true},
+	{colPaymentMethod, "Payment Method", false},
+	{colAccountType, "Account Type", false},
+	{colGST, "GST($ incl GST)", true},
+	{colPayment, "Payment($ incl GST)", true},
+	{colDeposit, "Deposit($ incl GST)", false},
+}
+
+// columnIndex maps a logical field to its position in a record.
+// Optional fields which are not in the file are not in the map.
+type columnIndex map[string]int
+
+// headerKey normalises a header title so "GST\n($ incl GST)" and "gst($ incl gst)" match
+func headerKey(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), ""))
+}
+
+// isColumnPosition returns true if a column map value is a position rather than a header title
+func isColumnPosition(value string) bool {
+	_, err := strconv.Atoi(strings.TrimSpace(value))
+	return err == nil
+}
+
+// resolveColumns works out where each field is, using the header row of the file.
+// Without a header row the default Payments Export positions are used.
+// columnMap overrides the header title per field, or the position if the value is a
+// number (zero based). A required field that cannot be found is an error.
+func resolveColumns(specs []columnSpec, header []string, columnMap map[string]string) (columnIndex, error) {
+	known := map[string]columnSpec{}
+	for _, spec := range specs {
+		known[spec.field] = spec
+	}
+	for field := range columnMap {
+		if _, ok := known[field]; !ok {
+			return nil, fmt.Errorf("column map has unknown field: %v", field)
+		}
+	}
+	headerPos := map[string]int{}
+	for i, title := range header {
+		key := headerKey(title)
+		if _, exists := headerPos[key]; !exists && key != "" {
+			headerPos[key] = i
+		}
+	}
+
+	cols := columnIndex{}
+	for i, spec := range specs {
+		title := spec.header
+		if override, ok := columnMap[spec.field]; ok {
+			if pos, err := strconv.Atoi(strings.TrimSpace(override)); err == nil {
+				if pos < 0 {
+					return nil, fmt.Errorf("column map position for %v must not be negative: %v", spec.field, pos)
+				}
+				cols[spec.field] = pos
+				continue
+			}
+			title = override
+		}
+		if header == nil {
+			cols[spec.field] = i
+			continue
+		}
+		pos, found := headerPos[headerKey(title)]
+		if found {
+			cols[spec.field] = pos
+		} else if spec.required {
+			return nil, fmt.Errorf("header is missing required column %q for field: %v", title, spec.field)
+		}
+	}
+	return cols, nil
+}
+
+// minFields is the number of fields a record needs to hold all required columns
+func (c columnIndex) minFields(specs []columnSpec) int {
+	max := -1
+	for _, spec := range specs {
+		if pos, ok := c[spec.field]; ok && spec.required && pos > max {
+			max = pos
+		}
+	}
+	return max + 1
+}
+
+// get returns the field value from the record or "" if the column is not present
+func (c columnIndex) get(record []string, field string) string {
+	pos, ok := c[field]
+	if !ok || pos >= len(record) {
+		return ""
+	}
+	return record[pos]
+}
@@ -71,7 +71,20 @@ func deleteCompanies(ctx context.Context, client *firestore.Client, userId strin
 		return fmt.Errorf("user does not exist: %v", userId)
 	}
 	userDocRef := client.Collection("users").Doc(userId)
+	companyDocs, err := userDocRef.Collection("companyDetails").Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to get companies of user %v: %w", userId, err)
+	}
+	// firestore does not delete the subcollections with the document
+	for _, doc := range companyDocs {
+		deleteCollection(ctx, client, doc.Ref.Collection("processedPayments"))
+		deleteCollection(ctx, client, doc.Ref.Collection("balances"))
+	}
 	deleteCollection(ctx, client, userDocRef.Collection("companyDetails"))
+	deleteCollection(ctx, client, userDocRef.Collection("rateSchedules"))
+	deleteCollection(ctx, client, userDocRef.Collection("adjustments"))
+	deleteCollection(ctx, client, userDocRef.Collection("invoiceCounters"))
+	deleteCollection(ctx, client, userDocRef.Collection("invoiceTemplates"))
 	return nil
 }
 
@@ -150,6 +163,18 @@ func setCompanies(ctx context.Context, client *firestore.Client, userId string,
 	}
 
 	companyDetails := client.Collection("users").Doc(userId).Collection("companyDetails")
+	rateSchedules := client.Collection("users").Doc(userId).Collection("rateSchedules")
+	adjustments := client.Collection("users").Doc(userId).Collection("adjustments")
+	invoiceTemplates := client.Collection("users").Doc(userId).Collection("invoiceTemplates")
+	// firestore does not delete the subcollections with the document
+	for _, clinicId := range deleteItems {
+		if err := deleteCollection(ctx, client, companyDetails.Doc(clinicId).Collection("processedPayments")); err != nil {
+			return err
+		}
+		if err := deleteCollection(ctx, client, companyDetails.Doc(clinicId).Collection("balances")); err != nil {
+			return err
+		}
+	}
 	bw := client.BulkWriter(ctx)
 	for _, clinicId := range deleteItems {
 		docRef := companyDetails.Doc(clinicId)
@@ -157,6 +182,15 @@ func setCompanies(ctx context.Context, client *firestore.Client, userId string,
 		if err != nil {
 			return err
 		}
+		if _, err := bw.Delete(rateSchedules.Doc(clinicId)); err != nil {
+			return err
+		}
+		if _, err := bw.Delete(adjustments.Doc(clinicId)); err != nil {
+			return err
+		}
+		if _, err := bw.Delete(invoiceTemplates.Doc(clinicId)); err != nil {
+			return err
+		}
 	}
 	var docRef *firestore.DocumentRef
 	for _, clinic := range companyList {
@@ -177,3 +211,291 @@ func setCompanies(ctx context.Context, client *firestore.Client, userId string,
 	bw.End()
 	return nil
 }
+
+func processedPaymentsCollection(client *firestore.Client, userId string, companyId string) (*firestore.CollectionRef, error) {
+	if strings.TrimSpace(userId) == "" || strings.TrimSpace(companyId) == "" {
+		return nil, fmt.Errorf("no user id or company id")
+	}
+	return client.Collection("users").Doc(userId).Collection("companyDetails").Doc(companyId).Collection("processedPayments"), nil
+}
+
+// getProcessedPayments returns which of the payment keys have been stored for the company before
+func getProcessedPayments(ctx context.Context, client *firestore.Client, userId string, companyId string,
+	keys []string) (map[string]bool, error) {
+	result := map[string]bool{}
+	if len(keys) == 0 {
+		return result, nil
+	}
+	collection, err := processedPaymentsCollection(client, userId, companyId)
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]*firestore.DocumentRef, len(keys))
+	for i, key := range keys {
+		refs[i] = collection.Doc(key)
+	}
+	docs, err := client.GetAll(ctx, refs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get processed payments: %w", err)
+	}
+	for _, doc := range docs {
+		if doc.Exists() {
+			result[doc.Ref.ID] = true
+		}
+	}
+	return result, nil
+}
+
+// setProcessedPayments stores the payment keys for the company
+func setProcessedPayments(ctx context.Context, client *firestore.Client, userId string, companyId string,
+	keys []string) error {
+	collection, err := processedPaymentsCollection(client, userId, companyId)
+	if err != nil {
+		return err
+	}
+	bw := client.BulkWriter(ctx)
+	for _, key := range keys {
+		doc := map[string]interface{}{
+			"processed": firestore.ServerTimestamp,
+		}
+		if _, err := bw.Set(collection.Doc(key), doc); err != nil {
+			return err
+		}
+	}
+	bw.End()
+	return nil
+}
+
+// The balances carried forward are kept per provider under the company details
+func balancesCollection(client *firestore.Client, userId string, companyId string) (*firestore.CollectionRef, error) {
+	if strings.TrimSpace(userId) == "" || strings.TrimSpace(companyId) == "" {
+		return nil, fmt.Errorf("no user id or company id")
+	}
+	return client.Collection("users").Doc(userId).Collection("companyDetails").Doc(companyId).Collection("balances"), nil
+}
+
+// balanceKey is the document id of the balance of a provider, which must not contain a "/"
+func balanceKey(provider string) string {
+	return strings.ReplaceAll(standardString(provider), "/", "-")
+}
+
+// getBalances returns the balances carried forward of the providers, providers without a balance are left out
+func getBalances(ctx context.Context, client *firestore.Client, userId string, companyId string,
+	providers []string) (map[string]LedgerEntry, error) {
+	result := map[string]LedgerEntry{}
+	if len(providers) == 0 {
+		return result, nil
+	}
+	collection, err := balancesCollection(client, userId, companyId)
+	if err != nil {
+		return nil, err
+	}
+	refs := make([]*firestore.DocumentRef, len(providers))
+	for i, provider := range providers {
+		refs[i] = collection.Doc(balanceKey(provider))
+	}
+	docs, err := client.GetAll(ctx, refs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get balances: %w", err)
+	}
+	for i, doc := range docs {
+		if !doc.Exists() {
+			continue
+		}
+		var entry LedgerEntry
+		if err := doc.DataTo(&entry); err != nil {
+			return nil, err
+		}
+		result[providers[i]] = entry
+	}
+	return result, nil
+}
+
+// setBalances stores the balances carried forward of the providers
+func setBalances(ctx context.Context, client *firestore.Client, userId string, companyId string,
+	entries map[string]LedgerEntry) error {
+	collection, err := balancesCollection(client, userId, companyId)
+	if err != nil {
+		return err
+	}
+	bw := client.BulkWriter(ctx)
+	for provider, entry := range entries {
+		entry.Provider = provider
+		if _, err := bw.Set(collection.Doc(balanceKey(provider)), entry); err != nil {
+			return err
+		}
+	}
+	bw.End()
+	return nil
+}
+
+// The rate schedules of a company are kept next to the company details, under the company id
+func rateSchedulesDoc(client *firestore.Client, userId string, companyId string) (*firestore.DocumentRef, error) {
+	if strings.TrimSpace(userId) == "" || strings.TrimSpace(companyId) == "" {
+		return nil, fmt.Errorf("no user id or company id")
+	}
+	return client.Collection("users").Doc(userId).Collection("rateSchedules").Doc(companyId), nil
+}
+
+type rateSchedules struct {
+	Schedules []RateSchedule `firestore:"schedules"`
+}
+
+// getRateSchedules returns the rate schedules of the company, none if they were never set
+func getRateSchedules(ctx context.Context, client *firestore.Client, userId string, companyId string) ([]RateSchedule, error) {
+	docRef, err := rateSchedulesDoc(client, userId, companyId)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := docRef.Get(ctx)
+	if err != nil && status.Code(err) == codes.NotFound {
+		return []RateSchedule{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get rate schedules: %w", err)
+	}
+	var data rateSchedules
+	if err := doc.DataTo(&data); err != nil {
+		return nil, err
+	}
+	return data.Schedules, nil
+}
+
+// setRateSchedules replaces the rate schedules of the company
+func setRateSchedules(ctx context.Context, client *firestore.Client, userId string, companyId string,
+	schedules []RateSchedule) error {
+	docRef, err := rateSchedulesDoc(client, userId, companyId)
+	if err != nil {
+		return err
+	}
+	_, err = docRef.Set(ctx, rateSchedules{Schedules: schedules})
+	return err
+}
+
+// The adjustments of the providers of a company, like their room rent, are kept under the company id
+func adjustmentsDoc(client *firestore.Client, userId string, companyId string) (*firestore.DocumentRef, error) {
+	if strings.TrimSpace(userId) == "" || strings.TrimSpace(companyId) == "" {
+		return nil, fmt.Errorf("no user id or company id")
+	}
+	return client.Collection("users").Doc(userId).Collection("adjustments").Doc(companyId), nil
+}
+
+type providerAdjustments struct {
+	Providers map[string][]Adjustments `firestore:"providers"`
+}
+
+// getProviderAdjustments returns the adjustments stored per provider of the company, none if they were never set
+func getProviderAdjustments(ctx context.Context, client *firestore.Client, userId string, companyId string) (map[string][]Adjustments, error) {
+	docRef, err := adjustmentsDoc(client, userId, companyId)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := docRef.Get(ctx)
+	if err != nil && status.Code(err) == codes.NotFound {
+		return map[string][]Adjustments{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get adjustments: %w", err)
+	}
+	var data providerAdjustments
+	if err := doc.DataTo(&data); err != nil {
+		return nil, err
+	}
+	if data.Providers == nil {
+		data.Providers = map[string][]Adjustments{}
+	}
+	return data.Providers, nil
+}
+
+// setProviderAdjustments replaces the adjustments stored per provider of the company
+func setProviderAdjustments(ctx context.Context, client *firestore.Client, userId string, companyId string,
+	adjustMap map[string][]Adjustments) error {
+	docRef, err := adjustmentsDoc(client, userId, companyId)
+	if err != nil {
+		return err
+	}
+	_, err = docRef.Set(ctx, providerAdjustments{Providers: adjustMap})
+	return err
+}
+
+// The invoice counter of a company is kept next to the company details, under the company id.
+// It is not deleted with the company, so a company added again does not reuse its invoice numbers.
+func invoiceCounterDoc(client *firestore.Client, userId string, companyId string) (*firestore.DocumentRef, error) {
+	if strings.TrimSpace(userId) == "" || strings.TrimSpace(companyId) == "" {
+		return nil, fmt.Errorf("no user id or company id")
+	}
+	return client.Collection("users").Doc(userId).Collection("invoiceCounters").Doc(companyId), nil
+}
+
+// invoiceCounterData is the next sequence number of the company and the sequence numbers of the invoices
+// it was given, by provider, location and report period, so an invoice made again keeps its number
+type invoiceCounterData struct {
+	Next   int64            `firestore:"next"`
+	Issued map[string]int64 `firestore:"issued"`
+}
+
+// updateInvoiceCounter changes the invoice counter of the company in a transaction, so two uploads at the
+// same time do not get the same numbers. Nothing is stored if change fails.
+func updateInvoiceCounter(ctx context.Context, client *firestore.Client, userId string, companyId string,
+	change func(data *invoiceCounterData) error) error {
+	docRef, err := invoiceCounterDoc(client, userId, companyId)
+	if err != nil {
+		return err
+	}
+	err = client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		var data invoiceCounterData
+		doc, err := tx.Get(docRef)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if err == nil {
+			if err := doc.DataTo(&data); err != nil {
+				return err
+			}
+		}
+		if err := change(&data); err != nil {
+			return err
+		}
+		return tx.Set(docRef, data)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to number the invoices: %w", err)
+	}
+	return nil
+}
+
+// The invoice template of a company is kept under the company id
+func invoiceTemplateDoc(client *firestore.Client, userId string, companyId string) (*firestore.DocumentRef, error) {
+	if strings.TrimSpace(userId) == "" || strings.TrimSpace(companyId) == "" {
+		return nil, fmt.Errorf("no user id or company id")
+	}
+	return client.Collection("users").Doc(userId).Collection("invoiceTemplates").Doc(companyId), nil
+}
+
+// getInvoiceTemplate returns the invoice template of the company, the standard template if it was never set
+func getInvoiceTemplate(ctx context.Context, client *firestore.Client, userId string, companyId string) (InvoiceTemplate, error) {
+	docRef, err := invoiceTemplateDoc(client, userId, companyId)
+	if err != nil {
+		return InvoiceTemplate{}, err
+	}
+	doc, err := docRef.Get(ctx)
+	if err != nil && status.Code(err) == codes.NotFound {
+		return InvoiceTemplate{}, nil
+	} else if err != nil {
+		return InvoiceTemplate{}, fmt.Errorf("failed to get invoice template: %w", err)
+	}
+	var template InvoiceTemplate
+	if err := doc.DataTo(&template); err != nil {
+		return InvoiceTemplate{}, err
+	}
+	return template, nil
+}
+
+// setInvoiceTemplate replaces the invoice template of the company
+func setInvoiceTemplate(ctx context.Context, client *firestore.Client, userId string, companyId string,
+	template InvoiceTemplate) error {
+	docRef, err := invoiceTemplateDoc(client, userId, companyId)
+	if err != nil {
+		return err
+	}
+	_, err = docRef.Set(ctx, template)
+	return err
+}
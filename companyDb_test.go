@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
@@ -91,3 +92,232 @@ func checkCompanies(t *testing.T, ctx context.Context, client *firestore.Client,
 	require.NoError(t, err)
 	return docs
 }
+
+func TestProcessedPayments(t *testing.T) {
+	configureLogging()
+
+	os.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8080")
+	res, err := http.Get("http://localhost:8080")
+	if err != nil || res.StatusCode != http.StatusOK {
+		startEmulators(t)
+		defer stopEmulators(t)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	keys := filepath.Join(KEYPATH, KEYFILE)
+	client := initClient(ctx, keys)
+
+	userId := "testUser"
+	deleteUser(ctx, client, userId)
+	err = setCompanies(ctx, client, userId, []companyDetails{{ID: "clinic1", Name: "Test Clinic"}})
+	require.NoError(t, err)
+
+	history := firestoreHistory{ctx: ctx, client: client, userId: userId, companyId: "clinic1"}
+	seen, err := history.processed([]string{"payment_1_2", "payment_3_4"})
+	require.NoError(t, err)
+	require.Empty(t, seen)
+	require.NoError(t, history.record([]string{"payment_1_2"}))
+	seen, err = history.processed([]string{"payment_1_2", "payment_3_4"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]bool{"payment_1_2": true}, seen)
+
+	_, err = getProcessedPayments(ctx, client, userId, "", []string{"payment_1_2"})
+	require.Error(t, err)
+
+	// a company added again does not get the history of the one removed
+	require.NoError(t, setCompanies(ctx, client, userId, []companyDetails{{ID: "clinic2", Name: "Other Clinic"}}))
+	require.NoError(t, setCompanies(ctx, client, userId, []companyDetails{{ID: "clinic1", Name: "Test Clinic"}}))
+	seen, err = history.processed([]string{"payment_1_2"})
+	require.NoError(t, err)
+	require.Empty(t, seen)
+	deleteUser(ctx, client, userId)
+}
+
+func TestStoredRateSchedules(t *testing.T) {
+	configureLogging()
+
+	os.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8080")
+	res, err := http.Get("http://localhost:8080")
+	if err != nil || res.StatusCode != http.StatusOK {
+		startEmulators(t)
+		defer stopEmulators(t)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	keys := filepath.Join(KEYPATH, KEYFILE)
+	client := initClient(ctx, keys)
+
+	userId := "testUser"
+	deleteUser(ctx, client, userId)
+	err = setCompanies(ctx, client, userId, []companyDetails{{ID: "clinic1", Name: "Test Clinic"}})
+	require.NoError(t, err)
+
+	schedules, err := getRateSchedules(ctx, client, userId, "clinic1")
+	require.NoError(t, err)
+	require.Empty(t, schedules)
+	stored := []RateSchedule{{EffectiveFrom: "01/03/2024", PracMap: map[string]map[string]string{"Dr Aha": {"code1": "35"}}}}
+	require.NoError(t, setRateSchedules(ctx, client, userId, "clinic1", stored))
+	schedules, err = getRateSchedules(ctx, client, userId, "clinic1")
+	require.NoError(t, err)
+	require.Equal(t, stored[0].PracMap, schedules[0].PracMap)
+	require.Equal(t, "01/03/2024", schedules[0].EffectiveFrom)
+
+	deleteUser(ctx, client, userId)
+}
+
+func TestStoredAdjustments(t *testing.T) {
+	configureLogging()
+
+	os.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8080")
+	res, err := http.Get("http://localhost:8080")
+	if err != nil || res.StatusCode != http.StatusOK {
+		startEmulators(t)
+		defer stopEmulators(t)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	keys := filepath.Join(KEYPATH, KEYFILE)
+	client := initClient(ctx, keys)
+
+	userId := "testUser"
+	deleteUser(ctx, client, userId)
+	err = setCompanies(ctx, client, userId, []companyDetails{{ID: "clinic1", Name: "Test Clinic"}})
+	require.NoError(t, err)
+
+	adjustMap, err := getProviderAdjustments(ctx, client, userId, "clinic1")
+	require.NoError(t, err)
+	require.Empty(t, adjustMap)
+	stored := map[string][]Adjustments{"Dr Aha": {{Description: "Room rent", Amount: Money{Amount: 110000},
+		GSTInclusive: true, Recurrence: recurMonthly, From: "01/07/2024"}}}
+	require.NoError(t, setProviderAdjustments(ctx, client, userId, "clinic1", stored))
+	adjustMap, err = getProviderAdjustments(ctx, client, userId, "clinic1")
+	require.NoError(t, err)
+	require.Equal(t, stored, adjustMap)
+
+	deleteUser(ctx, client, userId)
+}
+
+func TestStoredBalances(t *testing.T) {
+	configureLogging()
+
+	os.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8080")
+	res, err := http.Get("http://localhost:8080")
+	if err != nil || res.StatusCode != http.StatusOK {
+		startEmulators(t)
+		defer stopEmulators(t)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	keys := filepath.Join(KEYPATH, KEYFILE)
+	client := initClient(ctx, keys)
+
+	userId := "testUser"
+	deleteUser(ctx, client, userId)
+	err = setCompanies(ctx, client, userId, []companyDetails{{ID: "clinic1", Name: "Test Clinic"}})
+	require.NoError(t, err)
+
+	ledger := firestoreLedger{ctx: ctx, client: client, userId: userId, companyId: "clinic1"}
+	entries, err := ledger.entries([]string{"Dr Aha", "Dr A/B"})
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	entry := LedgerEntry{Period: "01/03/2024 - 31/03/2024", Balance: Money{Amount: -3300, Currency: "AUD"}}
+	require.NoError(t, ledger.record(map[string]LedgerEntry{"Dr A/B": entry}))
+	entries, err = ledger.entries([]string{"Dr Aha", "Dr A/B"})
+	require.NoError(t, err)
+	entry.Provider = "Dr A/B"
+	require.Equal(t, map[string]LedgerEntry{"Dr A/B": entry}, entries)
+
+	_, err = getBalances(ctx, client, userId, "", []string{"Dr Aha"})
+	require.Error(t, err)
+
+	// a company added again does not get the balances of the one removed
+	require.NoError(t, setCompanies(ctx, client, userId, []companyDetails{{ID: "clinic2", Name: "Other Clinic"}}))
+	require.NoError(t, setCompanies(ctx, client, userId, []companyDetails{{ID: "clinic1", Name: "Test Clinic"}}))
+	entries, err = ledger.entries([]string{"Dr A/B"})
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	deleteUser(ctx, client, userId)
+}
+
+func TestInvoiceCounter(t *testing.T) {
+	configureLogging()
+
+	os.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8080")
+	res, err := http.Get("http://localhost:8080")
+	if err != nil || res.StatusCode != http.StatusOK {
+		startEmulators(t)
+		defer stopEmulators(t)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	keys := filepath.Join(KEYPATH, KEYFILE)
+	client := initClient(ctx, keys)
+
+	userId := "testUser"
+	deleteUser(ctx, client, userId)
+	err = setCompanies(ctx, client, userId, []companyDetails{{ID: "clinic1", Name: "Test Clinic"}})
+	require.NoError(t, err)
+
+	counter := firestoreCounter{ctx: ctx, client: client, userId: userId, companyId: "clinic1"}
+	take := func(data *invoiceCounterData) error {
+		data.Next = max(data.Next, 100) + 1
+		return nil
+	}
+	require.NoError(t, counter.update(take))
+	// uploads at the same time get different numbers
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, counter.update(take))
+		}()
+	}
+	wg.Wait()
+	// a failed change is not stored
+	require.Error(t, counter.update(func(data *invoiceCounterData) error {
+		data.Next = 1000
+		return fmt.Errorf("the invoices could not be made")
+	}))
+	require.NoError(t, counter.update(func(data *invoiceCounterData) error {
+		require.Equal(t, int64(106), data.Next)
+		return nil
+	}))
+
+	err = updateInvoiceCounter(ctx, client, userId, "", take)
+	require.Error(t, err)
+	deleteUser(ctx, client, userId)
+}
+
+func TestStoredInvoiceTemplate(t *testing.T) {
+	configureLogging()
+
+	os.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8080")
+	res, err := http.Get("http://localhost:8080")
+	if err != nil || res.StatusCode != http.StatusOK {
+		startEmulators(t)
+		defer stopEmulators(t)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	keys := filepath.Join(KEYPATH, KEYFILE)
+	client := initClient(ctx, keys)
+
+	userId := "testUser"
+	deleteUser(ctx, client, userId)
+	err = setCompanies(ctx, client, userId, []companyDetails{{ID: "clinic1", Name: "Test Clinic"}})
+	require.NoError(t, err)
+
+	template, err := getInvoiceTemplate(ctx, client, userId, "clinic1")
+	require.NoError(t, err)
+	require.Equal(t, InvoiceTemplate{}, template)
+	stored := InvoiceTemplate{Base: templateSummary, Sections: []string{sectionHeader, sectionTotal}, Font: "Times",
+		AccentColor: "#004080", Columns: []TemplateColumn{{Field: columnPatient, Width: 60}, {Field: columnServiceFee, Width: 30}},
+		Logo: LogoPlacement{X: 10, Y: 250, Width: 30, Height: 30}}
+	require.NoError(t, setInvoiceTemplate(ctx, client, userId, "clinic1", stored))
+	template, err = getInvoiceTemplate(ctx, client, userId, "clinic1")
+	require.NoError(t, err)
+	require.Equal(t, stored, template)
+
+	deleteUser(ctx, client, userId)
+}
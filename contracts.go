@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// FeeContract is a provider's contract for the service fee of a period, on top of or instead of the
+// percentages per service code. The contract covers the service codes listed, or all if there are none.
+// Tiers are a sliding scale on the payments ex GST of the period and replace the percentages,
+// e.g. 35% up to $20,000 and 30% above. PerConsult is a fixed fee for every consultation.
+// Minimum and Maximum limit the contract fee for the period.
+type FeeContract struct {
+	ServiceCodes []string  `json:"serviceCodes"`
+	Tiers        []FeeTier `json:"tiers"`
+	PerConsult   Money     `json:"perConsult"` // cents
+	Minimum      Money     `json:"minimum"`    // cents, 0 for no minimum
+	Maximum      Money     `json:"maximum"`    // cents, 0 for no cap
+}
+
+type FeeTier struct {
+	UpTo       Money  `json:"upTo"` // cents of payments ex GST the tier goes up to, 0 on the last tier
+	Percentage string `json:"percentage"`
+}
+
+// ContractFee is how the fee of a contract was worked out, for the service fee breakdown
+type ContractFee struct {
+	ServiceCodes []string  `json:"serviceCodes"` // the service codes of the period the contract covered
+	Base         Money     `json:"base"`         // payments ex GST of those service codes
+	LineFees     Money     `json:"lineFees"`     // the fees of the lines by percentage
+	Tiers        []TierFee `json:"tiers"`
+	Consults     int       `json:"consults"`
+	ConsultFees  Money     `json:"consultFees"`
+	Limit        Money     `json:"limit"` // added to reach the minimum or taken off to stay under the cap
+	Fee          Money     `json:"fee"`   // the fee for the period, replacing the line fees
+	// the parts of the difference between the fee and the line fees for GST-free and input taxed service codes
+	GSTFree    Money `json:"gstFree"`
+	InputTaxed Money `json:"inputTaxed"`
+}
+
+type TierFee struct {
+	From       Money  `json:"from"`
+	UpTo       Money  `json:"upTo"`
+	Base       Money  `json:"base"`
+	Percentage string `json:"percentage"`
+	Fee        Money  `json:"fee"`
+}
+
+// createContractMap keys the contracts by the standardised provider name
+func createContractMap(contracts map[string][]FeeContract) map[string][]FeeContract {
+	result := make(map[string][]FeeContract)
+	for provider, providerContracts := range contracts {
+		result[standardString(provider)] = providerContracts
+	}
+	return result
+}
+
+func (c FeeContract) validate() error {
+	for i, tier := range c.Tiers {
+		rate, err := parseRate(tier.Percentage)
+		if err != nil {
+			return fmt.Errorf("tier %v has an invalid percentage: %w", i+1, err)
+		}
+		if rate.Sign() < 0 {
+			return fmt.Errorf("tier %v percentage must not be negative: %v", i+1, tier.Percentage)
+		}
+		if i == len(c.Tiers)-1 {
+			if !tier.UpTo.IsZero() {
+				return fmt.Errorf("the last tier must be without a limit")
+			}
+		} else if tier.UpTo.Amount <= 0 || (i > 0 && tier.UpTo.Amount <= c.Tiers[i-1].UpTo.Amount) {
+			return fmt.Errorf("tier %v must go up to more than the tier before", i+1)
+		}
+	}
+	if c.PerConsult.Sign() < 0 || c.Minimum.Sign() < 0 || c.Maximum.Sign() < 0 {
+		return fmt.Errorf("fees must not be negative")
+	}
+	if c.Maximum.Sign() > 0 && c.Minimum.Amount > c.Maximum.Amount {
+		return fmt.Errorf("minimum: %v is more than the maximum: %v", c.Minimum, c.Maximum)
+	}
+	return nil
+}
+
+func validateContracts(contracts map[string][]FeeContract) error {
+	for provider, providerContracts := range contracts {
+		for _, contract := range providerContracts {
+			if err := contract.validate(); err != nil {
+				return fmt.Errorf("contract of provider: %v %w", provider, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (c FeeContract) covers(serviceCode string) bool {
+	if len(c.ServiceCodes) == 0 {
+		return true
+	}
+	for _, code := range c.ServiceCodes {
+		if strings.EqualFold(strings.TrimSpace(code), serviceCode) {
+			return true
+		}
+	}
+	return false
+}
+
+// fee works out the contract fee from the totals of the service codes it covers
+func (c FeeContract) fee(codes []string, serviceTotals map[string]ServiceTotals, rounding RoundingPolicy) (ContractFee, error) {
+	res := ContractFee{ServiceCodes: codes}
+	var sum moneySum
+	for _, code := range codes {
+		sum.add(&res.Base, serviceTotals[code].ExGstFees)
+		sum.add(&res.LineFees, serviceTotals[code].ServiceFees)
+		res.Consults += serviceTotals[code].Consults
+	}
+	if sum.err != nil {
+		return res, sum.err
+	}
+	currency := res.Base.Currency
+	res.Fee = res.LineFees
+	if len(c.Tiers) > 0 {
+		res.Fee = newMoney(0, currency)
+		from := newMoney(0, currency)
+		for i, tier := range c.Tiers {
+			base := newMoney(0, currency)
+			switch {
+			case i == 0 && res.Base.Sign() < 0:
+				// net reversals are taken back at the first rate
+				base = res.Base
+			case res.Base.Amount > from.Amount:
+				upTo := res.Base
+				if !tier.UpTo.IsZero() && res.Base.Amount > tier.UpTo.Amount {
+					upTo = tier.UpTo
+				}
+				sum.add(&base, upTo)
+				sum.sub(&base, from)
+			}
+			rate, _ := parseRate(tier.Percentage) // checked by validate
+			fee, err := rounding.money(exactFee(base, rate), currency)
+			if err != nil {
+				return res, err
+			}
+			res.Tiers = append(res.Tiers, TierFee{From: from, UpTo: tier.UpTo, Base: base, Percentage: tier.Percentage, Fee: fee})
+			sum.add(&res.Fee, fee)
+			from = tier.UpTo
+		}
+	}
+	consultFees, err := c.PerConsult.Mul(int64(res.Consults))
+	if err != nil {
+		return res, err
+	}
+	res.ConsultFees = consultFees
+	sum.add(&res.Fee, res.ConsultFees)
+	if sum.err != nil {
+		return res, sum.err
+	}
+	if c.Minimum.Sign() > 0 && res.Fee.Amount < c.Minimum.Amount {
+		sum.add(&res.Limit, c.Minimum)
+		sum.sub(&res.Limit, res.Fee)
+	}
+	if c.Maximum.Sign() > 0 && res.Fee.Amount > c.Maximum.Amount {
+		sum.add(&res.Limit, c.Maximum)
+		sum.sub(&res.Limit, res.Fee)
+	}
+	sum.add(&res.Fee, res.Limit)
+	return res, sum.err
+}
+
+// applyContracts replaces the line fees of the service codes covered by a contract with the contract fee.
+// The difference is booked on the first location, same as the adjustments.
+func (p *PaymentTotals) applyContracts(contracts []FeeContract, rounding RoundingPolicy, tax TaxConfig) error {
+	p.Contracts = nil
+	for i, contract := range contracts {
+		codes := []string{}
+		for _, code := range sortedServiceCodes(p.ServiceCodeSplit) {
+			if contractIndex(contracts, code) == i {
+				codes = append(codes, code)
+			}
+		}
+		if len(codes) == 0 && contract.Minimum.IsZero() {
+			continue
+		}
+		res, err := contract.fee(codes, p.ServiceCodeSplit, rounding)
+		if err != nil {
+			return err
+		}
+		difference, err := res.Fee.Sub(res.LineFees)
+		if err != nil {
+			return err
+		}
+		if err := res.splitTax(difference, p.ServiceCodeSplit, tax, rounding); err != nil {
+			return err
+		}
+		var sum moneySum
+		sum.add(&p.ServiceCutTotal, difference)
+		if locations := sortedLocations(p.LocationSplit); len(locations) > 0 {
+			first := p.LocationSplit[locations[0]]
+			sum.add(&first.ServiceCutTotal, difference)
+			first.Contracts = append(first.Contracts, res)
+			p.LocationSplit[locations[0]] = first
+		}
+		if sum.err != nil {
+			return sum.err
+		}
+		p.Contracts = append(p.Contracts, res)
+	}
+	return nil
+}
+
+// splitTax books the difference between the contract fee and the line fees by the tax treatment of
+// the service codes it covers, in proportion to their payments ex GST. The rest is taxable.
+func (res *ContractFee) splitTax(difference Money, serviceTotals map[string]ServiceTotals, tax TaxConfig,
+	rounding RoundingPolicy) error {
+	res.GSTFree = newMoney(0, difference.Currency)
+	res.InputTaxed = newMoney(0, difference.Currency)
+	bases := map[string]Money{}
+	total := newMoney(0, difference.Currency)
+	var sum moneySum
+	for _, code := range res.ServiceCodes {
+		treatment := tax.codeTax(code)
+		base := bases[treatment]
+		if base.Currency == "" {
+			base = newMoney(0, difference.Currency)
+		}
+		sum.add(&base, serviceTotals[code].ExGstFees)
+		sum.add(&total, serviceTotals[code].ExGstFees)
+		bases[treatment] = base
+	}
+	if sum.err != nil {
+		return sum.err
+	}
+	parts := map[string]*Money{taxGSTFree: &res.GSTFree, taxInputTaxed: &res.InputTaxed}
+	for treatment, part := range parts {
+		base, ok := bases[treatment]
+		switch {
+		case !ok:
+		case len(bases) == 1:
+			// all the codes are treated alike, even without payments
+			*part = difference
+		case !total.IsZero():
+			share := new(big.Rat).Mul(difference.rat(), base.rat())
+			amount, err := rounding.money(share.Quo(share, total.rat()), difference.Currency)
+			if err != nil {
+				return err
+			}
+			*part = amount
+		}
+	}
+	return nil
+}
+
+// contractIndex is the index of the first contract covering the service code, or -1
+func contractIndex(contracts []FeeContract, serviceCode string) int {
+	for i, contract := range contracts {
+		if contract.covers(serviceCode) {
+			return i
+		}
+	}
+	return -1
+}
+
+// contractRate returns "0" for service codes whose fee comes from the tiers of a contract,
+// their lines carry no fee of their own
+func contractRate(contracts []FeeContract, serviceCode string) (string, bool) {
+	if i := contractIndex(contracts, serviceCode); i >= 0 && len(contracts[i].Tiers) > 0 {
+		return "0", true
+	}
+	return "", false
+}
+
+// contractCovers is true if the fee of the service code comes from a contract
+func contractCovers(contracts []FeeContract, serviceCode string) bool {
+	return contractIndex(contracts, serviceCode) >= 0
+}
+
+func sortedServiceCodes(serviceTotals map[string]ServiceTotals) []string {
+	codes := make([]string, 0, len(serviceTotals))
+	for code := range serviceTotals {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
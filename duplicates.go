@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+)
+
+// paymentHistory remembers the payment lines of files processed earlier,
+// so a re-uploaded or overlapping report period is not charged twice
+type paymentHistory interface {
+	// processed returns which of the keys were processed before
+	processed(keys []string) (map[string]bool, error)
+	// record remembers the keys as processed
+	record(keys []string) error
+}
+
+// duplicateKey identifies a payment line by its Payment ID and Service ID.
+// The category is part of the key as a reversal repeats the IDs of the payment it reverses.
+// Lines without any ID cannot be told apart and return "".
+func duplicateKey(category string, line PaymentLine) string {
+	paymentID := strings.TrimSpace(line.PaymentID)
+	serviceID := strings.TrimSpace(line.ServiceID)
+	if paymentID == "" && serviceID == "" {
+		return ""
+	}
+	// the key is used as a firestore document id, which must not contain a "/"
+	key := category + "_" + paymentID + "_" + serviceID
+	return strings.ReplaceAll(key, "/", "-")
+}
+
+// firestoreHistory keeps the processed payments under the user's company details
+type firestoreHistory struct {
+	ctx       context.Context
+	client    *firestore.Client
+	userId    string
+	companyId string
+}
+
+func (h firestoreHistory) processed(keys []string) (map[string]bool, error) {
+	return getProcessedPayments(h.ctx, h.client, h.userId, h.companyId, keys)
+}
+
+func (h firestoreHistory) record(keys []string) error {
+	return setProcessedPayments(h.ctx, h.client, h.userId, h.companyId, keys)
+}
@@ -0,0 +1,49 @@
+package main
+
+import "strings"
+
+// FeeRule sets the percentage of a provider's service code for lines with a particular
+// account type (Medicare, Private, DVA) and/or payment method. Blank fields match any line.
+type FeeRule struct {
+	ServiceCode   string `json:"serviceCode"`
+	AccountType   string `json:"accountType"`
+	PaymentMethod string `json:"paymentMethod"`
+	Percentage    string `json:"percentage"`
+}
+
+// createFeeRuleMap keys the rules by the standardised provider name, same as createProviderMap
+func createFeeRuleMap(feeRules map[string][]FeeRule) map[string][]FeeRule {
+	result := make(map[string][]FeeRule)
+	for provider, rules := range feeRules {
+		result[standardString(provider)] = rules
+	}
+	return result
+}
+
+// matchFeeRule returns the most specific rule matching the line, the first one if several are equally specific
+func matchFeeRule(rules []FeeRule, serviceCode string, line PaymentLine) (FeeRule, bool) {
+	best := FeeRule{}
+	bestScore := -1
+	for _, rule := range rules {
+		score := 0
+		matches := true
+		for _, m := range []struct{ want, got string }{
+			{rule.ServiceCode, serviceCode},
+			{rule.AccountType, line.AccountType},
+			{rule.PaymentMethod, line.PaymentMethod},
+		} {
+			if strings.TrimSpace(m.want) == "" {
+				continue
+			}
+			if standardString(m.want) != standardString(m.got) {
+				matches = false
+				break
+			}
+			score++
+		}
+		if matches && score > bestScore {
+			best, bestScore = rule, score
+		}
+	}
+	return best, bestScore >= 0
+}
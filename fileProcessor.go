@@ -6,7 +6,11 @@ import (
 	"encoding/csv"
 	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	"sort"
 	"strings"
+	"time"
 )
 
 type ServiceCut struct {
@@ -26,10 +30,38 @@ type PaymentFile struct {
 	FileContent    string                       `json:"fileContent"`
 	CsvLineStart   int                          `json:"csvLineStart"`
 	CompanyDetails Address                      `json:"companyDetails"`
-	CodeMap        map[string][]string          `json:"codeMap"`
+	CodeMap        map[string][]string          `json:"codeMap"` // item numbers, ranges "80000-80170", prefixes "800*" or descriptions
 	PracMap        map[string]map[string]string `json:"pracMap"`
 	PracDetails    map[string]Address           `json:"pracDetails"`
 	AdjustMap      map[string][]Adjustments     `json:"adjustMap"` // maps providers to adjustments
+	ColumnMap      map[string]string            `json:"columnMap"` // overrides the header title or position per field
+	Importer       string                       `json:"importer"`  // export layout, detected from the header if blank
+	FileType       string                       `json:"fileType"`  // "csv" (default) or "xlsx" with base64 FileContent
+	Sheet          string                       `json:"sheet"`     // xlsx sheet name, the first sheet if blank
+	CompanyID      string                       `json:"companyId"`
+	CheckHistory   bool                         `json:"checkHistory"` // check and remember payments across uploads
+	FeeRules       map[string][]FeeRule         `json:"feeRules"`     // percentages by account type or payment method per provider
+	// maps locations to providers to service codes and their percentage at that location
+	LocationPracMap    map[string]map[string]map[string]string `json:"locationPracMap"`
+	InvoicePerLocation bool                                    `json:"invoicePerLocation"` // else one invoice with a location breakdown
+	Strict             bool                                    `json:"strict"`             // fail on the first invalid amount or percentage
+	ReportPeriod       string                                  `json:"reportPeriod"`       // "DD/MM/YYYY - DD/MM/YYYY" for files without a period
+	Rounding           RoundingPolicy                          `json:"rounding"`           // of the company, half up per line if not set
+	Tax                TaxConfig                               `json:"tax"`                // GST setup of the company, 10% on everything if not set
+	Contracts          map[string][]FeeContract                `json:"contracts"`          // tiered, capped and per consultation fees per provider
+	Schedules          []RateSchedule                          `json:"schedules"`          // code and provider maps by Transaction Date
+	LoadSchedules      bool                                    `json:"loadSchedules"`      // use the schedules stored for the company
+	LoadAdjustments    bool                                    `json:"loadAdjustments"`    // add the adjustments stored per provider
+	Currency           string                                  `json:"currency"`           // of the amounts in the file, AUD if blank
+	Balance            BalancePolicy                           `json:"balance"`            // how negative and small totals are settled
+	MatchConfidence    float64                                 `json:"matchConfidence"`    // descriptions matched with less are confirmed first, 0.85 if not set
+	Numbering          InvoiceNumbering                        `json:"numbering"`          // prefix and format of the invoice numbers
+	Template           InvoiceTemplate                         `json:"template"`           // layout of the invoices, the standard layout if not set
+	LoadTemplate       bool                                    `json:"loadTemplate"`       // use the template stored for the company
+	CreationDate       string                                  `json:"creationDate"`       // DD/MM/YYYY, fixes the dates in the PDFs and the package so they can be diffed
+	history            paymentHistory                          // set when CheckHistory is requested by an authorised user
+	ledger             balanceLedger                           // set when balances are carried forward for an authorised user
+	counter            invoiceCounter                          // the invoice counter of the company, set for an authorised user
 }
 
 type FileProcessingResponse struct {
@@ -37,60 +69,187 @@ type FileProcessingResponse struct {
 	MissingItemNrs      map[string]string            `json:"missingItemNrs"`
 	NoItemNrs           map[string]string            `json:"noItemNrs"`
 	MissingServiceCodes map[string]map[string]string `json:"missingServiceCodes"`
+	UnknownStatuses     map[string]string            `json:"unknownStatuses"`
+	Duplicates          map[string]string            `json:"duplicates"`
+	DescriptionMatches  map[string]ItemMatch         `json:"descriptionMatches"` // descriptions matched other than exactly
+	Issues              []ValidationIssue            `json:"issues"`
+	PeriodStart         string                       `json:"periodStart"` // DD/MM/YYYY, blank if the period is not known
+	PeriodEnd           string                       `json:"periodEnd"`
+	Rounding            RoundingPolicy               `json:"rounding"` // the policy the fees were rounded with
 	ChargeDetail        map[string]PaymentTotals     `json:"chargeDetail"`
 	InvoicePackage      []byte                       `json:"invoicePackage"`
 }
 
 type PaymentFileResponse struct {
-	Provider     string     `json:"provider"`
-	Patient      string     `json:"patient"`
-	TransDate    string     `json:"transDate"`
-	InvoiceNo    string     `json:"invoiceNo"`
-	ItemNo       string     `json:"ItemNo"`
-	Service      ServiceCut `json:"service"`
-	Payment      string     `json:"payment"`
-	GST          int        `json:"gst"`
-	TotalPayment string     `json:"totalPayment"`
-	ServiceFee   string     `json:"serviceFee"`
-}
-
-type Adjustments struct {
-	Description string `json:"description"`
-	Amount      int    `json:"amount"`
+	Provider      string     `json:"provider"`
+	Location      string     `json:"location"`
+	Patient       string     `json:"patient"`
+	TransDate     string     `json:"transDate"`
+	InvoiceNo     string     `json:"invoiceNo"`
+	ItemNo        string     `json:"ItemNo"`
+	Service       ServiceCut `json:"service"`
+	Payment       Money      `json:"payment"`
+	GST           Money      `json:"gst"`
+	TotalPayment  Money      `json:"totalPayment"`
+	ServiceFee    Money      `json:"serviceFee"`
+	Status        string     `json:"status"`       // payment, reversal or refund
+	OriginalDate  string     `json:"originalDate"` // date of the payment a reversal takes back, if it is in the file
+	PaymentMethod string     `json:"paymentMethod"`
+	AccountType   string     `json:"accountType"`
+	Deposit       Money      `json:"deposit"`
 }
 
 type PaymentTotals struct {
 	Provider            string                   `json:"provider"`
+	Location            string                   `json:"location"` // set on the totals of the LocationSplit
 	PaymentDetails      []PaymentFileResponse    `json:"paymentDetails"`
-	PaymentTotalWithGST int                      `json:"paymentTotal"`
-	PaymentTotalNoGST   int                      `json:"PaymentTotalWithGST"`
-	ServiceCutTotal     int                      `json:"serviceCutTotal"`
-	GSTTotal            int                      `json:"gstTotal"`
-	AdjustmentTotal     int                      `json:"adjustmentTotal"`
+	PaymentTotalWithGST Money                    `json:"paymentTotalWithGst"` // payments of lines with GST
+	PaymentTotalNoGST   Money                    `json:"paymentTotalNoGst"`   // payments of lines without GST
+	ServiceCutTotal     Money                    `json:"serviceCutTotal"`
+	GSTTotal            Money                    `json:"gstTotal"`
+	AdjustmentTotal     Money                    `json:"adjustmentTotal"`
+	DepositTotal        Money                    `json:"depositTotal"`
+	TaxableTotal        Money                    `json:"taxableTotal"`    // service fees and adjustments the invoice GST is charged on
+	GSTFreeTotal        Money                    `json:"gstFreeTotal"`    // service fees and adjustments which are GST-free
+	InputTaxedTotal     Money                    `json:"inputTaxedTotal"` // service fees and adjustments which are input taxed
+	InvoiceGST          Money                    `json:"invoiceGst"`      // GST charged on the invoice
+	Deposits            []PaymentFileResponse    `json:"deposits"`        // deposits are held for future services and carry no fee
+	Adjustments         []AdjustmentLine         `json:"adjustments"`     // as charged on the invoice
 	PdfFile             []byte                   `json:"invoice"`
 	ServiceCodeSplit    map[string]ServiceTotals `json:"serviceCodeSplit"`
+	LocationSplit       map[string]PaymentTotals `json:"locationSplit"`  // the same totals per location
+	Contracts           []ContractFee            `json:"contracts"`      // how the contract fees were worked out
+	BroughtForward      Money                    `json:"broughtForward"` // balance carried forward from the periods before
+	AmountDue           Money                    `json:"amountDue"`      // service fees, adjustments, GST and the balance brought forward
+	CarriedForward      Money                    `json:"carriedForward"` // balance carried forward to the next period
+	Document            string                   `json:"document"`       // invoice, creditNote or carriedForward
+	InvoiceNumber       string                   `json:"invoiceNumber"`  // of the invoice or credit note
+	exactFees           *big.Rat                 // the service fees before rounding, for rounding on the total
 }
 
-func (p *PaymentTotals) TotalPayments(gst int, payment int, serviceFee int) {
-	if gst > 0 {
-		p.PaymentTotalWithGST += payment
+func (p *PaymentTotals) TotalPayments(gst Money, payment Money, serviceFee Money) error {
+	var sum moneySum
+	if !gst.IsZero() {
+		sum.add(&p.PaymentTotalWithGST, payment)
 	} else {
-		p.PaymentTotalNoGST += payment
+		sum.add(&p.PaymentTotalNoGST, payment)
+	}
+	sum.add(&p.ServiceCutTotal, serviceFee)
+	sum.add(&p.GSTTotal, gst)
+	return sum.err
+}
+
+// addPayment adds the payment line to the totals and to the totals of its location
+func (p *PaymentTotals) addPayment(payment PaymentFileResponse, exGst Money, exactFee *big.Rat) error {
+	if err := p.addLine(payment, exGst, exactFee); err != nil {
+		return err
+	}
+	location := p.locationTotals(payment.Location)
+	if err := location.addLine(payment, exGst, exactFee); err != nil {
+		return err
+	}
+	p.LocationSplit[payment.Location] = location
+	return nil
+}
+
+func (p *PaymentTotals) addLine(payment PaymentFileResponse, exGst Money, exactFee *big.Rat) error {
+	serviceTotals := p.ServiceCodeSplit[payment.Service.Code]
+	if err := p.TotalPayments(payment.GST, payment.TotalPayment, payment.ServiceFee); err != nil {
+		return err
+	}
+	p.exactFees = addExactFee(p.exactFees, exactFee)
+	if err := serviceTotals.TotalServiceCodes(payment.Service.Percentage, payment.ServiceFee, exGst); err != nil {
+		return err
+	}
+	if err := serviceTotals.addRate(payment.Service.Percentage, payment.ServiceFee, exGst, exactFee); err != nil {
+		return err
+	}
+	serviceTotals.exactFees = addExactFee(serviceTotals.exactFees, exactFee)
+	p.ServiceCodeSplit[payment.Service.Code] = serviceTotals
+	p.PaymentDetails = append(p.PaymentDetails, payment)
+	return nil
+}
+
+func (p *PaymentTotals) TotalDeposits(deposit PaymentFileResponse) error {
+	var sum moneySum
+	location := p.locationTotals(deposit.Location)
+	sum.add(&p.DepositTotal, deposit.Deposit)
+	sum.add(&location.DepositTotal, deposit.Deposit)
+	if sum.err != nil {
+		return sum.err
+	}
+	p.Deposits = append(p.Deposits, deposit)
+	location.Deposits = append(location.Deposits, deposit)
+	p.LocationSplit[deposit.Location] = location
+	return nil
+}
+
+// sortedProviders returns the providers of the totals in alphabetical order
+func sortedProviders(totalsMap map[string]PaymentTotals) []string {
+	providers := make([]string, 0, len(totalsMap))
+	for provider := range totalsMap {
+		providers = append(providers, provider)
+	}
+	sort.Strings(providers)
+	return providers
+}
+
+// providerTotals returns the totals of the provider, creating them if this is the first line
+func providerTotals(totalsMap map[string]PaymentTotals, provider string) PaymentTotals {
+	totals, exists := totalsMap[provider]
+	if !exists {
+		totals = PaymentTotals{Provider: provider}
+		totals.ServiceCodeSplit = make(map[string]ServiceTotals)
 	}
-	p.ServiceCutTotal += serviceFee
-	p.GSTTotal += gst
+	return totals
 }
 
 type ServiceTotals struct {
-	ExGstFees   int    `json:"exgstfees"`
-	ServiceFees int    `json:"serviceFees"`
+	ExGstFees   Money  `json:"exgstfees"`   // the payments without GST, they held the service fees before the rounding policy
+	ServiceFees Money  `json:"serviceFees"` // the service fees, they held the payments without GST before the rounding policy
 	Rate        string `json:"rate"`
+	Consults    int    `json:"consults"` // payments less reversals
+	// the same totals per rate, when the rate changed during the period
+	RateSplit map[string]ServiceTotals `json:"rateSplit,omitempty"`
+	exactFees *big.Rat
 }
 
-func (p *ServiceTotals) TotalServiceCodes(rate string, serviceFee int, payment int) {
-	p.ExGstFees += payment
-	p.ServiceFees += serviceFee
+func (p *ServiceTotals) TotalServiceCodes(rate string, serviceFee Money, payment Money) error {
+	var sum moneySum
+	sum.add(&p.ExGstFees, payment)
+	sum.add(&p.ServiceFees, serviceFee)
+	if sum.err != nil {
+		return sum.err
+	}
 	p.Rate = rate
+	if payment.Sign() < 0 {
+		p.Consults--
+	} else {
+		p.Consults++
+	}
+	return nil
+}
+
+// addRate keeps the totals per rate, so a rate change during the period shows on the breakdown
+func (p *ServiceTotals) addRate(rate string, serviceFee Money, payment Money, exactFee *big.Rat) error {
+	if p.RateSplit == nil {
+		p.RateSplit = make(map[string]ServiceTotals)
+	}
+	rateTotals := p.RateSplit[rate]
+	if err := rateTotals.TotalServiceCodes(rate, serviceFee, payment); err != nil {
+		return err
+	}
+	rateTotals.exactFees = addExactFee(rateTotals.exactFees, exactFee)
+	p.RateSplit[rate] = rateTotals
+	return nil
+}
+
+// addExactFee keeps the sum of the service fees before rounding
+func addExactFee(total *big.Rat, fee *big.Rat) *big.Rat {
+	if total == nil {
+		return new(big.Rat).Set(fee)
+	}
+	return new(big.Rat).Add(total, fee)
 }
 
 var (
@@ -114,84 +273,290 @@ var (
 // Status, Transaction, Date, Payment Method, Account Type, GST ($ incl GST), Payment ($ incl GST), Deposit ($ incl GST)
 //
 // Required: 0 Location, 1 Provider, 8 itemNum, 9 Description, 15 GST, 16 Payment, 17 Deposit
+// The columns are found by title in the header row, see columns.go. Other export layouts are
+// turned into the same payment lines by an Importer, see importer.go.
 // Location,Provider,Billed To,Patient Name,Invoice No.,Service ID,Payment ID,Item No.,Description,Status,Transaction Date,Payment Method,Account Type,"GST
 // ClinicName,Dr Phoebe Kho,Irrelevant,Patient Name,162307,174545,71756,80010,"Clinical psychologist consultation, >50 min, consulting rooms",Reversed payment,01/03/2024,EFT,Private,0.00,(224.50),0.00
 
 func processFileContent(content PaymentFile) (FileProcessingResponse, error) {
 
-	//location := 0
-	providerField := 1
-	patientField := 3
-	invoiceNumField := 4
-	itemNumField := 7
-	descriptionField := 8
-	transDateField := 10
-	GSTField := 13
-	paymentField := 14
-
 	fileRes := FileProcessingResponse{}
 	fileRes.MissingProviders = map[string]string{}
 	fileRes.MissingItemNrs = map[string]string{}
 	fileRes.NoItemNrs = map[string]string{}
 	fileRes.MissingServiceCodes = make(map[string]map[string]string)
+	fileRes.UnknownStatuses = map[string]string{}
+	fileRes.Duplicates = map[string]string{}
+	fileRes.DescriptionMatches = map[string]ItemMatch{}
 
 	providerTotalsMap := map[string]PaymentTotals{}
 	providerWithErrors := map[string]string{}
 
-	reader := csv.NewReader(strings.NewReader(content.FileContent))
-	records, err := reader.ReadAll()
+	rounding, err := content.Rounding.withDefaults()
 	if err != nil {
-		return fileRes, processError(fmt.Sprintf("Reading csv file failed with error: %v", err))
+		return fileRes, processError(fmt.Sprintf("Invalid rounding policy: %v", err))
+	}
+	fileRes.Rounding = rounding
+	if err := content.Tax.validate(content.AdjustMap); err != nil {
+		return fileRes, processError(fmt.Sprintf("Invalid tax configuration: %v", err))
+	}
+	if err := validateAdjustments(content.AdjustMap); err != nil {
+		return fileRes, processError(fmt.Sprintf("Invalid adjustment: %v", err))
+	}
+	settings := invoiceSettings{rounding: rounding, tax: content.Tax}
+	currency := strings.ToUpper(strings.TrimSpace(content.Currency))
+	if currency == "" {
+		currency = defaultCurrency
+	}
+	if err := validCurrency(currency); err != nil {
+		return fileRes, processError(fmt.Sprintf("Invalid currency: %v", err))
+	}
+	if err := validateContracts(content.Contracts); err != nil {
+		return fileRes, processError(fmt.Sprintf("Invalid fee contract: %v", err))
+	}
+	if err := content.Balance.validate(); err != nil {
+		return fileRes, processError(fmt.Sprintf("Invalid balance policy: %v", err))
+	}
+	matchConfidence, err := validMatchConfidence(content.MatchConfidence)
+	if err != nil {
+		return fileRes, processError(fmt.Sprintf("Invalid match confidence: %v", err))
+	}
+	if err := content.Numbering.validate(); err != nil {
+		return fileRes, processError(fmt.Sprintf("Invalid invoice numbering: %v", err))
+	}
+	if settings.layout, err = content.Template.layout(); err != nil {
+		return fileRes, processError(fmt.Sprintf("Invalid invoice template: %v", err))
+	}
+	if strings.TrimSpace(content.CreationDate) != "" {
+		if settings.created, err = parseDate(content.CreationDate); err != nil {
+			return fileRes, processError(fmt.Sprintf("Invalid creation date: %v", err))
+		}
+	}
+	counter := content.counter
+	if counter == nil {
+		fileRes.Issues = append(fileRes.Issues, ValidationIssue{Code: issueNotNumbered, Severity: severityWarning,
+			Message: "invoices are not numbered without a companyId, the numbers would repeat with every upload"})
 	}
 
-	lineNum, records, reportPeriod, companyName, err := getHeaderDetails(records)
+	records, positions, err := readRecords(content)
 	if err != nil {
-		logError.Printf("Reading csv file failed with error: %v", err)
+		return fileRes, processError(fmt.Sprintf("Reading %v file failed with error: %v", fileType(content), err))
+	}
+
+	importer, err := selectImporter(content.Importer, records)
+	if err != nil {
+		return fileRes, processError(fmt.Sprintf("Reading %v file failed with error: %v", fileType(content), err))
+	}
+	imported, err := importer.Import(records, positions, content.ColumnMap)
+	if err != nil {
+		return fileRes, processError(fmt.Sprintf("Reading %v file failed with error: %v", importer.Name(), err))
+	}
+	fileRes.Issues = append(fileRes.Issues, imported.Issues...)
+	companyName := imported.CompanyName
+	//
+	// The period the file covers, lines outside of it are flagged
+	//
+	periodText := imported.ReportPeriod
+	if strings.TrimSpace(periodText) == "" {
+		periodText = content.ReportPeriod
+	}
+	reportPeriod, err := parseReportPeriod(periodText)
+	if err != nil && strings.TrimSpace(periodText) != "" {
+		logError.Printf("Reading report period failed with error: %v", err)
+		fileRes.Issues = append(fileRes.Issues, ValidationIssue{Value: periodText, Code: issueInvalidPeriod,
+			Severity: severityWarning, Message: err.Error()})
+	}
+	if reportPeriod.isSet() {
+		fileRes.PeriodStart = reportPeriod.Start.Format(dateLayout)
+		fileRes.PeriodEnd = reportPeriod.End.Format(dateLayout)
 	}
 
 	itemMap := createItemMap(content.CodeMap)
+	items := newItemMatcher(itemMap)
 	providerMap := createProviderMap(content.PracMap)
+	feeRules := createFeeRuleMap(content.FeeRules)
+	locationPracMap := createLocationPracMap(content.LocationPracMap)
+	contracts := createContractMap(content.Contracts)
+	scheduleMaps, err := createScheduleMaps(content.Schedules, itemMap, providerMap)
+	if err != nil {
+		return fileRes, processError(fmt.Sprintf("Invalid rate schedule: %v", err))
+	}
+	originals := originalPayments(imported.Lines)
+	previous, err := previouslyProcessed(content.history, imported.Lines)
+	if err != nil {
+		return fileRes, processError(fmt.Sprintf("Checking for payments processed before failed with error: %v", err))
+	}
+	seenLines := map[string]int{}
+	invoicedKeys := map[string][]string{}
 
-	for _, record := range records {
-		if len(record) < paymentField {
-			logError.Printf("Reading csv file failed with error: not enough fields in line: %v", lineNum)
-			continue
-		}
-		lineNum++
+	for _, line := range imported.Lines {
+		lineNum := line.LineNum
 		//
 		// Skip blank lines
 		//
-		provider := strings.TrimSpace(record[providerField])
+		provider := strings.TrimSpace(line.Provider)
 		if provider == "" {
 			continue
 		}
-		itemNr := strings.TrimSpace(record[itemNumField])
-		itemDesc := strings.TrimSpace(record[descriptionField])
+		//
+		// Voided lines never moved any money. An unknown status stops the invoice
+		// for that provider, we cannot tell if the line should be charged
+		//
+		category, known := classifyStatus(line.Status)
+		if !known {
+			errStr := fmt.Sprintf("provider: %v in line: %v has unknown status: %v", provider, lineNum, line.Status)
+			fileRes.UnknownStatuses[line.Status] = errStr
+			fileRes.addIssue(line, colStatus, line.Status, issueUnknownStatus, severityError, errStr)
+			providerWithErrors[provider] = provider
+			continue
+		}
+		if category == statusVoid {
+			continue
+		}
+		if reportPeriod.isSet() {
+			if date, err := parseDate(line.TransDate); err != nil {
+				fileRes.addIssue(line, colTransDate, line.TransDate, issueInvalidDate, severityWarning,
+					fmt.Sprintf("provider: %v in line: %v has an invalid transaction date. Cause: %v", provider, lineNum, err))
+			} else if !reportPeriod.contains(date) {
+				fileRes.addIssue(line, colTransDate, line.TransDate, issueOutOfPeriod, severityWarning,
+					fmt.Sprintf("provider: %v in line: %v has transaction date: %v outside the report period: %v",
+						provider, lineNum, line.TransDate, reportPeriod))
+			}
+		}
+		//
+		// The same payment twice, in this file or in an earlier upload, must not be charged twice
+		//
+		key := duplicateKey(category, line)
+		if key != "" {
+			if first, exists := seenLines[key]; exists {
+				errStr := fmt.Sprintf("provider: %v in line: %v duplicates line: %v", provider, lineNum, first)
+				fileRes.Duplicates[key] = errStr
+				fileRes.addIssue(line, colPaymentID, line.PaymentID, issueDuplicate, severityWarning, errStr)
+				continue
+			}
+			seenLines[key] = lineNum
+			if previous[key] {
+				errStr := fmt.Sprintf("provider: %v in line: %v was processed in an earlier upload", provider, lineNum)
+				fileRes.Duplicates[key] = errStr
+				fileRes.addIssue(line, colPaymentID, line.PaymentID, issueDuplicate, severityWarning, errStr)
+				continue
+			}
+		}
+		itemNr := strings.TrimSpace(line.ItemNo)
+		itemDesc := strings.TrimSpace(line.Description)
+		location := strings.TrimSpace(line.Location)
 
-		providerServiceCodes, ok := providerMap[standardString(provider)]
+		//
+		// The maps of the rate schedule in effect on the day of the line
+		//
+		lineItems, lineProviderMap := items, providerMap
+		if date, err := parseDate(line.TransDate); err == nil && len(scheduleMaps) > 0 {
+			if schedule, found := scheduleFor(scheduleMaps, date); found {
+				lineItems, lineProviderMap = schedule.items, schedule.providers
+			}
+		}
+		providerServiceCodes, ok := lineProviderMap[standardString(provider)]
 		if !ok {
 			fileRes.MissingProviders[provider] = standardString(provider)
+			fileRes.addIssue(line, colProvider, provider, issueMissingProvider, severityError,
+				fmt.Sprintf("provider: %v in line: %v is not in the provider list", provider, lineNum))
 			continue
 		}
 		//
-		// if there is no item number we use the description to map to the service code
+		// Deposits are money held for future services. They are totalled on their own and carry no service fee.
 		//
+		deposit, err := parseMoney(line.Deposit, currency)
+		if strings.TrimSpace(line.Deposit) == "" {
+			deposit, err = newMoney(0, currency), nil
+		}
+		if err != nil {
+			errStr := fmt.Sprintf("provider: %v in line: %v value: %v. Cause: %v", provider, lineNum, line.Deposit,
+				fmt.Errorf("%w %w", ErrAmount, err))
+			if content.Strict {
+				return fileRes, processError(errStr)
+			}
+			logError.Print(errStr)
+			fileRes.addIssue(line, colDeposit, line.Deposit, amountIssueCode(err), severityError, errStr)
+			providerWithErrors[provider] = provider
+			continue
+		}
+		if !deposit.IsZero() {
+			if isReversal(category) && deposit.Sign() > 0 {
+				deposit = deposit.Neg()
+			}
+			totals := providerTotals(providerTotalsMap, provider)
+			err := totals.TotalDeposits(PaymentFileResponse{
+				Provider:      provider,
+				Location:      location,
+				Patient:       line.Patient,
+				TransDate:     line.TransDate,
+				InvoiceNo:     line.InvoiceNo,
+				ItemNo:        itemNr,
+				Status:        category,
+				PaymentMethod: line.PaymentMethod,
+				AccountType:   line.AccountType,
+				Deposit:       deposit,
+			})
+			if err != nil {
+				errStr := fmt.Sprintf("provider: %v in line: %v deposit: %v could not be added up. Cause: %v",
+					provider, lineNum, line.Deposit, err)
+				logError.Print(errStr)
+				fileRes.addIssue(line, colDeposit, line.Deposit, issueCalculation, severityError, errStr)
+				providerWithErrors[provider] = provider
+				continue
+			}
+			providerTotalsMap[provider] = totals
+			if payment, err := parseMoney(line.Payment, currency); err == nil && payment.IsZero() {
+				continue
+			}
+		}
+		//
+		// if there is no item number we use the description to map to the service code.
+		// Descriptions which are only close to one in the CodeMap are confirmed before they are used.
+		//
+		match, itemFound := lineItems.match(itemNr, itemDesc, matchConfidence)
 		if itemNr == "" {
 			itemNr = itemDesc
 		}
-		serviceCode, itemFound := itemMap[itemNr]
+		if match.MatchedBy == matchDescription || match.MatchedBy == matchFuzzy {
+			fileRes.DescriptionMatches[itemNr] = match
+		}
+		serviceCode := match.ServiceCode
 		if !itemFound {
+			serviceCode = ""
 			if itemNr == "" {
 				fileRes.NoItemNrs[itemNr] = itemNr
+				fileRes.addIssue(line, colItemNum, itemNr, issueNoItemNr, severityError,
+					fmt.Sprintf("provider: %v in line: %v has no item number or description", provider, lineNum))
+			} else if match.ServiceCode != "" {
+				fileRes.addIssue(line, colDescription, itemNr, issueLowConfidenceMatch, severityError,
+					fmt.Sprintf("provider: %v in line: %v has description: %v which is %.0f%% like: %v of service code: %v, add it to the CodeMap to confirm",
+						provider, lineNum, itemNr, match.Confidence*100, match.Entry, match.ServiceCode))
 			} else {
 				fileRes.MissingItemNrs[itemNr] = itemNr
+				fileRes.addIssue(line, colItemNum, itemNr, issueMissingItemNr, severityError,
+					fmt.Sprintf("provider: %v in line: %v has item: %v which has no service code", provider, lineNum, itemNr))
 			}
 			providerWithErrors[provider] = provider
 		}
 		//
-		// Once we have a service code, get the percentage per provider for that service code
+		// Once we have a service code, get the percentage per provider for that service code.
+		// A percentage for the location overrides it and a fee rule for the type of billing overrides both.
+		// Lines of service codes whose fee comes from the tiers of a contract carry no fee of their own.
 		//
 		serviceCut, ok := providerServiceCodes[serviceCode]
+		if locationCut, found := locationPercentage(locationPracMap, location, provider, serviceCode); found {
+			serviceCut, ok = locationCut, true
+		}
+		if rule, found := matchFeeRule(feeRules[standardString(provider)], serviceCode, line); found && itemFound {
+			serviceCut, ok = rule.Percentage, true
+		}
+		providerContracts := contracts[standardString(provider)]
+		if contractCut, found := contractRate(providerContracts, serviceCode); found && itemFound {
+			serviceCut, ok = contractCut, true
+		} else if !ok && itemFound && contractCovers(providerContracts, serviceCode) {
+			serviceCut, ok = "0", true
+		}
 		if itemFound && !ok {
 			errStr := fmt.Sprintf("provider: %v in line: %v has no service cut assigned for service code: %v",
 				provider, lineNum, serviceCode)
@@ -199,6 +564,7 @@ func processFileContent(content PaymentFile) (FileProcessingResponse, error) {
 				fileRes.MissingServiceCodes[provider] = make(map[string]string)
 			}
 			fileRes.MissingServiceCodes[provider][serviceCode] = errStr
+			fileRes.addIssue(line, colItemNum, itemNr, issueMissingServiceCode, severityError, errStr)
 			providerWithErrors[provider] = provider
 		}
 		//
@@ -208,70 +574,151 @@ func processFileContent(content PaymentFile) (FileProcessingResponse, error) {
 			continue
 		}
 		// Make the calculations for the service fee and exGst
-		exGst, feeCents, paymentCents, gstCents, err := calcPayment(record[paymentField], record[GSTField], serviceCut)
+		payment := line.Payment
+		exGst, fee, paymentAmount, gstAmount, err := calcExactPayment(payment, line.GST, serviceCut, currency)
 		if err != nil {
+			column, value, code := colPayment, payment, issueInvalidAmount
+			errStr := ""
 			if errors.Is(err, ErrAmount) {
-				return fileRes, processError(fmt.Sprintf("provider: %v in line: %v value: %v. Cause: %v",
-					provider, lineNum, record[paymentField], err.Error()))
+				code = amountIssueCode(err)
+				errStr = fmt.Sprintf("provider: %v in line: %v value: %v. Cause: %v",
+					provider, lineNum, payment, err.Error())
 			} else if errors.Is(err, ErrPercentage) {
-				return fileRes, processError(fmt.Sprintf("provider: %v in line: %v value: %v. Cause: %v",
-					provider, lineNum, serviceCut, err.Error()))
+				column, value, code = "pracMap", serviceCut, issueInvalidPercentage
+				errStr = fmt.Sprintf("provider: %v in line: %v value: %v. Cause: %v",
+					provider, lineNum, serviceCut, err.Error())
 			} else {
-				return fileRes, processError(fmt.Sprintf("provider: %v in line: %v with amount: %v and percentage %v failed due to unknown error: %v",
-					provider, lineNum, record[paymentField], serviceCut, err.Error()))
+				code = issueCalculation
+				errStr = fmt.Sprintf("provider: %v in line: %v with amount: %v and percentage %v failed due to unknown error: %v",
+					provider, lineNum, payment, serviceCut, err.Error())
+			}
+			if content.Strict {
+				return fileRes, processError(errStr)
 			}
+			logError.Print(errStr)
+			fileRes.addIssue(line, column, value, code, severityError, errStr)
+			providerWithErrors[provider] = provider
+			continue
 		}
-		// Create the maps storing totals and individual payments
-		providerPaymentMap, exists := providerTotalsMap[provider]
-		if !exists {
-			providerPaymentMap = PaymentTotals{Provider: provider}
-			providerPaymentMap.ServiceCodeSplit = make(map[string]ServiceTotals)
+		//
+		// Reversals and refunds take money back, whether or not the export puts them in brackets
+		//
+		originalDate := ""
+		if isReversal(category) {
+			if paymentAmount.Sign() > 0 {
+				exGst, paymentAmount, gstAmount = exGst.Neg(), paymentAmount.Neg(), gstAmount.Neg()
+				fee.Neg(fee)
+			}
+			if original, ok := originals[paymentKey(line)]; ok {
+				originalDate = original.TransDate
+			}
 		}
-		serviceTotals, exists := providerPaymentMap.ServiceCodeSplit[serviceCode]
-		if !exists {
-			serviceTotals = ServiceTotals{}
+		serviceFee, err := rounding.money(fee, currency)
+		if err != nil {
+			errStr := fmt.Sprintf("provider: %v in line: %v with amount: %v and percentage %v failed. Cause: %v",
+				provider, lineNum, payment, serviceCut, err)
+			logError.Print(errStr)
+			fileRes.addIssue(line, colPayment, payment, issueCalculation, severityError, errStr)
+			providerWithErrors[provider] = provider
+			continue
 		}
-		// Add the totals and the payment details
-		providerPaymentMap.TotalPayments(gstCents, paymentCents, feeCents)
-		serviceTotals.TotalServiceCodes(serviceCut, exGst, feeCents)
-
 		result := PaymentFileResponse{
 			Provider:  provider,
-			Patient:   record[patientField],
-			TransDate: record[transDateField],
-			InvoiceNo: record[invoiceNumField],
+			Location:  location,
+			Patient:   line.Patient,
+			TransDate: line.TransDate,
+			InvoiceNo: line.InvoiceNo,
 			ItemNo:    itemNr,
 			Service: ServiceCut{
 				Code:       serviceCode,
 				Percentage: serviceCut,
 			},
-			Payment:      record[paymentField],
-			GST:          gstCents,
-			TotalPayment: cents2DStr(paymentCents),
-			ServiceFee:   cents2DStr(feeCents),
+			Payment:       paymentAmount,
+			GST:           gstAmount,
+			TotalPayment:  paymentAmount,
+			ServiceFee:    serviceFee,
+			Status:        category,
+			OriginalDate:  originalDate,
+			PaymentMethod: line.PaymentMethod,
+			AccountType:   line.AccountType,
+		}
+		// Add the totals and the payment details
+		providerPaymentMap := providerTotals(providerTotalsMap, provider)
+		if err := providerPaymentMap.addPayment(result, exGst, fee); err != nil {
+			errStr := fmt.Sprintf("provider: %v in line: %v amount: %v could not be added up. Cause: %v",
+				provider, lineNum, payment, err)
+			logError.Print(errStr)
+			fileRes.addIssue(line, colPayment, payment, issueCalculation, severityError, errStr)
+			providerWithErrors[provider] = provider
+			continue
 		}
-		providerPaymentMap.PaymentDetails = append(providerPaymentMap.PaymentDetails, result)
-		providerPaymentMap.ServiceCodeSplit[serviceCode] = serviceTotals
 		providerTotalsMap[provider] = providerPaymentMap
+		if key != "" {
+			invoicedKeys[provider] = append(invoicedKeys[provider], key)
+		}
+	}
+	for provider, details := range providerTotalsMap {
+		var err error
+		if rounding.On == roundOnTotal {
+			err = details.roundTotals(rounding)
+		}
+		if err == nil {
+			err = details.applyContracts(contracts[standardString(provider)], rounding, content.Tax)
+		}
+		if err != nil {
+			errStr := fmt.Sprintf("provider: %v totals could not be worked out. Cause: %v", provider, err)
+			logError.Print(errStr)
+			fileRes.Issues = append(fileRes.Issues, ValidationIssue{Value: provider, Code: issueCalculation,
+				Severity: severityError, Message: errStr})
+			providerWithErrors[provider] = provider
+		}
+		providerTotalsMap[provider] = details
+	}
+	//
+	// The balances carried forward to this period, of the providers who get an invoice
+	//
+	ledgerPeriod := ""
+	if reportPeriod.isSet() {
+		ledgerPeriod = reportPeriod.String()
+	}
+	providers := []string{}
+	for provider := range providerTotalsMap {
+		if _, exists := providerWithErrors[provider]; !exists {
+			providers = append(providers, provider)
+		}
+	}
+	balances, err := broughtForward(content.ledger, providers, ledgerPeriod)
+	if err != nil {
+		return fileRes, processError(fmt.Sprintf("Loading the balances carried forward failed with error: %v", err))
 	}
 	//
 	// Create PDFs, but only if that provider had no errors
 	// If there are adjustments for that provider, add them to the PDF
+	// Negative and small totals get a credit note or are carried forward, as the company chose
+	// The invoices are made and numbered together at the end, in the order of the providers and their
+	// locations, so the numbers of the company have no gaps
 	//
 	imageData := []byte{}
 	logoType := ""
 	var convError error = nil
-	gotAtLeastOneInvoice := false
+	invoices := []pendingInvoice{}
 	if content.CompanyDetails.Logo == "" {
 		logError.Printf("No logo provided for %v", content.CompanyDetails.Name)
 	}
-	for provider, details := range providerTotalsMap {
+	for _, provider := range sortedProviders(providerTotalsMap) {
+		details := providerTotalsMap[provider]
 		if _, exists := providerWithErrors[provider]; !exists {
-			if content.AdjustMap[provider] != nil {
-				details.AdjustmentTotal = 0
-				for _, adj := range content.AdjustMap[provider] {
-					details.AdjustmentTotal += adj.Amount
-				}
+			adjustments, err := resolveAdjustments(content.AdjustMap[provider], details.ServiceCutTotal, reportPeriod,
+				content.Tax, rounding)
+			if err == nil {
+				err = details.setAdjustments(adjustments)
+			}
+			if err != nil {
+				errStr := fmt.Sprintf("provider: %v adjustments could not be added up. Cause: %v", provider, err)
+				logError.Print(errStr)
+				fileRes.Issues = append(fileRes.Issues, ValidationIssue{Column: "adjustMap", Value: provider,
+					Code: issueCalculation, Severity: severityError, Message: errStr})
+				continue
 			}
 			if content.CompanyDetails.Logo != "" && len(imageData) == 0 && convError == nil {
 				imageData, logoType, convError = decodeBase64Image(content.CompanyDetails.Logo)
@@ -279,30 +726,175 @@ func processFileContent(content PaymentFile) (FileProcessingResponse, error) {
 					logError.Printf("Logo conversion failed: %v", convError)
 				}
 			}
-			pdfBytes, err := makePdf(reportPeriod, companyName, provider, details, content.AdjustMap[provider],
-				content.CompanyDetails, content.PracDetails[provider], imageData, logoType)
-
-			if err != nil {
-				logError.Printf("Error creating PDF for provider: %v. Cause: %v", provider, err)
-			}
-			if len(pdfBytes) > 0 {
-				details.PdfFile = pdfBytes
-				gotAtLeastOneInvoice = true
+			if content.InvoicePerLocation {
+				// one invoice per location, the adjustments and the balance brought forward go on
+				// the invoice of the first location. The balance policy is applied to the total of
+				// the provider, so all its locations get the same document.
+				var sum moneySum
+				details.BroughtForward = balances[provider]
+				details.AmountDue = newMoney(0, currency)
+				locations := sortedLocations(details.LocationSplit)
+				for i, location := range locations {
+					locationDetails := details.LocationSplit[location]
+					broughtForward := newMoney(0, currency)
+					if i == 0 {
+						locationDetails.Adjustments = details.Adjustments
+						locationDetails.AdjustmentTotal = details.AdjustmentTotal
+						broughtForward = details.BroughtForward
+					}
+					if err := content.Tax.totalTax(&locationDetails, rounding); err != nil {
+						logError.Printf("Error calculating GST for provider: %v at location: %v. Cause: %v", provider, location, err)
+					}
+					if sum.err == nil {
+						sum.err = BalancePolicy{}.settle(&locationDetails, broughtForward)
+					}
+					sum.add(&details.AmountDue, locationDetails.AmountDue)
+					details.LocationSplit[location] = locationDetails
+				}
+				if sum.err != nil {
+					errStr := fmt.Sprintf("provider: %v balance could not be worked out. Cause: %v", provider, sum.err)
+					logError.Print(errStr)
+					fileRes.Issues = append(fileRes.Issues, ValidationIssue{Value: provider, Code: issueCalculation,
+						Severity: severityError, Message: errStr})
+					continue
+				}
+				content.Balance.decide(&details)
+				if issue, found := content.Balance.balanceIssue(provider, details); found {
+					fileRes.Issues = append(fileRes.Issues, issue)
+				}
+				for _, location := range locations {
+					locationDetails := details.LocationSplit[location]
+					locationDetails.Document = details.Document
+					locationDetails.CarriedForward = newMoney(0, currency)
+					if details.Document == documentCarriedForward {
+						locationDetails.CarriedForward = locationDetails.AmountDue
+					} else {
+						invoices = append(invoices, pendingInvoice{provider: provider, location: location})
+					}
+					details.LocationSplit[location] = locationDetails
+				}
+			} else {
+				if err := content.Tax.totalTax(&details, rounding); err != nil {
+					logError.Printf("Error calculating GST for provider: %v. Cause: %v", provider, err)
+				}
+				if err := content.Balance.settle(&details, balances[provider]); err != nil {
+					errStr := fmt.Sprintf("provider: %v balance could not be worked out. Cause: %v", provider, err)
+					logError.Print(errStr)
+					fileRes.Issues = append(fileRes.Issues, ValidationIssue{Value: provider, Code: issueCalculation,
+						Severity: severityError, Message: errStr})
+					continue
+				}
+				if issue, found := content.Balance.balanceIssue(provider, details); found {
+					fileRes.Issues = append(fileRes.Issues, issue)
+				}
+				if details.Document != documentCarriedForward {
+					invoices = append(invoices, pendingInvoice{provider: provider})
+				}
 			}
 			details.Provider = provider
 			providerTotalsMap[provider] = details
 		}
 	}
+	made, err := content.Numbering.makeInvoices(counter, reportPeriod, settings.created, providerTotalsMap, invoices,
+		func(invoice pendingInvoice, details PaymentTotals) ([]byte, error) {
+			return makePdf(reportPeriod, companyName, invoice.provider, invoice.location, details,
+				content.CompanyDetails, content.PracDetails[invoice.provider], imageData, logoType, settings)
+		})
+	if err != nil {
+		errStr := fmt.Sprintf("the invoices could not be made and numbered. Cause: %v", err)
+		logError.Print(errStr)
+		fileRes.Issues = append(fileRes.Issues, ValidationIssue{Code: issueInvoiceNumber, Severity: severityError,
+			Message: errStr})
+	} else {
+		providerTotalsMap = made.totals
+		fileRes.InvoicePackage = made.invoices
+		fileRes.Issues = append(fileRes.Issues, made.issues...)
+	}
 	fileRes.ChargeDetail = providerTotalsMap
-	if gotAtLeastOneInvoice {
-		fileRes.InvoicePackage, err = createZipFile(providerTotalsMap)
+	if content.history != nil {
+		keys := []string{}
+		for provider, details := range providerTotalsMap {
+			if settled(details) {
+				keys = append(keys, invoicedKeys[provider]...)
+			}
+		}
+		if err := content.history.record(keys); err != nil {
+			logError.Printf("Error remembering processed payments. Cause: %v", err)
+		}
 	}
-	if err != nil {
-		logError.Printf("Error creating zip file. Cause: %v", err)
+	if content.ledger != nil {
+		entries := map[string]LedgerEntry{}
+		for provider, details := range providerTotalsMap {
+			if _, exists := providerWithErrors[provider]; !exists && settled(details) {
+				entries[provider] = LedgerEntry{Period: ledgerPeriod, BroughtForward: details.BroughtForward,
+					Balance: details.CarriedForward}
+			}
+		}
+		if err := content.ledger.record(entries); err != nil {
+			logError.Printf("Error storing the balances carried forward. Cause: %v", err)
+		}
 	}
 	return fileRes, nil
 }
 
+// previouslyProcessed returns the keys of the lines which were processed in an earlier upload
+func previouslyProcessed(history paymentHistory, lines []PaymentLine) (map[string]bool, error) {
+	if history == nil {
+		return map[string]bool{}, nil
+	}
+	keys := []string{}
+	for _, line := range lines {
+		category, _ := classifyStatus(line.Status)
+		if key := duplicateKey(category, line); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return history.processed(keys)
+}
+
+// readRecords returns the rows of the uploaded file, either CSV text or a base64 encoded workbook,
+// and the position of every field in the original file. CSV fields can span lines and blank
+// lines are skipped, so the record index is not the line number.
+func readRecords(content PaymentFile) ([][]string, [][]fieldPos, error) {
+	switch fileType(content) {
+	case fileTypeCsv:
+		reader := csv.NewReader(strings.NewReader(content.FileContent))
+		// short rows are reported as issues of the line rather than failing the file
+		reader.FieldsPerRecord = -1
+		records := [][]string{}
+		positions := [][]fieldPos{}
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			pos := make([]fieldPos, len(record))
+			for i := range record {
+				pos[i].line, pos[i].column = reader.FieldPos(i)
+			}
+			records = append(records, record)
+			positions = append(positions, pos)
+		}
+		return records, positions, nil
+	case fileTypeXlsx:
+		return readXlsx(content.FileContent, content.Sheet)
+	default:
+		return nil, nil, fmt.Errorf("unsupported file type: %v", content.FileType)
+	}
+}
+
+// fileType is the type of the uploaded file, csv if not given
+func fileType(content PaymentFile) string {
+	fileType := strings.ToLower(strings.TrimSpace(content.FileType))
+	if fileType == "" {
+		return fileTypeCsv
+	}
+	return fileType
+}
+
 func processError(err string) error {
 	logError.Print(err)
 	return fmt.Errorf("%s", err)
@@ -317,22 +909,40 @@ func standardString(s string) string {
 	return strings.ToLower(ns)
 }
 
-func getHeaderDetails(records [][]string) (int, [][]string, string, string, error) {
+// Returns the line offset of the data, the header row, the data records, the report period and the company name.
+// The header row is the one starting with "Location" or holding the provider column title.
+// If there is no header row, all records are returned as data and the header is nil.
+func getHeaderDetails(records [][]string, providerTitle string) (int, []string, [][]string, string, string, error) {
 	reportPeriod := ""
 	companyName := ""
 	for i, record := range records {
+		if len(record) == 0 {
+			continue // a sheet with only empty rows has records without fields
+		}
 		trimmedRecord := strings.ToLower(strings.TrimSpace(record[0]))
 		if strings.Contains(trimmedRecord, "report period:") {
 			startIndex := strings.Index(trimmedRecord, "report period:") + len("report period:")
 			reportPeriod = strings.TrimSpace(trimmedRecord[startIndex:])
-			companyName = strings.TrimSpace(record[15])
+			if len(record) > 15 {
+				companyName = strings.TrimSpace(record[15])
+			}
 		}
 
-		if strings.Contains(trimmedRecord, "location") {
-			return i + 1, records[i+1:], reportPeriod, companyName, nil
+		if strings.Contains(trimmedRecord, "location") || isHeaderRow(record, providerTitle) {
+			return i + 1, record, records[i+1:], reportPeriod, companyName, nil
 		}
 	}
-	return 0, records, reportPeriod, companyName, fmt.Errorf("no header found")
+	return 0, nil, records, reportPeriod, companyName, fmt.Errorf("no header found")
+}
+
+// isHeaderRow returns true if one of the fields is the column title
+func isHeaderRow(record []string, title string) bool {
+	for _, field := range record {
+		if headerKey(field) == headerKey(title) {
+			return true
+		}
+	}
+	return false
 }
 
 // input: CodeMap: map[string][]string{"code1": {"123", "456"}}, {"code2": {"789", "012"}}
@@ -354,23 +964,37 @@ func createProviderMap(pracMap map[string]map[string]string) map[string]map[stri
 	return result
 }
 
-func createZipFile(paymentDetails map[string]PaymentTotals) ([]byte, error) {
+// createZipFile packs the invoices by provider and location, with the creation date if it is set
+func createZipFile(paymentDetails map[string]PaymentTotals, period ReportPeriod, created time.Time) ([]byte, error) {
 	buf := new(bytes.Buffer)
 	zipWriter := zip.NewWriter(buf)
 
-	for provider, details := range paymentDetails {
-		if len(details.PdfFile) == 0 {
-			continue
-		}
-		provider = strings.ReplaceAll(provider, " ", "_") + "_Invoice" + ".pdf"
-		zipFileWriter, err := zipWriter.Create(provider)
-		if err != nil {
-			return nil, err
+	for _, provider := range sortedProviders(paymentDetails) {
+		details := paymentDetails[provider]
+		names := []string{invoiceFileName(provider, "", details.InvoiceNumber, period)}
+		files := map[string][]byte{names[0]: details.PdfFile}
+		for _, location := range sortedLocations(details.LocationSplit) {
+			locationDetails := details.LocationSplit[location]
+			if len(locationDetails.PdfFile) > 0 {
+				name := invoiceFileName(provider, location, locationDetails.InvoiceNumber, period)
+				names = append(names, name)
+				files[name] = locationDetails.PdfFile
+			}
 		}
-		_, err = zipFileWriter.Write(details.PdfFile)
-		if err != nil {
-			fmt.Println(err)
-			return nil, err
+		for _, name := range names {
+			pdfFile := files[name]
+			if len(pdfFile) == 0 {
+				continue
+			}
+			zipFileWriter, err := zipWriter.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: created})
+			if err != nil {
+				return nil, err
+			}
+			_, err = zipFileWriter.Write(pdfFile)
+			if err != nil {
+				fmt.Println(err)
+				return nil, err
+			}
 		}
 	}
 	zipWriter.Close()
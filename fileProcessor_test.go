@@ -1,9 +1,21 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"image"
+	"image/png"
+	"maps"
+	"math"
+	"math/big"
 	"os"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"github.com/stretchr/testify/require"
 )
@@ -39,7 +51,7 @@ func TestCalculate1(t *testing.T) {
 		CodeMap:        map[string][]string{"code1": {"80010", "456"}, "code2": {"789", "012"}},
 		PracMap:        map[string]map[string]string{drName: {"code1": "30", "code2": "20"}, "Dr Buhu": {"code1": "40", "code2": "30"}},
 		PracDetails:    map[string]Address{drName: addr},
-		AdjustMap:      map[string][]Adjustments{drName: {Adjustments{Description: "adjustment1", Amount: 10}, Adjustments{"adjustment1", 5}}},
+		AdjustMap:      map[string][]Adjustments{drName: {Adjustments{Description: "adjustment1", Amount: Money{Amount: 10}}, Adjustments{Description: "adjustment1", Amount: Money{Amount: 5}}}},
 	}
 	var res FileProcessingResponse
 	res, err := processFileContent(paymentFile)
@@ -47,8 +59,8 @@ func TestCalculate1(t *testing.T) {
 	require.Equal(t, "Dr Aha", res.ChargeDetail[drName].Provider)
 	require.Equal(t, "Sick Patient", res.ChargeDetail[drName].PaymentDetails[0].Patient)
 	require.Equal(t, "80010", res.ChargeDetail[drName].PaymentDetails[0].ItemNo)
-	require.Equal(t, "(224.50)", res.ChargeDetail[drName].PaymentDetails[0].Payment)
-	require.Equal(t, "(67.35)", res.ChargeDetail[drName].PaymentDetails[0].ServiceFee)
+	require.Equal(t, "(224.50)", res.ChargeDetail[drName].PaymentDetails[0].Payment.String())
+	require.Equal(t, "(67.35)", res.ChargeDetail[drName].PaymentDetails[0].ServiceFee.String())
 	require.Equal(t, "30", res.ChargeDetail[drName].ServiceCodeSplit["code1"].Rate)
 	require.NotEmpty(t, res)
 }
@@ -137,6 +149,7 @@ func TestCalcErrorBadNumbers(t *testing.T) {
 		CompanyDetails: addr,
 		CodeMap:        map[string][]string{"code1": {"80010", "456"}, "code2": {"789", "012"}},
 		PracMap:        map[string]map[string]string{drName: {"code1": "30", "code2": "20"}, "Dr Buhu": {"code1": "40", "code2": "30"}},
+		Strict:         true,
 	}
 	//
 	// Missing service code for Dr
@@ -162,6 +175,41 @@ func TestCalcErrorBadNumbers(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestValidationIssues(t *testing.T) {
+	configureLogging()
+	drName := "Dr Aha"
+	good := "A Practice,Dr Aha,Irrelevant,Sick Patient,162307,174545,71756,80010,Consultation,Payment,26/02/2024,EFT,Private,0.00,100.00,0.00"
+	badAmount := "A Practice,Dr Aha,Irrelevant,Sick Patient,162308,174546,71757,80010,Consultation,Payment,26/02/2024,EFT,Private,0.00,1O0.00,0.00"
+	shortRow := "A Practice,Dr Aha,Irrelevant"
+	otherDr := "A Practice,Dr Buhu,Irrelevant,Sick Patient,162309,174547,71758,80010,Consultation,Payment,26/02/2024,EFT,Private,0.00,50.00,0.00"
+	unknownDr := "A Practice,Dr Who,Irrelevant,Sick Patient,162310,174548,71759,80010,Consultation,Payment,26/02/2024,EFT,Private,0.00,50.00,0.00"
+	paymentFile := PaymentFile{
+		FileContent: strings.Join([]string{good, badAmount, shortRow, otherDr, unknownDr}, "\n"),
+		CodeMap:     map[string][]string{"code1": {"80010"}},
+		PracMap:     map[string]map[string]string{drName: {"code1": "30"}, "Dr Buhu": {"code1": "40"}},
+		counter:     &memoryCounter{},
+	}
+	res, err := processFileContent(paymentFile)
+	require.NoError(t, err)
+	codes := map[string]ValidationIssue{}
+	for _, issue := range res.Issues {
+		codes[issue.Code] = issue
+	}
+	require.Len(t, res.Issues, 3)
+	require.Equal(t, shortRow, codes[issueShortRow].Value)
+	require.Equal(t, "1O0.00", codes[issueInvalidAmount].Value)
+	require.Equal(t, colPayment, codes[issueInvalidAmount].Column)
+	require.Equal(t, severityError, codes[issueInvalidAmount].Severity)
+	require.Equal(t, "Dr Who", codes[issueMissingProvider].Value)
+	// the provider with the bad line gets no invoice, the others do
+	require.Empty(t, res.ChargeDetail[drName].PdfFile)
+	require.NotEmpty(t, res.ChargeDetail["Dr Buhu"].PdfFile)
+
+	paymentFile.Strict = true
+	_, err = processFileContent(paymentFile)
+	require.Error(t, err)
+}
+
 func TestConvertPayment(t *testing.T) {
 	tests := []struct {
 		input  string
@@ -170,44 +218,172 @@ func TestConvertPayment(t *testing.T) {
 		{"123.45", "123.45"},
 		{"123", "123.00"},
 		{"123.4", "123.40"},
-		{"123.456", "123.45"},
+		{"123.456", "123.46"},
+		{"123.454", "123.45"},
+		{"123.455", "123.46"},
 		{"(123.45)", "(123.45)"},
-		{"(123", "(123.00)"},
 		{"(123.4)", "(123.40)"},
-		{"(123.456)", "(123.45)"},
+		{"(123.456)", "(123.46)"},
+		{"(123.455)", "(123.46)"},
+		{".5", "0.50"},
 	}
 	for _, test := range tests {
 		res, err := convertToInt(test.input)
 		require.NoError(t, err)
-		require.Equal(t, test.output, cents2DStr(res))
+		require.Equal(t, test.output, newMoney(res, defaultCurrency).String())
 	}
 	_, err := convertToInt("test.input")
 	require.Error(t, err)
 	_, err = convertToInt("123)")
 	require.Error(t, err)
+	_, err = convertToInt("(123")
+	require.Error(t, err)
 	_, err = convertToInt("1 23)")
 	require.Error(t, err)
+	_, err = convertToInt("1e3")
+	require.Error(t, err)
+	_, err = convertToInt("1/2")
+	require.Error(t, err)
 }
 
-func TestConvertPecentage(t *testing.T) {
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		input string
+		cents int64
+		code  string // the issue code if the amount is rejected
+	}{
+		{"1,234.50", 123450, ""},
+		{"$1,234.50", 123450, ""},
+		{"A$1,234.50", 123450, ""},
+		{"12,345,678.9", 1234567890, ""},
+		{"-$12.00", -1200, ""},
+		{"$-12.00", -1200, ""},
+		{"$ (12.00)", -1200, ""},
+		{"($1,234.50)", -123450, ""},
+		{"12.5-", -1250, ""},
+		{"$12.50 -", -1250, ""},
+		{"\u221212.00", -1200, ""},
+		{"$\u22121,000", -100000, ""},
+		{"+12", 1200, ""},
+		{"\u00a0 1,000.00\u00a0", 100000, ""},
+		{"0.005", 1, ""},
+		{"-0.005", -1, ""},
+		{"", 0, issueInvalidAmount},
+		{"  ", 0, issueInvalidAmount},
+		{"$", 0, issueInvalidAmount},
+		{"12.00)", 0, issueInvalidAmount},
+		{"12 000", 0, issueInvalidAmount},
+		{"$$12", 0, issueInvalidAmount},
+		{"12 AUD", 0, issueInvalidAmount},
+		{"1e3", 0, issueInvalidAmount},
+		{"12,50", 0, issueAmbiguousAmount},
+		{"1.234,50", 0, issueAmbiguousAmount},
+		{"1.234.567", 0, issueAmbiguousAmount},
+		{"1,2345.00", 0, issueAmbiguousAmount},
+		{"-(12.00)", 0, issueAmbiguousAmount},
+		{"(12.00", 0, issueAmbiguousAmount},
+		{"$(12.00", 0, issueAmbiguousAmount},
+		{"(123", 0, issueAmbiguousAmount},
+		{"-12.00-", 0, issueAmbiguousAmount},
+		{"+12.00-", 0, issueAmbiguousAmount},
+		{"92,233,720,368,547,758.08", 0, issueAmountRange},
+	}
+	for _, test := range tests {
+		cents, err := convertToInt(test.input)
+		if test.code != "" {
+			require.Error(t, err, test.input)
+			require.Equal(t, test.code, amountIssueCode(err), test.input)
+			continue
+		}
+		require.NoError(t, err, test.input)
+		require.Equal(t, test.cents, cents, test.input)
+	}
+
+	// the code of the issue is the one of the amount
+	configureLogging()
+	line := "A Practice,Dr Aha,Irrelevant,Sick Patient,162307,174545,71756,80010,Consultation,Payment,26/02/2024,EFT,Private,0.00,\"12,50\",0.00"
+	large := "A Practice,Dr Buhu,Irrelevant,Sick Patient,162308,174546,71757,80010,Consultation,Payment,26/02/2024,EFT,Private,0.00,\"$1,234.50\",0.00"
+	res, err := processFileContent(PaymentFile{
+		FileContent: line + "\n" + large,
+		CodeMap:     map[string][]string{"code1": {"80010"}},
+		PracMap:     map[string]map[string]string{"Dr Aha": {"code1": "30"}, "Dr Buhu": {"code1": "30"}},
+		counter:     &memoryCounter{},
+	})
+	require.NoError(t, err)
+	require.Len(t, res.Issues, 1)
+	require.Equal(t, issueAmbiguousAmount, res.Issues[0].Code)
+	require.Equal(t, int64(37035), res.ChargeDetail["Dr Buhu"].ServiceCutTotal.Amount)
+}
+
+func FuzzConvertToInt(f *testing.F) {
+	for _, seed := range []string{"1,234.50", "$ (12.00)", "12.5-", "\u221212.00", "12,50", "(123", "-$0.005", ".5"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		cents, err := convertToInt(input)
+		if err != nil {
+			var amountErr *AmountError
+			require.ErrorAs(t, err, &amountErr)
+			return
+		}
+		// an amount in brackets has both of them
+		require.Equal(t, strings.Count(input, "("), strings.Count(input, ")"), input)
+		// what the invoice shows reads back as the same amount
+		again, err := convertToInt(newMoney(cents, defaultCurrency).String())
+		require.NoError(t, err, input)
+		require.Equal(t, cents, again, input)
+	})
+}
+
+func TestParseRate(t *testing.T) {
 	tests := []struct {
 		input  string
-		output int
+		output *big.Rat
 	}{
-		{"10%", 1000},
-		{"80", 8000},
-		{"5.0%", 500},
+		{"10%", big.NewRat(10, 1)},
+		{"80", big.NewRat(80, 1)},
+		{"5.0%", big.NewRat(5, 1)},
+		{"7.50", big.NewRat(15, 2)},
+		{"33.333", big.NewRat(33333, 1000)},
+		{"33 1/3", big.NewRat(100, 3)},
+		{"33 1/3%", big.NewRat(100, 3)},
+		{"100/3", big.NewRat(100, 3)},
+		{"0.125", big.NewRat(1, 8)},
 	}
 	for _, test := range tests {
-		res, err := convertPercToFloat(test.input)
-		require.NoError(t, err)
-		require.Equal(t, test.output, res)
+		res, err := parseRate(test.input)
+		require.NoError(t, err, test.input)
+		require.Zero(t, test.output.Cmp(res), "%v parsed as %v", test.input, res)
 	}
-	_, err := convertPercToFloat("5 0")
-	require.Error(t, err)
-	_, err = convertPercToFloat("")
-	require.Error(t, err)
+	for _, input := range []string{"5 0", "", "1/0", "33 1/3 1/3", "1e2", "0x10", "ten"} {
+		_, err := parseRate(input)
+		require.Error(t, err, input)
+	}
+}
 
+func TestExactFees(t *testing.T) {
+	tests := []struct {
+		payment    string
+		percentage string
+		fee        int64
+	}{
+		// a third of 100.00 is 33.33, 33.33% would be 33.33 as well but not on 1000.00
+		{"100.00", "33 1/3", 3333},
+		{"1000.00", "33 1/3", 33333},
+		{"1000.00", "33.33", 33330},
+		{"1000.00", "100/3", 33333},
+		{"200.00", "33.333", 6667},
+		{"0.03", "50", 2},
+		{"(0.03)", "50", -2},
+		{"123.45", "12.345", 1524},
+	}
+	for _, test := range tests {
+		_, exact, _, _, err := calcExactPayment(test.payment, "0", test.percentage, defaultCurrency)
+		require.NoError(t, err)
+		fee, err := RoundingPolicy{Mode: roundHalfUp}.money(exact, defaultCurrency)
+		require.NoError(t, err)
+		require.Equal(t, test.fee, fee.Amount, "%v of %v", test.percentage, test.payment)
+	}
 }
 
 func TestCalcPayment(t *testing.T) {
@@ -215,38 +391,40 @@ func TestCalcPayment(t *testing.T) {
 		payment    string
 		gst        string
 		percentage string
-		exGst      int
-		billed     int
-		totalP     int
-		gstc       int
+		exGst      int64
+		billed     int64
+		totalP     int64
+		gstc       int64
 	}{
 		// positive numbers, vary payemnt and precentage
 		{"123.45", "0", "10%", 12345, 1235, 12345, 0},
 		{"123", "0", "80", 12300, 9840, 12300, 0},
 		{"123.4", "0", "", 12340, 0, 12340, 0},
-		{"123.456", "0", "5.0%", 12345, 617, 12345, 0},
+		{"123.456", "0", "5.0%", 12346, 617, 12346, 0},
 		// same as above but negative
 		{"(123.45)", "0", "10%", -12345, -1235, -12345, 0},
-		{"(123", "0", "80", -12300, -9840, -12300, 0},
+		{"(123", "0", "80", 0, 0, 0, 0}, // no closing bracket
 		{"(123.4)", "0", "", -12340, 0, -12340, 0},
-		{"(123.456)", "0", "5.0%", -12345, -617, -12345, 0},
+		{"(123.456)", "0", "5.0%", -12346, -617, -12346, 0},
 		{"(80.1)", "0", "5.5%", -8010, -441, -8010, 0},
 		// now with gst
 		{"123.45", "10.0", "10%", 11345, 1135, 12345, 1000},
 		{"123", "22.00", "80", 10100, 8080, 12300, 2200},
-		{"(123.4)", "12.3456", "0.8", -13574, -109, -12340, 1234},
+		{"(123.4)", "12.3456", "0.8", -13575, -109, -12340, 1235},
 	}
 	for idx, test := range tests {
 		//exGst, fee, totalP, gst, err
-		exGst, fee, totalP, gst, err := calcPayment(test.payment, test.gst, test.percentage)
+		exGst, exact, totalP, gst, err := calcExactPayment(test.payment, test.gst, test.percentage, defaultCurrency)
 		if test.billed == 0 {
 			require.Error(t, err)
 		} else {
 			require.NoError(t, err)
-			require.Equal(t, test.exGst, exGst, "Failed calcPayment exGst test %d", idx)
-			require.Equal(t, test.billed, fee, "Failed calcPayment fee test %d", idx)
-			require.Equal(t, test.totalP, totalP, "Failed calcPayment payment conversion test %d", idx)
-			require.Equal(t, test.gstc, gst, "Failed calcPayment gst conversion test %d", idx)
+			fee, err := RoundingPolicy{Mode: roundHalfUp}.money(exact, defaultCurrency)
+			require.NoError(t, err)
+			require.Equal(t, test.exGst, exGst.Amount, "Failed calcPayment exGst test %d", idx)
+			require.Equal(t, test.billed, fee.Amount, "Failed calcPayment fee test %d", idx)
+			require.Equal(t, test.totalP, totalP.Amount, "Failed calcPayment payment conversion test %d", idx)
+			require.Equal(t, test.gstc, gst.Amount, "Failed calcPayment gst conversion test %d", idx)
 		}
 	}
 }
@@ -290,19 +468,1311 @@ func TestCalculator(t *testing.T) {
 	testCases := []struct {
 		dval   string
 		perc   string
-		pcents int
-		cents  int
+		pcents int64
+		cents  int64
 	}{
 		{"10.99", "10.99", 121, 1099}, {"5.5", "5.5", 30, 550}, {"3.14159", "3.14159", 10, 314},
-		{"20", "20", 400, 2000}, {"$15.758", "15.758", 248, 1575}}
+		{"20", "20", 400, 2000}, {"$15.758", "15.758", 248, 1576}}
 
 	for _, tc := range testCases {
-		cents, err := dollarStringToCents(tc.dval)
+		amount, err := parseMoney(tc.dval, defaultCurrency)
+		require.NoError(t, err)
+		require.Equal(t, tc.cents, amount.Amount)
+
+		_, exact, _, _, err := calcExactPayment(tc.dval, "0", tc.perc, defaultCurrency)
+		require.NoError(t, err)
+		res, err := RoundingPolicy{Mode: roundHalfUp}.money(exact, defaultCurrency)
+		require.NoError(t, err)
+		require.Equal(t, tc.pcents, res.Amount)
+	}
+}
+
+func TestColumnsFromHeader(t *testing.T) {
+	configureLogging()
+	drName := "Dr Aha"
+	header := "Provider,Location,Patient Name,Invoice No.,Item No.,Description,Status,Transaction Date,\"GST\n($ incl GST)\",\"Payment\n($ incl GST)\""
+	line := "Dr Aha,A Practice,Sick Patient,162307,80010,Consultation,Payment,01/03/2024,0.00,100.00"
+
+	paymentFile := PaymentFile{
+		FileContent: header + "\n" + line,
+		CodeMap:     map[string][]string{"code1": {"80010"}},
+		PracMap:     map[string]map[string]string{drName: {"code1": "30"}},
+	}
+	res, err := processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Equal(t, "Sick Patient", res.ChargeDetail[drName].PaymentDetails[0].Patient)
+	require.Equal(t, "100.00", res.ChargeDetail[drName].PaymentDetails[0].Payment.String())
+	require.Equal(t, "30.00", res.ChargeDetail[drName].PaymentDetails[0].ServiceFee.String())
+	//
+	// override the header title of a column
+	//
+	paymentFile.FileContent = strings.Replace(paymentFile.FileContent, "Item No.", "MBS Item", 1)
+	_, err = processFileContent(paymentFile)
+	require.ErrorContains(t, err, "Item No.")
+	paymentFile.ColumnMap = map[string]string{colItemNum: "MBS Item"}
+	res, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Equal(t, "80010", res.ChargeDetail[drName].PaymentDetails[0].ItemNo)
+	//
+	// unknown fields are rejected
+	//
+	paymentFile.ColumnMap = map[string]string{"itemNumber": "MBS Item"}
+	_, err = processFileContent(paymentFile)
+	require.Error(t, err)
+}
+
+func TestResolveColumns(t *testing.T) {
+	cols, err := resolveColumns(paymentsExportColumns, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, cols[colProvider])
+	require.Equal(t, 14, cols[colPayment])
+	require.Equal(t, 15, cols.minFields(paymentsExportColumns))
+
+	cols, err = resolveColumns(paymentsExportColumns, nil, map[string]string{colPayment: "16"})
+	require.NoError(t, err)
+	require.Equal(t, 16, cols[colPayment])
+	require.Equal(t, 17, cols.minFields(paymentsExportColumns))
+
+	_, err = resolveColumns(paymentsExportColumns, nil, map[string]string{colPayment: "-1"})
+	require.Error(t, err)
+
+	header := []string{"Provider", "Patient Name", "Invoice No.", "Item No.", "Description", "Transaction Date", "GST($ incl GST)", "Payment($ incl GST)"}
+	cols, err = resolveColumns(paymentsExportColumns, header, nil)
+	require.NoError(t, err)
+	require.Equal(t, 7, cols[colPayment])
+	_, ok := cols[colLocation]
+	require.False(t, ok)
+	require.Equal(t, "", cols.get([]string{"a"}, colLocation))
+	_, err = resolveColumns(paymentsExportColumns, header[1:], nil)
+	require.ErrorContains(t, err, "Provider")
+}
+
+func TestPaymentStatus(t *testing.T) {
+	configureLogging()
+	drName := "Dr Aha"
+	payment := "A Practice,Dr Aha,Irrelevant,Sick Patient,162307,174545,71756,80010,Consultation,Payment,26/02/2024,EFT,Private,0.00,224.50,0.00"
+	reversal := "A Practice,Dr Aha,Irrelevant,Sick Patient,162307,174545,71756,80010,Consultation,Reversed payment,01/03/2024,EFT,Private,0.00,224.50,0.00"
+	voided := "A Practice,Dr Aha,Irrelevant,Sick Patient,162308,174546,71757,80010,Consultation,Voided payment,01/03/2024,EFT,Private,0.00,100.00,0.00"
+	paymentFile := PaymentFile{
+		FileContent: payment + "\n" + reversal + "\n" + voided,
+		CodeMap:     map[string][]string{"code1": {"80010"}},
+		PracMap:     map[string]map[string]string{drName: {"code1": "30"}},
+	}
+	res, err := processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Empty(t, res.UnknownStatuses)
+	details := res.ChargeDetail[drName]
+	require.Len(t, details.PaymentDetails, 2)
+	require.Equal(t, statusPayment, details.PaymentDetails[0].Status)
+	require.Equal(t, statusReversal, details.PaymentDetails[1].Status)
+	require.Equal(t, "(224.50)", details.PaymentDetails[1].Payment.String())
+	require.Equal(t, "(67.35)", details.PaymentDetails[1].ServiceFee.String())
+	require.Equal(t, "26/02/2024", details.PaymentDetails[1].OriginalDate)
+	require.Equal(t, int64(0), details.ServiceCutTotal.Amount)
+	require.NotEmpty(t, details.PdfFile)
+	//
+	// unknown status stops the invoice
+	//
+	paymentFile.FileContent = payment + "\n" + strings.Replace(reversal, "Reversed payment", "Written off", 1)
+	res, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Contains(t, res.UnknownStatuses["Written off"], "Written off")
+	require.Empty(t, res.ChargeDetail[drName].PdfFile)
+}
+
+func TestClassifyStatus(t *testing.T) {
+	tests := []struct {
+		status   string
+		category string
+		known    bool
+	}{
+		{"Payment", statusPayment, true},
+		{"", statusPayment, true},
+		{"Reversed  payment", statusReversal, true},
+		{"Refund", statusRefund, true},
+		{"VOID", statusVoid, true},
+		{"Written off", "", false},
+	}
+	for _, test := range tests {
+		category, known := classifyStatus(test.status)
+		require.Equal(t, test.known, known, test.status)
+		require.Equal(t, test.category, category, test.status)
+	}
+}
+
+type memoryHistory map[string]bool
+
+func (h memoryHistory) processed(keys []string) (map[string]bool, error) {
+	res := map[string]bool{}
+	for _, key := range keys {
+		if h[key] {
+			res[key] = true
+		}
+	}
+	return res, nil
+}
+
+func (h memoryHistory) record(keys []string) error {
+	for _, key := range keys {
+		h[key] = true
+	}
+	return nil
+}
+
+func TestDuplicatePayments(t *testing.T) {
+	configureLogging()
+	drName := "Dr Aha"
+	payment := "A Practice,Dr Aha,Irrelevant,Sick Patient,162307,174545,71756,80010,Consultation,Payment,26/02/2024,EFT,Private,0.00,100.00,0.00"
+	reversal := "A Practice,Dr Aha,Irrelevant,Sick Patient,162307,174545,71756,80010,Consultation,Reversed payment,01/03/2024,EFT,Private,0.00,(100.00),0.00"
+	other := "A Practice,Dr Aha,Irrelevant,Sick Patient,162308,174546,71757,80010,Consultation,Payment,01/03/2024,EFT,Private,0.00,50.00,0.00"
+	paymentFile := PaymentFile{
+		FileContent: payment + "\n" + payment + "\n" + reversal,
+		CodeMap:     map[string][]string{"code1": {"80010"}},
+		PracMap:     map[string]map[string]string{drName: {"code1": "30"}},
+	}
+	res, err := processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Len(t, res.Duplicates, 1)
+	require.Contains(t, res.Duplicates["payment_71756_174545"], "duplicates line: 1")
+	require.Len(t, res.ChargeDetail[drName].PaymentDetails, 2)
+	require.Equal(t, int64(0), res.ChargeDetail[drName].ServiceCutTotal.Amount)
+	//
+	// across uploads
+	//
+	history := memoryHistory{}
+	paymentFile.FileContent = payment
+	paymentFile.history = history
+	res, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Empty(t, res.Duplicates)
+	require.True(t, history["payment_71756_174545"])
+
+	paymentFile.FileContent = payment + "\n" + other
+	res, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Contains(t, res.Duplicates["payment_71756_174545"], "earlier upload")
+	require.Len(t, res.ChargeDetail[drName].PaymentDetails, 1)
+	require.Equal(t, int64(1500), res.ChargeDetail[drName].ServiceCutTotal.Amount)
+}
+
+func TestSourceLineNumbers(t *testing.T) {
+	configureLogging()
+	// the report title and the GST header span three and two lines, and there is a blank line
+	content := ",,,,,,,,,,,,,,,\n" +
+		"\"Payments Export \nReport\nReport Period: 26/02/2024 - 03/03/2024\",Report version: 1.10,,,,,,,,,,,,,,A Practice\n" +
+		"\n" +
+		"Location,Provider,Billed To,Patient Name,Invoice No.,Service ID,Payment ID,Item No.,Description,Status,Transaction Date,Payment Method,Account Type,\"GST\n($ incl GST)\",Payment($ incl GST),Deposit($ incl GST)\n" +
+		"A Practice,Dr Aha,Irrelevant,Sick Patient,162307,174545,71756,80010,Consultation,Payment,26/02/2024,EFT,Private,0.00,100.00,0.00\n" +
+		"A Practice,Dr Aha,Irrelevant,Sick Patient,162308,174546,71757,99999,Consultation,Payment,26/02/2024,EFT,Private,0.00,12x.00,0.00\n"
+	paymentFile := PaymentFile{
+		FileContent: content,
+		CodeMap:     map[string][]string{"code1": {"80010"}},
+		PracMap:     map[string]map[string]string{"Dr Aha": {"code1": "30"}},
+		counter:     &memoryCounter{},
+	}
+	res, err := processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Len(t, res.Issues, 1)
+	issue := res.Issues[0]
+	require.Equal(t, issueMissingItemNr, issue.Code)
+	require.Equal(t, 9, issue.Line)
+	require.Equal(t, 9, issue.FieldLine)
+	require.Equal(t, len("A Practice,Dr Aha,Irrelevant,Sick Patient,162308,174546,71757,")+1, issue.FieldColumn)
+	require.Contains(t, issue.Message, "in line: 9")
+}
+
+func TestFeeRulesAndDeposits(t *testing.T) {
+	configureLogging()
+	drName := "Dr Aha"
+	medicare := "A Practice,Dr Aha,Irrelevant,Sick Patient,162307,174545,71756,80010,Consultation,Payment,26/02/2024,Direct Credit,Medicare,0.00,100.00,0.00"
+	private := "A Practice,Dr Aha,Irrelevant,Sick Patient,162308,174546,71757,80010,Consultation,Payment,26/02/2024,EFT,Private,0.00,100.00,0.00"
+	dva := "A Practice,Dr Aha,Irrelevant,Sick Patient,162309,174547,71758,80010,Consultation,Payment,26/02/2024,EFT,DVA,0.00,100.00,0.00"
+	deposit := "A Practice,Dr Aha,Irrelevant,Sick Patient,162310,174548,71759,,,Payment,26/02/2024,EFT,Private,0.00,0.00,50.00"
+	paymentFile := PaymentFile{
+		FileContent: strings.Join([]string{medicare, private, dva, deposit}, "\n"),
+		CodeMap:     map[string][]string{"code1": {"80010"}},
+		PracMap:     map[string]map[string]string{drName: {"code1": "30"}},
+		FeeRules: map[string][]FeeRule{drName: {
+			{AccountType: "Medicare", Percentage: "20"},
+			{ServiceCode: "code1", AccountType: "medicare", PaymentMethod: "Direct Credit", Percentage: "25"},
+			{AccountType: "DVA", Percentage: "22"},
+		}},
+		counter: &memoryCounter{},
+	}
+	res, err := processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Empty(t, res.Issues)
+	details := res.ChargeDetail[drName]
+	require.Len(t, details.PaymentDetails, 3)
+	require.Equal(t, "25", details.PaymentDetails[0].Service.Percentage)
+	require.Equal(t, "30", details.PaymentDetails[1].Service.Percentage)
+	require.Equal(t, "22", details.PaymentDetails[2].Service.Percentage)
+	require.Equal(t, int64(7700), details.ServiceCutTotal.Amount)
+	require.Equal(t, int64(30000), details.PaymentTotalNoGST.Amount)
+	require.Len(t, details.Deposits, 1)
+	require.Equal(t, int64(5000), details.DepositTotal.Amount)
+	require.Equal(t, "50.00", details.Deposits[0].Deposit.String())
+	require.NotEmpty(t, details.PdfFile)
+}
+
+func TestLocations(t *testing.T) {
+	configureLogging()
+	drName := "Dr Aha"
+	vermont := "Vermont Medical Clinic [no bulk-billing],Dr Aha,Irrelevant,Sick Patient,162307,174545,71756,80010,Consultation,Payment,26/02/2024,EFT,Private,0.00,100.00,0.00"
+	vermont2 := "Vermont Medical Clinic [no bulk-billing],Dr Aha,Irrelevant,Sick Patient,162308,174546,71757,80010,Consultation,Payment,26/02/2024,EFT,Private,0.00,200.00,0.00"
+	box := "Box Hill Clinic,Dr Aha,Irrelevant,Sick Patient,162309,174547,71758,80010,Consultation,Payment,26/02/2024,EFT,Private,0.00,100.00,0.00"
+	paymentFile := PaymentFile{
+		FileContent:     strings.Join([]string{vermont, box, vermont2}, "\n"),
+		CodeMap:         map[string][]string{"code1": {"80010"}},
+		PracMap:         map[string]map[string]string{drName: {"code1": "30"}},
+		LocationPracMap: map[string]map[string]map[string]string{"Vermont Medical Clinic": {drName: {"code1": "40"}}},
+		AdjustMap:       map[string][]Adjustments{drName: {{Description: "Rent", Amount: Money{Amount: 1000}}}},
+		counter:         &memoryCounter{},
+	}
+	res, err := processFileContent(paymentFile)
+	require.NoError(t, err)
+	details := res.ChargeDetail[drName]
+	require.Equal(t, int64(15000), details.ServiceCutTotal.Amount)
+	require.Len(t, details.LocationSplit, 2)
+	vermontTotals := details.LocationSplit["Vermont Medical Clinic [no bulk-billing]"]
+	require.Equal(t, int64(12000), vermontTotals.ServiceCutTotal.Amount)
+	require.Equal(t, int64(30000), vermontTotals.PaymentTotalNoGST.Amount)
+	require.Len(t, vermontTotals.PaymentDetails, 2)
+	require.Equal(t, int64(3000), details.LocationSplit["Box Hill Clinic"].ServiceCutTotal.Amount)
+	require.NotEmpty(t, details.PdfFile)
+	// a location only covers lines with the same name
+	locationPracMap := createLocationPracMap(map[string]map[string]map[string]string{
+		"Vermont": {drName: {"code1": "40"}}, "A": {drName: {"code1": "50"}},
+		"Box Hill Clinic [bulk-billing]": {drName: {"code1": "60"}}, "Box Hill Clinic": {drName: {"code1": "70"}}})
+	for _, location := range []string{"Vermont South", "B Practice", "Vermont Medical Clinic"} {
+		_, ok := locationPercentage(locationPracMap, location, drName, "code1")
+		require.False(t, ok, location)
+	}
+	percentage, ok := locationPercentage(locationPracMap, "vermont [no bulk-billing]", drName, "code1")
+	require.True(t, ok)
+	require.Equal(t, "40", percentage)
+	percentage, _ = locationPercentage(locationPracMap, "Box Hill Clinic [bulk-billing]", drName, "code1")
+	require.Equal(t, "60", percentage)
+	percentage, _ = locationPercentage(locationPracMap, "Box Hill Clinic [after hours]", drName, "code1")
+	require.Equal(t, "70", percentage)
+
+	paymentFile.InvoicePerLocation = true
+	res, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	details = res.ChargeDetail[drName]
+	require.Empty(t, details.PdfFile)
+	for _, location := range details.LocationSplit {
+		require.NotEmpty(t, location.PdfFile)
+	}
+	require.Equal(t, int64(1000), details.LocationSplit["Box Hill Clinic"].AdjustmentTotal.Amount)
+	require.Equal(t, int64(0), details.LocationSplit["Vermont Medical Clinic [no bulk-billing]"].AdjustmentTotal.Amount)
+
+	zipReader, err := zip.NewReader(bytes.NewReader(res.InvoicePackage), int64(len(res.InvoicePackage)))
+	require.NoError(t, err)
+	names := []string{}
+	for _, f := range zipReader.File {
+		names = append(names, f.Name)
+	}
+	// the numbers go on from the invoice of the first upload
+	require.ElementsMatch(t, []string{"Dr_Aha_Box_Hill_Clinic_Invoice_INV000002.pdf",
+		"Dr_Aha_Vermont_Medical_Clinic_[no_bulk-billing]_Invoice_INV000003.pdf"}, names)
+	// a "/" or "\\" in a name would be a folder in the package
+	require.Equal(t, "Dr_A-B_Box_Hill-Vermont_Invoice_JG-2024-1.pdf",
+		invoiceFileName("Dr A\\B", "Box Hill/Vermont", "JG/2024/1", ReportPeriod{}))
+}
+
+func TestParseReportPeriod(t *testing.T) {
+	tests := []struct {
+		text  string
+		start string
+		end   string
+		err   bool
+	}{
+		{"26/02/2024 - 03/03/2024", "26/02/2024", "03/03/2024", false},
+		{"1/3/2024 to 7/3/2024", "01/03/2024", "07/03/2024", false},
+		{"26/02/2024-03/03/2024", "26/02/2024", "03/03/2024", false},
+		{"03/03/2024 - 26/02/2024", "", "", true},
+		{"last week", "", "", true},
+		{"31/02/2024 - 03/03/2024", "", "", true},
+	}
+	for _, test := range tests {
+		period, err := parseReportPeriod(test.text)
+		if test.err {
+			require.Error(t, err, test.text)
+			require.False(t, period.isSet())
+			require.Equal(t, test.text, period.String())
+			continue
+		}
+		require.NoError(t, err, test.text)
+		require.Equal(t, test.start, period.Start.Format(dateLayout))
+		require.Equal(t, test.end, period.End.Format(dateLayout))
+		require.Equal(t, test.start+" - "+test.end, period.String())
+	}
+}
+
+func TestReportPeriodLines(t *testing.T) {
+	configureLogging()
+	content := "\"Payments Export \nReport\nReport Period: 26/02/2024 - 03/03/2024\",Report version: 1.10,,,,,,,,,,,,,,A Practice\n" +
+		"Location,Provider,Billed To,Patient Name,Invoice No.,Service ID,Payment ID,Item No.,Description,Status,Transaction Date,Payment Method,Account Type,GST($ incl GST),Payment($ incl GST),Deposit($ incl GST)\n" +
+		"A Practice,Dr Aha,Irrelevant,Sick Patient,162307,174545,71756,80010,Consultation,Payment,03/03/2024,EFT,Private,0.00,100.00,0.00\n" +
+		"A Practice,Dr Aha,Irrelevant,Sick Patient,162308,174546,71757,80010,Consultation,Payment,04/03/2024,EFT,Private,0.00,100.00,0.00\n" +
+		"A Practice,Dr Aha,Irrelevant,Sick Patient,162309,174547,71758,80010,Consultation,Payment,yesterday,EFT,Private,0.00,100.00,0.00\n"
+	paymentFile := PaymentFile{
+		FileContent: content,
+		CodeMap:     map[string][]string{"code1": {"80010"}},
+		PracMap:     map[string]map[string]string{"Dr Aha": {"code1": "30"}},
+		counter:     &memoryCounter{},
+	}
+	res, err := processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Equal(t, "26/02/2024", res.PeriodStart)
+	require.Equal(t, "03/03/2024", res.PeriodEnd)
+	require.Len(t, res.Issues, 2)
+	require.Equal(t, issueOutOfPeriod, res.Issues[0].Code)
+	require.Equal(t, 6, res.Issues[0].Line)
+	require.Equal(t, issueInvalidDate, res.Issues[1].Code)
+	// flagged lines are still charged
+	require.Equal(t, int64(9000), res.ChargeDetail["Dr Aha"].ServiceCutTotal.Amount)
+
+	zipReader, err := zip.NewReader(bytes.NewReader(res.InvoicePackage), int64(len(res.InvoicePackage)))
+	require.NoError(t, err)
+	require.Equal(t, "Dr_Aha_Invoice_INV000001_2024-02-26_2024-03-03.pdf", zipReader.File[0].Name)
+
+	// files without a period in them can be given one
+	paymentFile.FileContent = strings.Join(strings.Split(content, "\n")[3:], "\n")
+	paymentFile.ReportPeriod = "01/03/2024 - 03/03/2024"
+	res, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Equal(t, "01/03/2024", res.PeriodStart)
+	require.Len(t, res.Issues, 2)
+	require.Equal(t, 3, res.Issues[0].Line)
+}
+
+func TestRoundingModes(t *testing.T) {
+	tests := []struct {
+		value    *big.Rat
+		halfUp   int64
+		bankers  int64
+		truncate int64
+	}{
+		{big.NewRat(5, 2), 3, 2, 2},
+		{big.NewRat(7, 2), 4, 4, 3},
+		{big.NewRat(-5, 2), -3, -2, -2},
+		{big.NewRat(-7, 2), -4, -4, -3},
+		{big.NewRat(26, 10), 3, 3, 2},
+		{big.NewRat(-24, 10), -2, -2, -2},
+		{big.NewRat(100, 3), 33, 33, 33},
+		{big.NewRat(0, 1), 0, 0, 0},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.halfUp, RoundingPolicy{Mode: roundHalfUp}.round(test.value).Int64(), "half up %v", test.value)
+		require.Equal(t, test.bankers, RoundingPolicy{Mode: roundBankers}.round(test.value).Int64(), "bankers %v", test.value)
+		require.Equal(t, test.truncate, RoundingPolicy{Mode: roundTruncate}.round(test.value).Int64(), "truncate %v", test.value)
+	}
+	_, err := RoundingPolicy{Mode: "up"}.withDefaults()
+	require.Error(t, err)
+	_, err = RoundingPolicy{On: "file"}.withDefaults()
+	require.Error(t, err)
+}
+
+func TestRoundOnTotal(t *testing.T) {
+	configureLogging()
+	lines := []string{}
+	for i := 0; i < 3; i++ {
+		lines = append(lines, fmt.Sprintf("A Practice,Dr Aha,Irrelevant,Sick Patient,16230%v,17454%v,7175%v,80010,Consultation,Payment,26/02/2024,EFT,Private,0.00,0.01,0.00", i, i, i))
+	}
+	paymentFile := PaymentFile{
+		FileContent: strings.Join(lines, "\n"),
+		CodeMap:     map[string][]string{"code1": {"80010"}},
+		PracMap:     map[string]map[string]string{"Dr Aha": {"code1": "50"}},
+	}
+	tests := []struct {
+		rounding RoundingPolicy
+		total    int64
+	}{
+		{RoundingPolicy{}, 3},
+		{RoundingPolicy{Mode: roundBankers}, 0},
+		{RoundingPolicy{Mode: roundTruncate, On: roundOnTotal}, 1},
+		{RoundingPolicy{Mode: roundHalfUp, On: roundOnTotal}, 2},
+		{RoundingPolicy{Mode: roundBankers, On: roundOnTotal}, 2},
+	}
+	for _, test := range tests {
+		paymentFile.Rounding = test.rounding
+		res, err := processFileContent(paymentFile)
+		require.NoError(t, err)
+		details := res.ChargeDetail["Dr Aha"]
+		require.Equal(t, test.total, details.ServiceCutTotal.Amount, "%+v", test.rounding)
+		require.Equal(t, test.total, details.ServiceCodeSplit["code1"].ServiceFees.Amount, "%+v", test.rounding)
+		require.Equal(t, test.total, details.LocationSplit["A Practice"].ServiceCutTotal.Amount, "%+v", test.rounding)
+		require.NotEmpty(t, res.Rounding.Mode)
+		require.NotEmpty(t, details.PdfFile)
+	}
+}
+
+func TestTaxConfig(t *testing.T) {
+	configureLogging()
+	drName := "Dr Aha"
+	consult := "A Practice,Dr Aha,Irrelevant,Sick Patient,162307,174545,71756,80010,Consultation,Payment,26/02/2024,EFT,Private,0.00,100.00,0.00"
+	report := "A Practice,Dr Aha,Irrelevant,Sick Patient,162308,174546,71757,80020,Report,Payment,26/02/2024,EFT,Private,0.00,200.00,0.00"
+	paymentFile := PaymentFile{
+		FileContent: consult + "\n" + report,
+		CodeMap:     map[string][]string{"code1": {"80010"}, "code2": {"80020"}},
+		PracMap:     map[string]map[string]string{drName: {"code1": "30", "code2": "50"}},
+		AdjustMap: map[string][]Adjustments{drName: {{Description: "Rent", Amount: Money{Amount: 1000}},
+			{Description: "Loan interest", Amount: Money{Amount: 500}, Tax: taxInputTaxed}}},
+	}
+	res, err := processFileContent(paymentFile)
+	require.NoError(t, err)
+	details := res.ChargeDetail[drName]
+	require.Equal(t, int64(14000), details.TaxableTotal.Amount)
+	require.Equal(t, int64(500), details.InputTaxedTotal.Amount)
+	require.Equal(t, int64(1400), details.InvoiceGST.Amount)
+
+	paymentFile.Tax = TaxConfig{GSTRate: "15%", GSTFreeCodes: []string{"CODE2"}}
+	res, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	details = res.ChargeDetail[drName]
+	require.Equal(t, int64(4000), details.TaxableTotal.Amount)
+	require.Equal(t, int64(10000), details.GSTFreeTotal.Amount)
+	require.Equal(t, int64(500), details.InputTaxedTotal.Amount)
+	require.Equal(t, int64(600), details.InvoiceGST.Amount)
+	require.Equal(t, "TAX INVOICE", paymentFile.Tax.title())
+
+	paymentFile.Tax = TaxConfig{NotRegistered: true}
+	res, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	details = res.ChargeDetail[drName]
+	require.Equal(t, int64(0), details.InvoiceGST.Amount)
+	require.NotEmpty(t, details.PdfFile)
+	require.Equal(t, "INVOICE", paymentFile.Tax.title())
+
+	paymentFile.Tax = TaxConfig{GSTRate: "ten"}
+	_, err = processFileContent(paymentFile)
+	require.Error(t, err)
+
+	paymentFile.Tax = TaxConfig{}
+	paymentFile.AdjustMap[drName][0].Tax = "exempt"
+	_, err = processFileContent(paymentFile)
+	require.Error(t, err)
+}
+
+func TestFeeContracts(t *testing.T) {
+	configureLogging()
+	drName := "Dr Aha"
+	lines := []string{}
+	for i := 0; i < 3; i++ {
+		lines = append(lines, fmt.Sprintf("A Practice,Dr Aha,Irrelevant,Sick Patient,16230%v,17454%v,7175%v,80010,Consultation,Payment,26/02/2024,EFT,Private,0.00,100.00,0.00", i, i, i))
+	}
+	lines = append(lines, "A Practice,Dr Aha,Irrelevant,Sick Patient,162309,174549,71759,80020,Report,Payment,26/02/2024,EFT,Private,0.00,50.00,0.00")
+	paymentFile := PaymentFile{
+		FileContent: strings.Join(lines, "\n"),
+		CodeMap:     map[string][]string{"code1": {"80010"}, "code2": {"80020"}},
+		PracMap:     map[string]map[string]string{drName: {"code2": "20"}},
+		Contracts: map[string][]FeeContract{drName: {
+			// 35% of the first 150.00 and 30% of the rest
+			{ServiceCodes: []string{"code1"}, Tiers: []FeeTier{{UpTo: Money{Amount: 15000}, Percentage: "35"}, {Percentage: "30"}}},
+			{ServiceCodes: []string{"code2"}, PerConsult: Money{Amount: 500}},
+		}},
+		counter: &memoryCounter{},
+	}
+	res, err := processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Empty(t, res.Issues)
+	details := res.ChargeDetail[drName]
+	require.Len(t, details.Contracts, 2)
+	tiered := details.Contracts[0]
+	require.Equal(t, int64(30000), tiered.Base.Amount)
+	require.Equal(t, int64(0), tiered.LineFees.Amount)
+	type tierAmounts struct{ from, upTo, base, fee int64 }
+	require.Len(t, tiered.Tiers, 2)
+	for i, want := range []tierAmounts{{0, 15000, 15000, 5250}, {15000, 0, 15000, 4500}} {
+		tier := tiered.Tiers[i]
+		require.Equal(t, want, tierAmounts{tier.From.Amount, tier.UpTo.Amount, tier.Base.Amount, tier.Fee.Amount})
+	}
+	require.Equal(t, "30", tiered.Tiers[1].Percentage)
+	require.Equal(t, int64(9750), tiered.Fee.Amount)
+	perConsult := details.Contracts[1]
+	require.Equal(t, int64(1000), perConsult.LineFees.Amount)
+	require.Equal(t, int64(500), perConsult.ConsultFees.Amount)
+	require.Equal(t, int64(1500), perConsult.Fee.Amount)
+	require.Equal(t, int64(11250), details.ServiceCutTotal.Amount)
+	require.NotEmpty(t, details.PdfFile)
+
+	// a cap and a minimum for the period
+	paymentFile.Contracts[drName][0].Maximum = Money{Amount: 9000}
+	paymentFile.Contracts[drName][1].Minimum = Money{Amount: 2000}
+	res, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	details = res.ChargeDetail[drName]
+	require.Equal(t, int64(-750), details.Contracts[0].Limit.Amount)
+	require.Equal(t, int64(500), details.Contracts[1].Limit.Amount)
+	require.Equal(t, int64(11000), details.ServiceCutTotal.Amount)
+
+	paymentFile.Contracts[drName][0].Tiers = []FeeTier{{UpTo: Money{Amount: 15000}, Percentage: "35"}, {UpTo: Money{Amount: 10000}, Percentage: "30"}}
+	_, err = processFileContent(paymentFile)
+	require.Error(t, err)
+	//
+	// the contract fee of GST-free service codes is GST-free
+	//
+	paymentFile = PaymentFile{
+		FileContent: "A Practice,Dr Aha,Irrelevant,Sick Patient,162307,174545,71756,80010,Consultation,Payment,26/02/2024,EFT,Private,0.00,1000.00,0.00",
+		CodeMap:     map[string][]string{"code1": {"80010"}, "code2": {"80020"}},
+		PracMap:     map[string]map[string]string{drName: {"code1": "30", "code2": "30"}},
+		Tax:         TaxConfig{GSTFreeCodes: []string{"code1"}},
+		Contracts:   map[string][]FeeContract{drName: {{Tiers: []FeeTier{{Percentage: "30"}}}}},
+	}
+	res, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	details = res.ChargeDetail[drName]
+	require.Equal(t, int64(30000), details.ServiceCutTotal.Amount)
+	require.Equal(t, int64(30000), details.GSTFreeTotal.Amount)
+	require.Equal(t, int64(0), details.TaxableTotal.Amount)
+	require.Equal(t, int64(0), details.InvoiceGST.Amount)
+	// a contract over GST-free and taxable codes is split by their payments
+	paymentFile.FileContent += "\nA Practice,Dr Aha,Irrelevant,Sick Patient,162308,174546,71757,80020,Report,Payment,26/02/2024,EFT,Private,0.00,500.00,0.00"
+	res, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	details = res.ChargeDetail[drName]
+	require.Equal(t, int64(45000), details.ServiceCutTotal.Amount)
+	require.Equal(t, int64(30000), details.GSTFreeTotal.Amount)
+	require.Equal(t, int64(15000), details.TaxableTotal.Amount)
+	require.Equal(t, int64(1500), details.InvoiceGST.Amount)
+}
+
+func TestRateSchedules(t *testing.T) {
+	configureLogging()
+	drName := "Dr Aha"
+	february := "A Practice,Dr Aha,Irrelevant,Sick Patient,162307,174545,71756,80010,Consultation,Payment,28/02/2024,EFT,Private,0.00,100.00,0.00"
+	march := "A Practice,Dr Aha,Irrelevant,Sick Patient,162308,174546,71757,80010,Consultation,Payment,01/03/2024,EFT,Private,0.00,100.00,0.00"
+	newItem := "A Practice,Dr Aha,Irrelevant,Sick Patient,162309,174547,71758,80020,Consultation,Payment,02/03/2024,EFT,Private,0.00,100.00,0.00"
+	paymentFile := PaymentFile{
+		FileContent: strings.Join([]string{february, march, newItem}, "\n"),
+		CodeMap:     map[string][]string{"code1": {"80010"}},
+		PracMap:     map[string]map[string]string{drName: {"code1": "30"}},
+		Schedules: []RateSchedule{
+			{EffectiveFrom: "01/03/2024", CodeMap: map[string][]string{"code1": {"80020"}},
+				PracMap: map[string]map[string]string{drName: {"code1": "35"}}},
+		},
+		counter: &memoryCounter{},
+	}
+	res, err := processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Empty(t, res.Issues)
+	details := res.ChargeDetail[drName]
+	require.Equal(t, "30", details.PaymentDetails[0].Service.Percentage)
+	require.Equal(t, "35", details.PaymentDetails[1].Service.Percentage)
+	require.Equal(t, "35", details.PaymentDetails[2].Service.Percentage)
+	require.Equal(t, int64(10000), details.ServiceCutTotal.Amount)
+	split := details.ServiceCodeSplit["code1"].RateSplit
+	require.Len(t, split, 2)
+	require.Equal(t, int64(3000), split["30"].ServiceFees.Amount)
+	require.Equal(t, int64(7000), split["35"].ServiceFees.Amount)
+	require.Equal(t, int64(20000), split["35"].ExGstFees.Amount)
+
+	// the newer schedule wins where they overlap, it does not add to the older one
+	paymentFile.Schedules = append(paymentFile.Schedules, RateSchedule{EffectiveFrom: "02/03/2024", EffectiveTo: "31/03/2024",
+		CodeMap: map[string][]string{"code1": {"80020"}}, PracMap: map[string]map[string]string{drName: {"code1": "40"}}})
+	res, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Equal(t, "40", res.ChargeDetail[drName].PaymentDetails[2].Service.Percentage)
+
+	paymentFile.Schedules[1].EffectiveTo = "01/02/2024"
+	_, err = processFileContent(paymentFile)
+	require.Error(t, err)
+}
+
+func TestMoney(t *testing.T) {
+	tests := []struct {
+		cents  int64
+		output string
+	}{
+		{0, "0.00"},
+		{5, "0.05"},
+		{-22450, "(224.50)"},
+		{99999, "999.99"},
+		{123456, "1,234.56"},
+		{-123456789, "(1,234,567.89)"},
+		{math.MaxInt64, "92,233,720,368,547,758.07"},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.output, newMoney(test.cents, defaultCurrency).String())
+	}
+
+	_, err := newMoney(math.MaxInt64, defaultCurrency).Add(newMoney(1, defaultCurrency))
+	require.ErrorIs(t, err, ErrOverflow)
+	_, err = newMoney(-math.MaxInt64, defaultCurrency).Sub(newMoney(1, defaultCurrency))
+	require.ErrorIs(t, err, ErrOverflow)
+	_, err = newMoney(math.MaxInt64/2+1, defaultCurrency).Mul(2)
+	require.ErrorIs(t, err, ErrOverflow)
+	_, err = newMoney(100, "AUD").Add(newMoney(100, "NZD"))
+	require.ErrorIs(t, err, ErrCurrency)
+	sum, err := newMoney(100, "AUD").Add(Money{Amount: 50})
+	require.NoError(t, err)
+	require.Equal(t, newMoney(150, "AUD"), sum)
+	_, err = parseMoney("92233720368547758.08", defaultCurrency)
+	require.ErrorIs(t, err, ErrOverflow)
+
+	data, err := json.Marshal(newMoney(-123456, defaultCurrency))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"amount":-123456,"currency":"AUD","formatted":"(1,234.56)"}`, string(data))
+	var amount Money
+	require.NoError(t, json.Unmarshal(data, &amount))
+	require.Equal(t, newMoney(-123456, defaultCurrency), amount)
+	// adjustments and contracts send plain cents
+	var adjustment Adjustments
+	require.NoError(t, json.Unmarshal([]byte(`{"description":"Rent","amount":1000}`), &adjustment))
+	require.Equal(t, Money{Amount: 1000}, adjustment.Amount)
+	require.Error(t, json.Unmarshal([]byte(`{"amount":"ten"}`), &adjustment))
+}
+
+func TestAdjustments(t *testing.T) {
+	configureLogging()
+	drName := "Dr Aha"
+	paymentFile := PaymentFile{
+		FileContent:  "A Practice,Dr Aha,Irrelevant,Sick Patient,162307,174545,71756,80010,Consultation,Payment,05/03/2024,EFT,Private,0.00,100.00,0.00",
+		CodeMap:      map[string][]string{"code1": {"80010"}},
+		PracMap:      map[string]map[string]string{drName: {"code1": "30"}},
+		ReportPeriod: "01/03/2024 - 31/03/2024",
+		AdjustMap: map[string][]Adjustments{drName: {
+			{Description: "Room rent", Amount: Money{Amount: 11000}, GSTInclusive: true, Recurrence: recurMonthly, From: "01/01/2024"},
+			{Description: "Refund", Amount: Money{Amount: 500}, Type: adjustCredit},
+			{Description: "Admin fee", Type: adjustPercentage, Percentage: "10"},
+			// Mondays from the 4th
+			{Description: "Cleaning", Amount: Money{Amount: 2000}, Recurrence: recurWeekly, From: "04/03/2024", To: "30/06/2024"},
+		}},
+	}
+	res, err := processFileContent(paymentFile)
+	require.NoError(t, err)
+	details := res.ChargeDetail[drName]
+	require.Len(t, details.Adjustments, 4)
+	rent := details.Adjustments[0]
+	require.Equal(t, 1, rent.Times)
+	require.Equal(t, int64(10000), rent.Amount.Amount)
+	require.Equal(t, int64(1000), rent.GST.Amount)
+	require.Equal(t, "Room rent (1 x monthly, 110.00 incl. GST)", adjustmentText(rent))
+	require.Equal(t, int64(-500), details.Adjustments[1].Amount.Amount)
+	require.Equal(t, int64(300), details.Adjustments[2].Amount.Amount)
+	require.Equal(t, 4, details.Adjustments[3].Times)
+	require.Equal(t, int64(8000), details.Adjustments[3].Amount.Amount)
+	require.Equal(t, int64(17800), details.AdjustmentTotal.Amount)
+	// 10% on everything but the rent, whose GST is included in the 110.00
+	require.Equal(t, int64(20800), details.TaxableTotal.Amount)
+	require.Equal(t, int64(1080+1000), details.InvoiceGST.Amount)
+	require.NotEmpty(t, details.PdfFile)
+
+	// a quarter has three rent days, the rent due on the 31st is due on the 29th in February
+	paymentFile.ReportPeriod = "01/01/2024 - 31/03/2024"
+	paymentFile.AdjustMap[drName][0].From = "31/01/2024"
+	res, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Equal(t, 3, res.ChargeDetail[drName].Adjustments[0].Times)
+	require.Equal(t, time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC), addMonths(time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC), 1))
+
+	// not registered for GST, the rent is charged as it is
+	paymentFile.Tax = TaxConfig{NotRegistered: true}
+	res, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Equal(t, int64(33000), res.ChargeDetail[drName].Adjustments[0].Amount.Amount)
+	require.Equal(t, int64(0), res.ChargeDetail[drName].InvoiceGST.Amount)
+
+	// the cleaning ended in June, it is not on the invoice for July
+	july, err := parseReportPeriod("01/07/2024 - 31/07/2024")
+	require.NoError(t, err)
+	lines, err := resolveAdjustments(paymentFile.AdjustMap[drName], Money{Amount: 3000, Currency: defaultCurrency}, july,
+		TaxConfig{}, RoundingPolicy{})
+	require.NoError(t, err)
+	descriptions := []string{}
+	for _, line := range lines {
+		descriptions = append(descriptions, line.Description)
+	}
+	require.Equal(t, []string{"Room rent", "Refund", "Admin fee"}, descriptions)
+
+	for _, adj := range []Adjustments{
+		{Description: "Rent", Amount: Money{Amount: 100}, Recurrence: recurMonthly},
+		{Description: "Rent", Amount: Money{Amount: 100}, Recurrence: "yearly", From: "01/01/2024"},
+		{Description: "Rent", Amount: Money{Amount: 100}, Type: "discount"},
+		{Description: "Admin", Type: adjustPercentage, Percentage: "5", GSTInclusive: true},
+		{Description: "Refund", Amount: Money{Amount: -100}, Type: adjustCredit},
+	} {
+		paymentFile.AdjustMap[drName] = []Adjustments{adj}
+		_, err = processFileContent(paymentFile)
+		require.Error(t, err, "%+v", adj)
+	}
+}
+
+type memoryLedger map[string]LedgerEntry
+
+func (l memoryLedger) entries(providers []string) (map[string]LedgerEntry, error) {
+	res := map[string]LedgerEntry{}
+	for _, provider := range providers {
+		if entry, ok := l[provider]; ok {
+			res[provider] = entry
+		}
+	}
+	return res, nil
+}
+
+func (l memoryLedger) record(entries map[string]LedgerEntry) error {
+	for provider, entry := range entries {
+		l[provider] = entry
+	}
+	return nil
+}
+
+func TestBalancePolicy(t *testing.T) {
+	configureLogging()
+	drName := "Dr Aha"
+	payment := "A Practice,Dr Aha,Irrelevant,Sick Patient,162307,174545,71756,80010,Consultation,Payment,05/03/2024,EFT,Private,0.00,100.00,0.00"
+	reversal := "A Practice,Dr Aha,Irrelevant,Sick Patient,162300,174540,71750,80010,Consultation,Reversed payment,06/03/2024,EFT,Private,0.00,(200.00),0.00"
+	paymentFile := PaymentFile{
+		FileContent:  payment + "\n" + reversal,
+		CodeMap:      map[string][]string{"code1": {"80010"}},
+		PracMap:      map[string]map[string]string{drName: {"code1": "30"}},
+		ReportPeriod: "01/03/2024 - 31/03/2024",
+		counter:      &memoryCounter{},
+	}
+	// the fees of -30.00 and their GST
+	res, err := processFileContent(paymentFile)
+	require.NoError(t, err)
+	details := res.ChargeDetail[drName]
+	require.Equal(t, int64(-3300), details.AmountDue.Amount)
+	require.Equal(t, documentInvoice, details.Document)
+	require.NotEmpty(t, details.PdfFile)
+	require.Len(t, res.Issues, 1)
+	require.Equal(t, issueNegativeTotal, res.Issues[0].Code)
+	require.Equal(t, severityWarning, res.Issues[0].Severity)
+
+	paymentFile.Balance = BalancePolicy{Mode: balanceCreditNote}
+	res, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	details = res.ChargeDetail[drName]
+	require.Equal(t, documentCreditNote, details.Document)
+	require.NotEmpty(t, details.PdfFile)
+	require.Contains(t, res.Issues[0].Message, "credit note")
+	//
+	// carried forward, processing the period again does not count the balance twice
+	//
+	ledger := memoryLedger{}
+	paymentFile.Balance = BalancePolicy{Mode: balanceCarryForward}
+	paymentFile.ledger = ledger
+	for range 2 {
+		res, err = processFileContent(paymentFile)
 		require.NoError(t, err)
-		require.Equal(t, tc.cents, cents)
+		details = res.ChargeDetail[drName]
+		require.Equal(t, documentCarriedForward, details.Document)
+		require.Empty(t, details.PdfFile)
+		require.Empty(t, res.InvoicePackage)
+		require.Equal(t, int64(-3300), details.CarriedForward.Amount)
+		require.Equal(t, LedgerEntry{Period: "01/03/2024 - 31/03/2024", BroughtForward: Money{Currency: defaultCurrency},
+			Balance: Money{Amount: -3300, Currency: defaultCurrency}}, ledger[drName])
+	}
+	// the next period has fees of 60.00, 66.00 with GST, less the credit
+	paymentFile.FileContent = strings.ReplaceAll(strings.ReplaceAll(payment, "/03/", "/04/"), "100.00", "200.00")
+	paymentFile.ReportPeriod = "01/04/2024 - 30/04/2024"
+	res, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Empty(t, res.Issues)
+	details = res.ChargeDetail[drName]
+	require.Equal(t, documentInvoice, details.Document)
+	require.NotEmpty(t, details.PdfFile)
+	require.Equal(t, int64(-3300), details.BroughtForward.Amount)
+	require.Equal(t, int64(3300), details.AmountDue.Amount)
+	require.Equal(t, int64(0), ledger[drName].Balance.Amount)
+	// below the minimum
+	delete(ledger, drName)
+	paymentFile.Balance.Minimum = Money{Amount: 10000}
+	res, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	details = res.ChargeDetail[drName]
+	require.Equal(t, documentCarriedForward, details.Document)
+	require.Equal(t, int64(6600), ledger[drName].Balance.Amount)
+	require.Equal(t, issueBelowMinimum, res.Issues[0].Code)
 
-		_, res, _, _, err := calcPayment(tc.dval, "0", tc.perc)
+	//
+	// with an invoice per location the policy is applied to the total of the provider
+	//
+	paymentFile.FileContent = payment + "\n" + strings.Replace(reversal, "A Practice", "B Practice", 1)
+	paymentFile.ReportPeriod = "01/03/2024 - 31/03/2024"
+	paymentFile.InvoicePerLocation = true
+	paymentFile.Balance = BalancePolicy{Mode: balanceCreditNote}
+	delete(ledger, drName)
+	res, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	details = res.ChargeDetail[drName]
+	require.Equal(t, int64(-3300), details.AmountDue.Amount)
+	require.Equal(t, documentCreditNote, details.Document)
+	require.Equal(t, documentCreditNote, details.LocationSplit["A Practice"].Document)
+	require.Equal(t, documentCreditNote, details.LocationSplit["B Practice"].Document)
+	require.Len(t, res.Issues, 1)
+	require.Equal(t, issueNegativeTotal, res.Issues[0].Code)
+	require.NotEmpty(t, res.InvoicePackage)
+
+	paymentFile.Balance = BalancePolicy{Mode: balanceCarryForward}
+	res, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	details = res.ChargeDetail[drName]
+	require.Equal(t, documentCarriedForward, details.Document)
+	require.Equal(t, int64(3300), details.LocationSplit["A Practice"].CarriedForward.Amount)
+	require.Equal(t, int64(-6600), details.LocationSplit["B Practice"].CarriedForward.Amount)
+	require.Equal(t, int64(-3300), ledger[drName].Balance.Amount)
+	require.Empty(t, res.InvoicePackage)
+	// a negative location is invoiced when the total is not
+	delete(ledger, drName)
+	paymentFile.FileContent = strings.Replace(payment, "100.00", "300.00", 1) + "\n" + strings.Replace(reversal, "A Practice", "B Practice", 1)
+	res, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Empty(t, res.Issues)
+	details = res.ChargeDetail[drName]
+	require.Equal(t, int64(3300), details.AmountDue.Amount)
+	require.Equal(t, documentInvoice, details.LocationSplit["B Practice"].Document)
+	require.Equal(t, int64(-6600), details.LocationSplit["B Practice"].AmountDue.Amount)
+	require.Equal(t, int64(0), details.LocationSplit["B Practice"].CarriedForward.Amount)
+	require.Equal(t, int64(0), ledger[drName].Balance.Amount)
+	zipReader, err := zip.NewReader(bytes.NewReader(res.InvoicePackage), int64(len(res.InvoicePackage)))
+	require.NoError(t, err)
+	require.Len(t, zipReader.File, 2)
+
+	paymentFile.Balance = BalancePolicy{Mode: balanceCreditNote, Minimum: Money{Amount: 100}}
+	_, err = processFileContent(paymentFile)
+	require.ErrorContains(t, err, "Invalid balance policy")
+	paymentFile.Balance = BalancePolicy{Mode: "writeOff"}
+	_, err = processFileContent(paymentFile)
+	require.ErrorContains(t, err, "unknown mode")
+}
+
+func TestItemMatching(t *testing.T) {
+	configureLogging()
+	items := newItemMatcher(createItemMap(map[string][]string{
+		"consult":  {"80000-80170", "91166"},
+		"long":     {"80100-80110"},
+		"group":    {"802*"},
+		"other":    {"8*"},
+		"phone":    {"Psychological therapy health service provided by phone"},
+		"physical": {"Physiotherapy - initial assessment"},
+	}))
+	tests := []struct {
+		item        string
+		description string
+		code        string
+		matchedBy   string
+		applied     bool
+	}{
+		{"91166", "", "consult", matchExact, true},
+		{"80010", "", "consult", matchRange, true},
+		{"80105", "", "long", matchRange, true},
+		{"80210", "", "group", matchPrefix, true},
+		{"81000", "", "other", matchPrefix, true},
+		{"70000", "", "", "", false},
+		{"", "Psychological therapy health service provided by phone", "phone", matchExact, true},
+		{"", "psychological therapy, health service provided by  PHONE", "phone", matchDescription, true},
+		{"", "Psychological therapy health service provided by telephone", "phone", matchFuzzy, true},
+		{"", "Psychological therapy by video", "phone", matchFuzzy, false},
+		{"", "Massage", "", "", false},
+		{"", "", "", "", false},
+	}
+	for _, test := range tests {
+		match, applied := items.match(test.item, test.description, defaultMatchConfidence)
+		require.Equal(t, test.applied, applied, test.item+test.description)
+		require.Equal(t, test.code, match.ServiceCode, test.item+test.description)
+		require.Equal(t, test.matchedBy, match.MatchedBy, test.item+test.description)
+	}
+	//
+	// low confidence matches are reported rather than applied
+	//
+	drName := "Dr Aha"
+	fuzzy := "A Practice,Dr Aha,Irrelevant,Sick Patient,162307,174545,71756,,Psychological therapy health service provided by telephone,Payment,26/02/2024,EFT,Private,0.00,100.00,0.00"
+	video := "A Practice,Dr Aha,Irrelevant,Sick Patient,162308,174546,71757,,Psychological therapy by video,Payment,26/02/2024,EFT,Private,0.00,100.00,0.00"
+	paymentFile := PaymentFile{
+		FileContent: fuzzy,
+		CodeMap:     map[string][]string{"phone": {"Psychological therapy health service provided by phone"}, "consult": {"80000-80170"}},
+		PracMap:     map[string]map[string]string{drName: {"phone": "30", "consult": "20"}},
+		counter:     &memoryCounter{},
+	}
+	res, err := processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Empty(t, res.Issues)
+	require.Equal(t, int64(3000), res.ChargeDetail[drName].ServiceCutTotal.Amount)
+	match := res.DescriptionMatches["Psychological therapy health service provided by telephone"]
+	require.True(t, match.Applied)
+	require.Greater(t, match.Confidence, defaultMatchConfidence)
+
+	paymentFile.FileContent = fuzzy + "\n" + video
+	res, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Len(t, res.Issues, 1)
+	require.Equal(t, issueLowConfidenceMatch, res.Issues[0].Code)
+	require.Equal(t, colDescription, res.Issues[0].Column)
+	require.Contains(t, res.Issues[0].Message, "service code: phone")
+	require.False(t, res.DescriptionMatches["Psychological therapy by video"].Applied)
+	require.Empty(t, res.ChargeDetail[drName].PdfFile)
+	// a lower confidence applies it
+	paymentFile.MatchConfidence = 0.5
+	res, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Empty(t, res.Issues)
+	require.Equal(t, int64(6000), res.ChargeDetail[drName].ServiceCutTotal.Amount)
+
+	paymentFile.MatchConfidence = 1.5
+	_, err = processFileContent(paymentFile)
+	require.ErrorContains(t, err, "Invalid match confidence")
+}
+
+type memoryCounter struct {
+	data invoiceCounterData
+}
+
+func (c *memoryCounter) update(change func(counter *invoiceCounterData) error) error {
+	data := c.data
+	data.Issued = maps.Clone(c.data.Issued)
+	if err := change(&data); err != nil {
+		return err
+	}
+	c.data = data
+	return nil
+}
+
+func TestInvoiceNumbering(t *testing.T) {
+	configureLogging()
+	date := time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		numbering InvoiceNumbering
+		sequence  int64
+		number    string
+		err       string
+	}{
+		{InvoiceNumbering{}, 12, "INV000012", ""},
+		{InvoiceNumbering{Prefix: "JG", Format: "{prefix}-{yyyy}{mm}-{seq:4}"}, 7, "JG-202403-0007", ""},
+		{InvoiceNumbering{Format: "{yy}/{seq}"}, 1234567, "24/1234567", ""},
+		{InvoiceNumbering{Format: "{prefix}{yyyy}"}, 1, "", "sequence number"},
+		{InvoiceNumbering{Format: "{prefix}{day}{seq}"}, 1, "", "unknown placeholder"},
+		{InvoiceNumbering{Format: "{prefix:3}{seq}"}, 1, "", "padded"},
+		{InvoiceNumbering{Start: -1}, 1, "", "negative"},
+	}
+	for _, test := range tests {
+		err := test.numbering.validate()
+		if test.err != "" {
+			require.ErrorContains(t, err, test.err, test.numbering.Format)
+			continue
+		}
+		require.NoError(t, err, test.numbering.Format)
+		require.Equal(t, test.number, test.numbering.invoiceNumber(test.sequence, date))
+	}
+	//
+	// the invoices of a company are numbered in order of the providers, across files
+	//
+	counter := &memoryCounter{}
+	paymentFile := PaymentFile{
+		FileContent: "A Practice,Dr Buhu,Irrelevant,Sick Patient,162307,174545,71756,80010,Consultation,Payment,26/02/2024,EFT,Private,0.00,100.00,0.00\n" +
+			"A Practice,Dr Aha,Irrelevant,Sick Patient,162308,174546,71757,80010,Consultation,Payment,26/02/2024,EFT,Private,0.00,100.00,0.00",
+		CodeMap:      map[string][]string{"code1": {"80010"}},
+		PracMap:      map[string]map[string]string{"Dr Aha": {"code1": "30"}, "Dr Buhu": {"code1": "30"}},
+		ReportPeriod: "26/02/2024 - 03/03/2024",
+		Numbering:    InvoiceNumbering{Prefix: "JG", Format: "{prefix}/{yyyy}/{seq:3}", Start: 100},
+		counter:      counter,
+	}
+	res, err := processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Equal(t, "JG/2024/100", res.ChargeDetail["Dr Aha"].InvoiceNumber)
+	require.Equal(t, "JG/2024/101", res.ChargeDetail["Dr Buhu"].InvoiceNumber)
+	// the same invoices made again keep their numbers
+	res, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Equal(t, "JG/2024/100", res.ChargeDetail["Dr Aha"].InvoiceNumber)
+	require.Equal(t, int64(102), counter.data.Next)
+	nextWeek := paymentFile
+	nextWeek.FileContent = strings.ReplaceAll(paymentFile.FileContent, "26/02/2024", "05/03/2024")
+	nextWeek.ReportPeriod = "04/03/2024 - 10/03/2024"
+	res, err = processFileContent(nextWeek)
+	require.NoError(t, err)
+	zipReader, err := zip.NewReader(bytes.NewReader(res.InvoicePackage), int64(len(res.InvoicePackage)))
+	require.NoError(t, err)
+	names := []string{}
+	for _, f := range zipReader.File {
+		names = append(names, f.Name)
+	}
+	require.ElementsMatch(t, []string{"Dr_Aha_Invoice_JG-2024-102_2024-03-04_2024-03-10.pdf",
+		"Dr_Buhu_Invoice_JG-2024-103_2024-03-04_2024-03-10.pdf"}, names)
+	// balances carried forward get no number
+	weekAfter := paymentFile
+	weekAfter.FileContent = strings.ReplaceAll(paymentFile.FileContent, "26/02/2024", "12/03/2024")
+	weekAfter.ReportPeriod = "11/03/2024 - 17/03/2024"
+	weekAfter.Balance = BalancePolicy{Mode: balanceCarryForward, Minimum: Money{Amount: 5000}}
+	res, err = processFileContent(weekAfter)
+	require.NoError(t, err)
+	require.Empty(t, res.ChargeDetail["Dr Aha"].InvoiceNumber)
+	require.Equal(t, int64(104), counter.data.Next)
+	// invoices that could not be made take no number, the PDF has no 16-bit logos
+	var logo bytes.Buffer
+	require.NoError(t, png.Encode(&logo, image.NewGray16(image.Rect(0, 0, 1, 1))))
+	weekAfter.Balance = BalancePolicy{}
+	weekAfter.CompanyDetails.Logo = base64.StdEncoding.EncodeToString(logo.Bytes())
+	res, err = processFileContent(weekAfter)
+	require.NoError(t, err)
+	require.Len(t, res.Issues, 2)
+	require.Equal(t, issueInvoiceNotMade, res.Issues[0].Code)
+	require.Empty(t, res.ChargeDetail["Dr Aha"].InvoiceNumber)
+	require.Empty(t, res.InvoicePackage)
+	require.Equal(t, int64(104), counter.data.Next)
+	weekAfter.CompanyDetails.Logo = ""
+	res, err = processFileContent(weekAfter)
+	require.NoError(t, err)
+	require.Equal(t, "JG/2024/104", res.ChargeDetail["Dr Aha"].InvoiceNumber)
+	// without a company counter the invoices are not numbered
+	weekAfter.counter = nil
+	res, err = processFileContent(weekAfter)
+	require.NoError(t, err)
+	require.Len(t, res.Issues, 1)
+	require.Equal(t, issueNotNumbered, res.Issues[0].Code)
+	require.Equal(t, severityWarning, res.Issues[0].Severity)
+	require.Empty(t, res.ChargeDetail["Dr Aha"].InvoiceNumber)
+	require.NotEmpty(t, res.ChargeDetail["Dr Aha"].PdfFile)
+	require.Equal(t, int64(106), counter.data.Next)
+	// only invoices of companies not registered for GST can be made without a company
+	require.ErrorContains(t, numberingError(weekAfter), "companyId")
+	weekAfter.Tax.NotRegistered = true
+	require.NoError(t, numberingError(weekAfter))
+	weekAfter.Tax.NotRegistered = false
+	weekAfter.CompanyID = "clinic1"
+	require.NoError(t, numberingError(weekAfter))
+
+	paymentFile.Numbering.Format = "{seq:3}{day}"
+	_, err = processFileContent(paymentFile)
+	require.ErrorContains(t, err, "Invalid invoice numbering")
+}
+
+func TestInvoiceTemplate(t *testing.T) {
+	configureLogging()
+	layout, err := InvoiceTemplate{}.layout()
+	require.NoError(t, err)
+	require.Equal(t, allSections, layout.sections)
+	require.Equal(t, allPages, layout.pages)
+	require.Equal(t, "Date", layout.columns[0].Title)
+	require.Equal(t, defaultFont, layout.face)
+	layout, err = InvoiceTemplate{Base: templateSummary, Font: "times", TextColor: "#1A2B3C",
+		Columns: []TemplateColumn{{Field: columnPatient, Title: "Client", Width: 60}, {Field: columnServiceFee, Width: 30}}}.layout()
+	require.NoError(t, err)
+	require.Equal(t, []string{pageBreakdown}, layout.pages)
+	require.Equal(t, "Times", layout.face)
+	require.Equal(t, 10.0, layout.size)
+	require.Equal(t, rgb{0x1a, 0x2b, 0x3c}, layout.accent)
+	require.Equal(t, []TemplateColumn{{Field: columnPatient, Title: "Client", Width: 60},
+		{Field: columnServiceFee, Title: "Service Fee", Width: 30}}, layout.columns)
+
+	tests := []struct {
+		template InvoiceTemplate
+		err      string
+	}{
+		{InvoiceTemplate{Base: "fancy"}, "unknown base template"},
+		{InvoiceTemplate{Sections: []string{sectionHeader, "footer"}}, "unknown section"},
+		{InvoiceTemplate{Sections: []string{sectionHeader}}, "needs the details section"},
+		{InvoiceTemplate{Sections: []string{sectionDetails}}, "needs the total section"},
+		{InvoiceTemplate{Sections: []string{}}, "needs the details section"},
+		{InvoiceTemplate{Pages: []string{pageBreakdown, pageBreakdown}}, "given twice"},
+		{InvoiceTemplate{Columns: []TemplateColumn{{Field: "doctor", Width: 20}}}, "unknown column"},
+		{InvoiceTemplate{Columns: []TemplateColumn{{Field: columnDate}}}, "needs a width"},
+		{InvoiceTemplate{Columns: []TemplateColumn{{Field: columnDate, Width: 120}, {Field: columnPatient, Width: 120}}}, "wider than the page"},
+		{InvoiceTemplate{Font: "Comic Sans"}, "unknown font"},
+		{InvoiceTemplate{FontSize: 30}, "font size"},
+		{InvoiceTemplate{AccentColor: "red"}, "accent colour"},
+		{InvoiceTemplate{Logo: LogoPlacement{X: 200, Y: 20, Width: 35, Height: 35}}, "on the page"},
+	}
+	for _, test := range tests {
+		require.ErrorContains(t, test.template.validate(), test.err, test.err)
+	}
+	//
+	// the template decides which pages the invoices have
+	//
+	paymentFile := PaymentFile{
+		FileContent:  "A Practice,Dr Aha,Irrelevant,Sick Patient,162307,174545,71756,80010,Consultation,Payment,26/02/2024,EFT,Private,0.00,100.00,0.00",
+		CodeMap:      map[string][]string{"code1": {"80010"}},
+		PracMap:      map[string]map[string]string{"Dr Aha": {"code1": "30"}},
+		ReportPeriod: "26/02/2024 - 03/03/2024",
+	}
+	pages := func(res FileProcessingResponse) int {
+		return bytes.Count(res.ChargeDetail["Dr Aha"].PdfFile, []byte("<</Type /Page\n"))
+	}
+	res, err := processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Equal(t, 3, pages(res))
+	paymentFile.Template = InvoiceTemplate{Base: templateSummary}
+	res, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Equal(t, 2, pages(res))
+	paymentFile.Template = InvoiceTemplate{Pages: []string{}, Sections: []string{sectionHeader, sectionDetails, sectionTotal},
+		Footer: "Thank you, {rounding}"}
+	res, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Equal(t, 1, pages(res))
+
+	// the rounding policy is always stated, after a footer without it
+	rounding := RoundingPolicy{Mode: roundBankers, On: roundOnTotal}
+	layout, err = InvoiceTemplate{}.layout()
+	require.NoError(t, err)
+	require.Equal(t, []string{rounding.String()}, layout.footerLines(rounding))
+	layout, err = InvoiceTemplate{Footer: "Thank you, {rounding}"}.layout()
+	require.NoError(t, err)
+	require.Equal(t, []string{"Thank you, " + rounding.String()}, layout.footerLines(rounding))
+	layout, err = InvoiceTemplate{Footer: "Thank you for your business"}.layout()
+	require.NoError(t, err)
+	require.Equal(t, []string{"Thank you for your business", rounding.String()}, layout.footerLines(rounding))
+
+	paymentFile.Template = InvoiceTemplate{FontSize: 2}
+	_, err = processFileContent(paymentFile)
+	require.ErrorContains(t, err, "Invalid invoice template")
+}
+
+func TestTablePageBreaks(t *testing.T) {
+	configureLogging()
+	// a core font, so the text can be found in the PDF
+	layout, err := InvoiceTemplate{Font: "Arial"}.layout()
+	require.NoError(t, err)
+	payments := []PaymentFileResponse{}
+	for i := 0; i < 100; i++ {
+		payments = append(payments, PaymentFileResponse{TransDate: "26/02/2024", Patient: fmt.Sprintf("Patient %d", i),
+			ItemNo: "80010", Payment: Money{Amount: 10000, Currency: "AUD"}, ServiceFee: Money{Amount: 3000, Currency: "AUD"},
+			Service: ServiceCut{Code: "code1", Percentage: "30"}})
+	}
+	pdf := newInvoicePdf(layout, layout.footerLines(RoundingPolicy{Mode: roundHalfUp}))
+	pdf.SetCompression(false)
+	pdf.AddPage()
+	pdf.SetMargins(10, 10, 30)
+	addServiceFeeCalculation(pdf, PaymentTotals{PaymentDetails: payments})
+	var buf bytes.Buffer
+	require.NoError(t, pdf.Output(&buf))
+	out := buf.String()
+	// every page has the header, the subtotal of the rows before it and a page number
+	require.Equal(t, 3, bytes.Count(buf.Bytes(), []byte("<</Type /Page\n")))
+	require.Equal(t, 3, strings.Count(out, "(Patient)Tj"))
+	require.Equal(t, 2, strings.Count(out, "(Subtotal)Tj"))
+	require.Equal(t, 2, strings.Count(out, "(Brought over)Tj"))
+	require.Contains(t, out, "(Page 1 of 3)Tj")
+	require.Contains(t, out, "(Page 3 of 3)Tj")
+	require.Equal(t, 3, strings.Count(out, "(Service fees are rounded half up on every line.)Tj"))
+	require.Equal(t, 100, strings.Count(out, "(Patient "))
+	// the subtotals are running totals of the rows so far
+	firstPage := strings.Count(out[:strings.Index(out, "(Subtotal)Tj")], "(Patient ")
+	require.Contains(t, out, fmt.Sprintf("(%v)Tj", Money{Amount: int64(firstPage) * 3000, Currency: "AUD"}))
+}
+
+func TestUnicodeFonts(t *testing.T) {
+	configureLogging()
+	tests := []struct {
+		text      string
+		width     int
+		truncated string
+	}{
+		{"Zoë Adams-Smith", 12, "Zoë Adams-Sm"},
+		{"Nguyễn Thị Minh Khai", 6, "Nguyễn"},
+		{"Nguye\u0302\u0303n Thi\u0323", 5, "Nguye\u0302\u0303"}, // the accents as combining marks
+		{"王小明", 2, "王小"},
+		{"80010", 8, "80010"},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.truncated, truncate(test.text, test.width), test.text)
+	}
+	layout, err := InvoiceTemplate{Font: "dejavu sans"}.layout()
+	require.NoError(t, err)
+	require.Equal(t, defaultFont, layout.face)
+	//
+	// the names are printed with the embedded font, unless the company chose a core font
+	//
+	paymentFile := PaymentFile{
+		FileContent:  "A Practice,Dr Nguyễn,Irrelevant,Zoë Trần,162307,174545,71756,80010,Consultation,Payment,26/02/2024,EFT,Private,0.00,100.00,0.00",
+		CodeMap:      map[string][]string{"code1": {"80010"}},
+		PracMap:      map[string]map[string]string{"Dr Nguyễn": {"code1": "30"}},
+		ReportPeriod: "26/02/2024 - 03/03/2024",
+	}
+	res, err := processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Contains(t, string(res.ChargeDetail["Dr Nguyễn"].PdfFile), "/FontFile2")
+	paymentFile.Template = InvoiceTemplate{Font: "Times"}
+	res, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.NotContains(t, string(res.ChargeDetail["Dr Nguyễn"].PdfFile), "/FontFile2")
+	//
+	// Chinese, Japanese and Korean names are printed in the fallback font, which has their letters
+	//
+	pdf := newInvoicePdf(layout, nil)
+	pdf.AddPage()
+	for _, name := range []string{"王小明", "张伟", "さくら", "김민준"} {
+		pdf.setFont(layout.font(Font{}), name)
+		_, em := pdf.GetFontSize()
+		require.Equal(t, float64(utf8.RuneCountInString(name))*em, pdf.GetStringWidth(name), name) // no letter is missing
+	}
+	require.NoError(t, pdf.Error())
+	paymentFile.FileContent = "A Practice,Dr Nguyễn,Irrelevant,王小明,162307,174545,71756,80010,Consultation,Payment,26/02/2024,EFT,Private,0.00,100.00,0.00"
+	for _, font := range []string{defaultFont, "Times"} {
+		paymentFile.Template = InvoiceTemplate{Font: font}
+		res, err = processFileContent(paymentFile)
 		require.NoError(t, err)
-		require.Equal(t, tc.pcents, res)
+		require.Contains(t, string(res.ChargeDetail["Dr Nguyễn"].PdfFile), "/BaseFont /utf8unifont", font)
+	}
+	paymentFile.FileContent = "A Practice,Dr Nguyễn,Irrelevant,Zoë Trần,162307,174545,71756,80010,Consultation,Payment,26/02/2024,EFT,Private,0.00,100.00,0.00"
+	res, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.NotContains(t, string(res.ChargeDetail["Dr Nguyễn"].PdfFile), "unifont")
+}
+
+func TestReproducibleInvoices(t *testing.T) {
+	configureLogging()
+	payments := sortedPayments([]PaymentFileResponse{{TransDate: "28/02/2024", Patient: "Ann"}, {TransDate: "27/02/2024", Patient: "Bob"},
+		{TransDate: "27/02/2024", Patient: "Ann", ItemNo: "1"}, {TransDate: "unknown", Patient: "Al"}, {TransDate: "27/02/2024", Patient: "Ann", ItemNo: "2"}})
+	order := []string{}
+	for _, payment := range payments {
+		order = append(order, payment.TransDate+" "+payment.Patient+payment.ItemNo)
+	}
+	require.Equal(t, []string{"27/02/2024 Ann1", "27/02/2024 Ann2", "27/02/2024 Bob", "28/02/2024 Ann", "unknown Al"}, order)
+	layout, err := InvoiceTemplate{ServiceCodes: []string{"code3", "code9", "code1"}}.layout()
+	require.NoError(t, err)
+	require.Equal(t, []string{"code3", "code1", "code2"}, layout.serviceCodeOrder([]string{"code1", "code2", "code3"}))
+	require.ErrorContains(t, InvoiceTemplate{ServiceCodes: []string{"code1", "code1"}}.validate(), "given twice")
+	//
+	// the same file gives the same invoices and package, byte for byte
+	//
+	paymentFile := PaymentFile{
+		FileContent: "A Practice,Dr Buhu,Irrelevant,Sick Patient,162307,174545,71756,80010,Consultation,Payment,27/02/2024,EFT,Private,0.00,100.00,0.00\n" +
+			"B Practice,Dr Buhu,Irrelevant,Other Patient,162308,174546,71757,80020,Consultation,Payment,26/02/2024,EFT,Private,0.00,150.00,0.00\n" +
+			"A Practice,Dr Aha,Irrelevant,Sick Patient,162309,174547,71758,80010,Consultation,Payment,26/02/2024,EFT,Private,0.00,100.00,0.00\n" +
+			"A Practice,Dr Aha,Irrelevant,Zoë Patient,162310,174548,71759,80020,Consultation,Payment,26/02/2024,EFT,Private,0.00,80.00,0.00",
+		CodeMap:            map[string][]string{"code1": {"80010"}, "code2": {"80020"}},
+		PracMap:            map[string]map[string]string{"Dr Aha": {"code1": "30", "code2": "40"}, "Dr Buhu": {"code1": "30", "code2": "40"}},
+		ReportPeriod:       "26/02/2024 - 03/03/2024",
+		InvoicePerLocation: true,
+		CreationDate:       "04/03/2024",
+		counter:            &memoryCounter{},
+	}
+	first, err := processFileContent(paymentFile)
+	require.NoError(t, err)
+	// a new company, so the invoices get the same numbers
+	paymentFile.counter = &memoryCounter{}
+	second, err := processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.NotEmpty(t, first.InvoicePackage)
+	require.Equal(t, first.InvoicePackage, second.InvoicePackage)
+	for provider, details := range first.ChargeDetail {
+		for location, locationDetails := range details.LocationSplit {
+			require.NotEmpty(t, locationDetails.PdfFile, provider+" "+location)
+			require.Equal(t, locationDetails.PdfFile, second.ChargeDetail[provider].LocationSplit[location].PdfFile, provider+" "+location)
+		}
+	}
+	zipReader, err := zip.NewReader(bytes.NewReader(first.InvoicePackage), int64(len(first.InvoicePackage)))
+	require.NoError(t, err)
+	names := []string{}
+	for _, f := range zipReader.File {
+		names = append(names, f.Name)
+		require.Equal(t, "2024-03-04", f.Modified.UTC().Format("2006-01-02"))
 	}
+	require.Equal(t, []string{"Dr_Aha_A_Practice_Invoice_INV000001_2024-02-26_2024-03-03.pdf",
+		"Dr_Buhu_A_Practice_Invoice_INV000002_2024-02-26_2024-03-03.pdf",
+		"Dr_Buhu_B_Practice_Invoice_INV000003_2024-02-26_2024-03-03.pdf"}, names)
+	// without a report period the invoices are dated on the creation date
+	paymentFile.ReportPeriod = ""
+	paymentFile.Numbering = InvoiceNumbering{Format: "{prefix}{yyyy}{mm}-{seq}"}
+	res, err := processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Equal(t, "INV202403-4", res.ChargeDetail["Dr Aha"].LocationSplit["A Practice"].InvoiceNumber)
+
+	paymentFile.CreationDate = "31/02/2024"
+	_, err = processFileContent(paymentFile)
+	require.ErrorContains(t, err, "Invalid creation date")
 }
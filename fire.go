@@ -55,6 +55,22 @@ func getClinicsHttp2(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// userFromRequest returns the uid of the user from the Authorization header of the request
+func userFromRequest(r *http.Request) (string, error) {
+	if gApp == nil {
+		return "", fmt.Errorf("firebase is not initialised")
+	}
+	authClient, err := gApp.Auth(r.Context())
+	if err != nil {
+		return "", fmt.Errorf("error getting Auth client: %w", err)
+	}
+	authHeader := r.Header.Get("Authorization")
+	if authHeader == "" {
+		return "", fmt.Errorf("no Authorization header")
+	}
+	return validateAndExtractUID(authHeader, authClient)
+}
+
 func validateAndExtractUID(token string, firebaseApp *auth.Client) (string, error) {
 	// Verify the Firebase Authentication token
 	tokenClaims, err := firebaseApp.VerifyIDToken(context.Background(), token)
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// The DejaVu fonts (https://dejavu-fonts.github.io) are free fonts with Latin, Greek, Cyrillic and
+// Vietnamese letters, copied from the font directory of gofpdf. They are embedded so the invoices can
+// print names with accents and in other scripts, the core fonts of the PDF only have the letters of
+// Windows-1252. They have no Chinese, Japanese or Korean letters, those are printed in GNU Unifont
+// (https://unifoundry.com/unifont), copied from the test fonts of pdfcpu. It has every letter of the
+// Basic Multilingual Plane and is licensed under the GPL with the font embedding exception. The licenses
+// are in fonts/LICENSE-DejaVu and fonts/LICENSE-Unifont. Unifont is 12 MB, so it is not embedded but read
+// from the disk when an invoice first needs it.
+//
+//go:embed fonts/DejaVu*.ttf
+var fontFiles embed.FS
+
+const (
+	defaultFont      = "DejaVu Sans"
+	fallbackFont     = "Unifont"
+	fallbackFontFile = "fonts/unifont-13.0.03.ttf"
+)
+
+// fallbackFontData reads the fallback font once, from the fallbackFont config or the fonts directory
+var fallbackFontData = sync.OnceValues(func() ([]byte, error) {
+	data, err := os.ReadFile(getConfig("fallbackFont", fallbackFontFile))
+	if err != nil {
+		return nil, fmt.Errorf("the font for Chinese, Japanese and Korean letters could not be read: %w", err)
+	}
+	return data, nil
+})
+
+// the scripts the fonts of the layouts do not have, text with them is printed in the fallback font
+var fallbackScripts = []*unicode.RangeTable{unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul, unicode.Bopomofo}
+
+// the font files of the embedded fonts per style
+var unicodeFonts = map[string]map[string]string{
+	defaultFont: {
+		"":   "fonts/DejaVuSansCondensed.ttf",
+		"B":  "fonts/DejaVuSansCondensed-Bold.ttf",
+		"I":  "fonts/DejaVuSansCondensed-Oblique.ttf",
+		"BI": "fonts/DejaVuSansCondensed-BoldOblique.ttf",
+	},
+}
+
+// addFonts makes the font of the layout available to the PDF. Text written in a core font
+// is translated to Windows-1252, letters it does not have are printed as a dot.
+func (pdf *invoicePdf) addFonts() {
+	styles, ok := unicodeFonts[pdf.layout.face]
+	if !ok {
+		pdf.translate = pdf.UnicodeTranslatorFromDescriptor("")
+		return
+	}
+	for style, file := range styles {
+		data, err := fontFiles.ReadFile(file)
+		if err != nil {
+			pdf.SetError(err)
+			return
+		}
+		pdf.AddUTF8FontFromBytes(pdf.layout.face, style, data)
+	}
+	pdf.translate = func(text string) string { return strings.ToValidUTF8(text, "?") }
+}
+
+// text returns the text as the font of the PDF needs it
+func (pdf *invoicePdf) text(text string) string {
+	if pdf.translate == nil {
+		return text
+	}
+	return pdf.translate(text)
+}
+
+// setFont sets the font for the text and returns the text as that font needs it. Text with Chinese,
+// Japanese or Korean letters is printed in the fallback font, which is only added to invoices that
+// need it. It has no bold or italic style.
+func (pdf *invoicePdf) setFont(font Font, text string) string {
+	if !strings.ContainsFunc(text, func(r rune) bool { return unicode.In(r, fallbackScripts...) }) {
+		pdf.SetFont(font.face, font.style, font.size)
+		return pdf.text(text)
+	}
+	if !pdf.fallback {
+		data, err := fallbackFontData()
+		if err != nil {
+			pdf.SetError(err)
+			return text
+		}
+		pdf.AddUTF8FontFromBytes(fallbackFont, "", data)
+		pdf.fallback = true
+	}
+	pdf.SetFont(fallbackFont, strings.NewReplacer("B", "", "I", "").Replace(font.style), font.size)
+	return strings.ToValidUTF8(text, "?")
+}
+
+// truncate shortens the text to at most width letters. Accents written as combining marks
+// stay with their letter, so "Nguyễn" is not cut between the "e" and its accents.
+func truncate(text string, width int) string {
+	letters := 0
+	for i, r := range text {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if letters == width {
+			return text[:i]
+		}
+		letters++
+	}
+	return text
+}
+
+// fontNames are the fonts a template can use, the embedded fonts first
+func fontNames() []string {
+	names := []string{defaultFont}
+	return append(names, coreFonts...)
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/pprof"
+	"strings"
 	"time"
 
 	"github.com/rs/cors"
@@ -27,6 +28,62 @@ func processFile(writer http.ResponseWriter, request *http.Request) {
 		http.Error(writer, errs, http.StatusBadRequest)
 		return
 	}
+	if err := numberingError(file); err != nil {
+		http.Error(writer, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	// the invoices of a company are numbered by its counter, which is kept for the signed in user
+	carryForward := file.Balance.Mode == balanceCarryForward
+	if file.CheckHistory || file.LoadSchedules || file.LoadAdjustments || file.LoadTemplate || carryForward ||
+		file.CompanyID != "" {
+		uid, err := userFromRequest(request)
+		if err != nil {
+			errs := fmt.Sprintf("Unauthorized: a companyId and the stored company settings need a signed in user: %v", err)
+			http.Error(writer, errs, http.StatusUnauthorized)
+			return
+		}
+		if file.CheckHistory {
+			file.history = firestoreHistory{ctx: request.Context(), client: gClient, userId: uid, companyId: file.CompanyID}
+		}
+		if carryForward {
+			file.ledger = firestoreLedger{ctx: request.Context(), client: gClient, userId: uid, companyId: file.CompanyID}
+		}
+		if file.CompanyID != "" {
+			file.counter = firestoreCounter{ctx: request.Context(), client: gClient, userId: uid, companyId: file.CompanyID}
+		}
+		if file.LoadSchedules {
+			schedules, err := getRateSchedules(request.Context(), gClient, uid, file.CompanyID)
+			if err != nil {
+				errs := fmt.Sprintf("Error loading rate schedules: %v", err)
+				http.Error(writer, errs, http.StatusInternalServerError)
+				return
+			}
+			file.Schedules = append(schedules, file.Schedules...)
+		}
+		if file.LoadAdjustments {
+			stored, err := getProviderAdjustments(request.Context(), gClient, uid, file.CompanyID)
+			if err != nil {
+				errs := fmt.Sprintf("Error loading adjustments: %v", err)
+				http.Error(writer, errs, http.StatusInternalServerError)
+				return
+			}
+			if file.AdjustMap == nil {
+				file.AdjustMap = map[string][]Adjustments{}
+			}
+			for provider, adjustments := range stored {
+				file.AdjustMap[provider] = append(adjustments, file.AdjustMap[provider]...)
+			}
+		}
+		if file.LoadTemplate {
+			template, err := getInvoiceTemplate(request.Context(), gClient, uid, file.CompanyID)
+			if err != nil {
+				errs := fmt.Sprintf("Error loading invoice template: %v", err)
+				http.Error(writer, errs, http.StatusInternalServerError)
+				return
+			}
+			file.Template = template
+		}
+	}
 	resp, err := processFileContent(file)
 	writer.Header().Set("Content-Type", "text/html; charset=utf-8")
 	if err != nil {
@@ -46,6 +103,144 @@ func processFile(writer http.ResponseWriter, request *http.Request) {
 	logInfo.Printf("Processing file took: %v", duration)
 }
 
+// numberingError is why the invoices of the file could not be numbered. Tax invoices must have a number,
+// which is counted per company.
+func numberingError(file PaymentFile) error {
+	if strings.TrimSpace(file.CompanyID) == "" && !file.Tax.NotRegistered {
+		return fmt.Errorf("tax invoices are numbered per company, a companyId must be given")
+	}
+	return nil
+}
+
+type RateScheduleRequest struct {
+	CompanyID string         `json:"companyId"`
+	Schedules []RateSchedule `json:"schedules"`
+}
+
+// saveRateSchedules replaces the rate schedules stored for a company of the signed in user
+func saveRateSchedules(writer http.ResponseWriter, request *http.Request) {
+	start := time.Now()
+
+	uid, err := userFromRequest(request)
+	if err != nil {
+		errs := fmt.Sprintf("Unauthorized: %v", err)
+		http.Error(writer, errs, http.StatusUnauthorized)
+		return
+	}
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		errs := fmt.Sprintf("Error reading request body: %v", err)
+		http.Error(writer, errs, http.StatusInternalServerError)
+		return
+	}
+	req := RateScheduleRequest{}
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		errs := fmt.Sprintf("Error parsing json body: %v", err)
+		http.Error(writer, errs, http.StatusBadRequest)
+		return
+	}
+	if _, err := createScheduleMaps(req.Schedules, nil, nil); err != nil {
+		errs := fmt.Sprintf("Invalid rate schedule: %v", err)
+		http.Error(writer, errs, http.StatusBadRequest)
+		return
+	}
+	err = setRateSchedules(request.Context(), gClient, uid, req.CompanyID, req.Schedules)
+	if err != nil {
+		errs := fmt.Sprintf("Error saving rate schedules: %v", err)
+		http.Error(writer, errs, http.StatusInternalServerError)
+		return
+	}
+	duration := time.Since(start)
+	logInfo.Printf("Saving rate schedules took: %v", duration)
+}
+
+type AdjustmentRequest struct {
+	CompanyID string                   `json:"companyId"`
+	AdjustMap map[string][]Adjustments `json:"adjustMap"` // maps providers to adjustments
+}
+
+// saveAdjustments replaces the adjustments stored per provider of a company of the signed in user
+func saveAdjustments(writer http.ResponseWriter, request *http.Request) {
+	start := time.Now()
+
+	uid, err := userFromRequest(request)
+	if err != nil {
+		errs := fmt.Sprintf("Unauthorized: %v", err)
+		http.Error(writer, errs, http.StatusUnauthorized)
+		return
+	}
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		errs := fmt.Sprintf("Error reading request body: %v", err)
+		http.Error(writer, errs, http.StatusInternalServerError)
+		return
+	}
+	req := AdjustmentRequest{}
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		errs := fmt.Sprintf("Error parsing json body: %v", err)
+		http.Error(writer, errs, http.StatusBadRequest)
+		return
+	}
+	if err := validateAdjustments(req.AdjustMap); err != nil {
+		errs := fmt.Sprintf("Invalid adjustment: %v", err)
+		http.Error(writer, errs, http.StatusBadRequest)
+		return
+	}
+	err = setProviderAdjustments(request.Context(), gClient, uid, req.CompanyID, req.AdjustMap)
+	if err != nil {
+		errs := fmt.Sprintf("Error saving adjustments: %v", err)
+		http.Error(writer, errs, http.StatusInternalServerError)
+		return
+	}
+	duration := time.Since(start)
+	logInfo.Printf("Saving adjustments took: %v", duration)
+}
+
+type InvoiceTemplateRequest struct {
+	CompanyID string          `json:"companyId"`
+	Template  InvoiceTemplate `json:"template"`
+}
+
+// saveInvoiceTemplate replaces the invoice template stored for a company of the signed in user
+func saveInvoiceTemplate(writer http.ResponseWriter, request *http.Request) {
+	start := time.Now()
+
+	uid, err := userFromRequest(request)
+	if err != nil {
+		errs := fmt.Sprintf("Unauthorized: %v", err)
+		http.Error(writer, errs, http.StatusUnauthorized)
+		return
+	}
+	body, err := io.ReadAll(request.Body)
+	if err != nil {
+		errs := fmt.Sprintf("Error reading request body: %v", err)
+		http.Error(writer, errs, http.StatusInternalServerError)
+		return
+	}
+	req := InvoiceTemplateRequest{}
+	err = json.Unmarshal(body, &req)
+	if err != nil {
+		errs := fmt.Sprintf("Error parsing json body: %v", err)
+		http.Error(writer, errs, http.StatusBadRequest)
+		return
+	}
+	if err := req.Template.validate(); err != nil {
+		errs := fmt.Sprintf("Invalid invoice template: %v", err)
+		http.Error(writer, errs, http.StatusBadRequest)
+		return
+	}
+	err = setInvoiceTemplate(request.Context(), gClient, uid, req.CompanyID, req.Template)
+	if err != nil {
+		errs := fmt.Sprintf("Error saving invoice template: %v", err)
+		http.Error(writer, errs, http.StatusInternalServerError)
+		return
+	}
+	duration := time.Since(start)
+	logInfo.Printf("Saving invoice template took: %v", duration)
+}
+
 // Returns 200 for successfully sent validation and 202 for already ACTIVE
 func registerNewSender(writer http.ResponseWriter, request *http.Request) {
 	start := time.Now()
@@ -154,6 +349,9 @@ func runHttpApi(port int) {
 	logInfo.Printf("Starting HTTP server: %s", httpAddress)
 	mux := http.NewServeMux()
 	mux.HandleFunc("/processFile", processFile)
+	mux.HandleFunc("/rateSchedules", saveRateSchedules)
+	mux.HandleFunc("/adjustments", saveAdjustments)
+	mux.HandleFunc("/templates", saveInvoiceTemplate)
 
 	//mux.HandleFunc("/register", registerNewSender)
 	//mux.HandleFunc("/active", checkSenderActive)
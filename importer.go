@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// fieldPos is where a field starts in the original file, both 1-based.
+// The column is the byte position in a CSV line and the cell column in a workbook.
+type fieldPos struct {
+	line   int
+	column int
+}
+
+// PaymentLine is one payment line of an export, normalised so the calculations
+// do not depend on the practice management system that produced the file.
+type PaymentLine struct {
+	LineNum       int // the line the record starts on in the original file
+	positions     map[string]fieldPos
+	Location      string
+	Provider      string
+	Patient       string
+	InvoiceNo     string
+	ServiceID     string
+	PaymentID     string
+	ItemNo        string
+	Description   string
+	Status        string
+	TransDate     string
+	PaymentMethod string
+	AccountType   string
+	GST           string
+	Payment       string
+	Deposit       string
+}
+
+type ImportResult struct {
+	ReportPeriod string
+	CompanyName  string
+	Lines        []PaymentLine
+	Issues       []ValidationIssue // rows which could not be read
+}
+
+// Importer turns the records of a source file into normalised payment lines
+type Importer interface {
+	Name() string
+	// Detect returns true if the records look like this importer's layout
+	Detect(records [][]string) bool
+	// positions has the position of every field of records, see readRecords
+	Import(records [][]string, positions [][]fieldPos, columnMap map[string]string) (ImportResult, error)
+}
+
+const (
+	importerPaymentsExport = "paymentsExport"
+	importerCliniko        = "cliniko"
+	importerGeneric        = "generic"
+)
+
+// rows searched for a header when detecting the layout
+const detectRows = 20
+
+// The order matters for detection, the generic importer matches almost anything
+var importers = []Importer{
+	paymentsExportImporter{},
+	columnImporter{name: importerCliniko, columns: clinikoColumns},
+	columnImporter{name: importerGeneric, columns: genericColumns},
+}
+
+// Cliniko invoice items export
+var clinikoColumns = []columnSpec{
+	{colLocation, "Business", false},
+	{colProvider, "Practitioner", true},
+	{colPatient, "Patient", true},
+	{colInvoiceNo, "Invoice Number", true},
+	{colPaymentID, "Payment ID", false},
+	{colItemNum, "Item Code", true},
+	{colDescription, "Item", true},
+	{colStatus, "Status", false},
+	{colTransDate, "Issue Date", true},
+	{colPaymentMethod, "Payment Method", false},
+	{colAccountType, "Billable Type", false},
+	{colGST, "Tax", true},
+	{colPayment, "Amount", true},
+}
+
+// A plain CSV file with a header row. Other titles can be set with the column map.
+var genericColumns = []columnSpec{
+	{colLocation, "Location", false},
+	{colProvider, "Provider", true},
+	{colPatient, "Patient", true},
+	{colInvoiceNo, "Invoice", false},
+	{colServiceID, "Service ID", false},
+	{colPaymentID, "Payment ID", false},
+	{colItemNum, "Item", true},
+	{colDescription, "Description", false},
+	{colStatus, "Status", false},
+	{colTransDate, "Date", true},
+	{colPaymentMethod, "Payment Method", false},
+	{colAccountType, "Account Type", false},
+	{colGST, "GST", true},
+	{colPayment, "Payment", true},
+	{colDeposit, "Deposit", false},
+}
+
+// selectImporter returns the importer by name. Without a name the importer is
+// detected from the header and if nothing matches the Payments Export is assumed.
+func selectImporter(name string, records [][]string) (Importer, error) {
+	if strings.TrimSpace(name) != "" {
+		for _, imp := range importers {
+			if strings.EqualFold(imp.Name(), strings.TrimSpace(name)) {
+				return imp, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown importer: %v", name)
+	}
+	for _, imp := range importers {
+		if imp.Detect(records) {
+			return imp, nil
+		}
+	}
+	return paymentsExportImporter{}, nil
+}
+
+// paymentsExportImporter reads the "Payments Export" report with the report period
+// in the first column and the clinic name in column 15 above the header row
+type paymentsExportImporter struct{}
+
+func (paymentsExportImporter) Name() string {
+	return importerPaymentsExport
+}
+
+func (paymentsExportImporter) Detect(records [][]string) bool {
+	return findHeaderRow(records, paymentsExportColumns) >= 0
+}
+
+func (paymentsExportImporter) Import(records [][]string, positions [][]fieldPos, columnMap map[string]string) (ImportResult, error) {
+	res := ImportResult{}
+	offset, header, records, reportPeriod, companyName, err := getHeaderDetails(records, providerTitle(paymentsExportColumns, columnMap))
+	if err != nil {
+		logError.Printf("Reading csv file failed with error: %v", err)
+	}
+	res.ReportPeriod = reportPeriod
+	res.CompanyName = companyName
+	res.Lines, res.Issues, err = importLines(records, positions[offset:], paymentsExportColumns, header, columnMap)
+	return res, err
+}
+
+// columnImporter reads a file whose only structure is a header row followed by data
+type columnImporter struct {
+	name    string
+	columns []columnSpec
+}
+
+func (c columnImporter) Name() string {
+	return c.name
+}
+
+func (c columnImporter) Detect(records [][]string) bool {
+	return findHeaderRow(records, c.columns) >= 0
+}
+
+func (c columnImporter) Import(records [][]string, positions [][]fieldPos, columnMap map[string]string) (ImportResult, error) {
+	res := ImportResult{}
+	title := providerTitle(c.columns, columnMap)
+	for i, record := range records {
+		if isHeaderRow(record, title) {
+			var err error
+			res.Lines, res.Issues, err = importLines(records[i+1:], positions[i+1:], c.columns, record, columnMap)
+			return res, err
+		}
+	}
+	return res, fmt.Errorf("no header with column %q found", title)
+}
+
+// findHeaderRow returns the index of the first row holding all the required column titles, or -1
+func findHeaderRow(records [][]string, columns []columnSpec) int {
+	for i, record := range records {
+		if i >= detectRows {
+			break
+		}
+		titles := map[string]bool{}
+		for _, field := range record {
+			titles[headerKey(field)] = true
+		}
+		found := true
+		for _, spec := range columns {
+			if spec.required && !titles[headerKey(spec.header)] {
+				found = false
+				break
+			}
+		}
+		if found {
+			return i
+		}
+	}
+	return -1
+}
+
+func providerTitle(columns []columnSpec, columnMap map[string]string) string {
+	for _, spec := range columns {
+		if spec.field == colProvider {
+			if title, ok := columnMap[colProvider]; ok && !isColumnPosition(title) {
+				return title
+			}
+			return spec.header
+		}
+	}
+	return ""
+}
+
+// importLines maps the data records to payment lines, keeping where each field came from
+func importLines(records [][]string, positions [][]fieldPos, columns []columnSpec, header []string,
+	columnMap map[string]string) ([]PaymentLine, []ValidationIssue, error) {
+	cols, err := resolveColumns(columns, header, columnMap)
+	if err != nil {
+		return nil, nil, err
+	}
+	minFields := cols.minFields(columns)
+	lines := []PaymentLine{}
+	issues := []ValidationIssue{}
+	for i, record := range records {
+		lineNum := 0
+		if len(positions[i]) > 0 {
+			lineNum = positions[i][0].line
+		}
+		if len(record) < minFields {
+			errStr := fmt.Sprintf("not enough fields in line: %v, found %v of %v", lineNum, len(record), minFields)
+			logError.Printf("Reading csv file failed with error: %v", errStr)
+			issues = append(issues, ValidationIssue{Line: lineNum, Value: strings.Join(record, ","),
+				Code: issueShortRow, Severity: severityError, Message: errStr})
+			continue
+		}
+		linePos := map[string]fieldPos{}
+		for field, pos := range cols {
+			if pos < len(positions[i]) {
+				linePos[field] = positions[i][pos]
+			}
+		}
+		lines = append(lines, PaymentLine{
+			LineNum:       lineNum,
+			positions:     linePos,
+			Location:      cols.get(record, colLocation),
+			Provider:      cols.get(record, colProvider),
+			Patient:       cols.get(record, colPatient),
+			InvoiceNo:     cols.get(record, colInvoiceNo),
+			ServiceID:     cols.get(record, colServiceID),
+			PaymentID:     cols.get(record, colPaymentID),
+			ItemNo:        cols.get(record, colItemNum),
+			Description:   cols.get(record, colDescription),
+			Status:        cols.get(record, colStatus),
+			TransDate:     cols.get(record, colTransDate),
+			PaymentMethod: cols.get(record, colPaymentMethod),
+			AccountType:   cols.get(record, colAccountType),
+			GST:           cols.get(record, colGST),
+			Payment:       cols.get(record, colPayment),
+			Deposit:       cols.get(record, colDeposit),
+		})
+	}
+	return lines, issues, nil
+}
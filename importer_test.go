@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectImporter(t *testing.T) {
+	configureLogging()
+	tests := []struct {
+		header string
+		name   string
+	}{
+		{"Location,Provider,Billed To,Patient Name,Invoice No.,Service ID,Payment ID,Item No.,Description,Status,Transaction Date,Payment Method,Account Type,GST($ incl GST),Payment($ incl GST),Deposit($ incl GST)", importerPaymentsExport},
+		{"Invoice Number,Issue Date,Patient,Practitioner,Business,Item Code,Item,Status,Tax,Amount", importerCliniko},
+		{"Date,Provider,Patient,Item,GST,Payment", importerGeneric},
+		{"Some,Thing,Else", importerPaymentsExport},
+	}
+	for _, test := range tests {
+		imp, err := selectImporter("", [][]string{{"title"}, strings.Split(test.header, ",")})
+		require.NoError(t, err)
+		require.Equal(t, test.name, imp.Name(), test.header)
+	}
+	imp, err := selectImporter("Cliniko", nil)
+	require.NoError(t, err)
+	require.Equal(t, importerCliniko, imp.Name())
+	_, err = selectImporter("unknown", nil)
+	require.Error(t, err)
+}
+
+func TestClinikoImport(t *testing.T) {
+	configureLogging()
+	drName := "Dr Aha"
+	content := "Invoice Number,Issue Date,Patient,Practitioner,Business,Item Code,Item,Status,Tax,Amount\n" +
+		"1001,01/03/2024,Sick Patient,Dr Aha,A Practice,80010,Psychology consultation,Paid,0.00,224.50\n"
+	paymentFile := PaymentFile{
+		FileContent: content,
+		CodeMap:     map[string][]string{"code1": {"80010"}},
+		PracMap:     map[string]map[string]string{drName: {"code1": "30"}},
+	}
+	res, err := processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Equal(t, "Sick Patient", res.ChargeDetail[drName].PaymentDetails[0].Patient)
+	require.Equal(t, "1001", res.ChargeDetail[drName].PaymentDetails[0].InvoiceNo)
+	require.Equal(t, "67.35", res.ChargeDetail[drName].PaymentDetails[0].ServiceFee.String())
+}
+
+func TestGenericImport(t *testing.T) {
+	configureLogging()
+	drName := "Dr Aha"
+	content := "Practitioner,Client,Date,Code,Tax,Paid\n" +
+		"Dr Aha,Sick Patient,01/03/2024,80010,0.00,100.00\n"
+	paymentFile := PaymentFile{
+		FileContent: content,
+		Importer:    importerGeneric,
+		CodeMap:     map[string][]string{"code1": {"80010"}},
+		PracMap:     map[string]map[string]string{drName: {"code1": "30"}},
+	}
+	_, err := processFileContent(paymentFile)
+	require.Error(t, err)
+
+	paymentFile.ColumnMap = map[string]string{colProvider: "Practitioner", colPatient: "Client",
+		colItemNum: "Code", colGST: "Tax", colPayment: "Paid"}
+	res, err := processFileContent(paymentFile)
+	require.NoError(t, err)
+	require.Equal(t, "Sick Patient", res.ChargeDetail[drName].PaymentDetails[0].Patient)
+	require.Equal(t, "30.00", res.ChargeDetail[drName].PaymentDetails[0].ServiceFee.String())
+}
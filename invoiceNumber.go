@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+const (
+	defaultInvoicePrefix = "INV"
+	defaultInvoiceFormat = "{prefix}{seq:6}"
+)
+
+// The placeholders of the invoice number format: {prefix}, {seq} or {seq:6} for the sequence
+// number padded with zeros to 6 digits, and {yyyy}, {yy} and {mm} of the invoice date
+var numberPlaceholder = regexp.MustCompile(`\{(\w+)(?::(\d+))?\}`)
+
+// InvoiceNumbering is how the invoices of a company are numbered. The sequence numbers are
+// counted per company, every invoice and credit note takes the next one.
+type InvoiceNumbering struct {
+	Prefix string `json:"prefix"` // INV if not set
+	Format string `json:"format"` // {prefix}{seq:6} if not set, e.g. "{prefix}-{yyyy}-{seq:4}"
+	Start  int64  `json:"start"`  // the first sequence number of a company, 1 if not set
+}
+
+func (n InvoiceNumbering) format() string {
+	if strings.TrimSpace(n.Format) == "" {
+		return defaultInvoiceFormat
+	}
+	return n.Format
+}
+
+func (n InvoiceNumbering) start() int64 {
+	if n.Start <= 0 {
+		return 1
+	}
+	return n.Start
+}
+
+func (n InvoiceNumbering) validate() error {
+	if n.Start < 0 {
+		return fmt.Errorf("start must not be negative: %v", n.Start)
+	}
+	hasSequence := false
+	for _, placeholder := range numberPlaceholder.FindAllStringSubmatch(n.format(), -1) {
+		switch placeholder[1] {
+		case "seq":
+			hasSequence = true
+		case "prefix", "yyyy", "yy", "mm":
+			if placeholder[2] != "" {
+				return fmt.Errorf("only the sequence number can be padded: %v", placeholder[0])
+			}
+		default:
+			return fmt.Errorf("unknown placeholder: %v", placeholder[0])
+		}
+	}
+	if !hasSequence {
+		return fmt.Errorf("format must contain the sequence number {seq}: %v", n.format())
+	}
+	return nil
+}
+
+// invoiceNumber formats the sequence number of an invoice dated on the date
+func (n InvoiceNumbering) invoiceNumber(sequence int64, date time.Time) string {
+	prefix := n.Prefix
+	if strings.TrimSpace(prefix) == "" {
+		prefix = defaultInvoicePrefix
+	}
+	return numberPlaceholder.ReplaceAllStringFunc(n.format(), func(text string) string {
+		placeholder := numberPlaceholder.FindStringSubmatch(text)
+		switch placeholder[1] {
+		case "prefix":
+			return prefix
+		case "yyyy":
+			return date.Format("2006")
+		case "yy":
+			return date.Format("06")
+		case "mm":
+			return date.Format("01")
+		}
+		width, _ := strconv.Atoi(placeholder[2])
+		return fmt.Sprintf("%0*d", width, sequence)
+	})
+}
+
+// invoiceCounter keeps the sequence numbers of the invoices of a company
+type invoiceCounter interface {
+	// update runs change on the counter and stores the result, nothing is stored if change fails
+	update(change func(counter *invoiceCounterData) error) error
+}
+
+// firestoreCounter keeps the invoice counter next to the company details
+type firestoreCounter struct {
+	ctx       context.Context
+	client    *firestore.Client
+	userId    string
+	companyId string
+}
+
+func (c firestoreCounter) update(change func(counter *invoiceCounterData) error) error {
+	return updateInvoiceCounter(c.ctx, c.client, c.userId, c.companyId, change)
+}
+
+// pendingInvoice is an invoice of the file, the location is blank for the invoice of all locations of the provider
+type pendingInvoice struct {
+	provider string
+	location string
+}
+
+// key identifies the invoice across uploads, invoices of a file without a report period can not be told apart
+func (i pendingInvoice) key(period ReportPeriod) string {
+	if !period.isSet() {
+		return ""
+	}
+	return i.provider + "|" + i.location + "|" + period.String()
+}
+
+func (i pendingInvoice) details(totals map[string]PaymentTotals) PaymentTotals {
+	if i.location == "" {
+		return totals[i.provider]
+	}
+	return totals[i.provider].LocationSplit[i.location]
+}
+
+func (i pendingInvoice) setDetails(totals map[string]PaymentTotals, details PaymentTotals) {
+	if i.location == "" {
+		totals[i.provider] = details
+		return
+	}
+	totals[i.provider].LocationSplit[i.location] = details
+}
+
+// madeInvoices are the totals with the PDFs of the invoices, the package of them and the issues of the
+// invoices that could not be made
+type madeInvoices struct {
+	totals   map[string]PaymentTotals
+	invoices []byte
+	issues   []ValidationIssue
+}
+
+// makeInvoices makes the invoices of the file and numbers them in one update of the counter of the company.
+// An invoice made again for the same report period keeps its number, the others take the next numbers in
+// order. An invoice that can not be made takes no number, and if the package can not be made the counter
+// is not changed at all, so the numbers of the company have no gaps. Without a counter the invoices are
+// not numbered.
+func (n InvoiceNumbering) makeInvoices(counter invoiceCounter, period ReportPeriod, created time.Time,
+	totals map[string]PaymentTotals, invoices []pendingInvoice,
+	makePdf func(invoice pendingInvoice, details PaymentTotals) ([]byte, error)) (madeInvoices, error) {
+	var made madeInvoices
+	change := func(data *invoiceCounterData) error {
+		// the change is run again if another upload changed the counter in the meantime
+		made = madeInvoices{totals: copyTotals(totals)}
+		for _, invoice := range invoices {
+			details := invoice.details(made.totals)
+			key := invoice.key(period)
+			sequence, issued := data.Issued[key]
+			if counter != nil {
+				if !issued {
+					sequence = max(data.Next, n.start())
+				}
+				details.InvoiceNumber = n.invoiceNumber(sequence, period.invoiceDate(created))
+			}
+			pdfBytes, err := makePdf(invoice, details)
+			if err == nil && len(pdfBytes) == 0 {
+				err = fmt.Errorf("the PDF is empty")
+			}
+			if err != nil {
+				errStr := fmt.Sprintf("provider: %v invoice could not be made. Cause: %v", invoice.provider, err)
+				if invoice.location != "" {
+					errStr = fmt.Sprintf("provider: %v at location: %v invoice could not be made. Cause: %v",
+						invoice.provider, invoice.location, err)
+				}
+				logError.Print(errStr)
+				made.issues = append(made.issues, ValidationIssue{Value: invoice.provider, Code: issueInvoiceNotMade,
+					Severity: severityError, Message: errStr})
+				continue
+			}
+			details.PdfFile = pdfBytes
+			invoice.setDetails(made.totals, details)
+			if counter != nil && !issued {
+				data.Next = sequence + 1
+				if key != "" {
+					if data.Issued == nil {
+						data.Issued = map[string]int64{}
+					}
+					data.Issued[key] = sequence
+				}
+			}
+		}
+		if len(made.issues) == len(invoices) {
+			return nil // no invoice, no package
+		}
+		pkg, err := createZipFile(made.totals, period, created)
+		if err != nil {
+			return fmt.Errorf("the package of the invoices could not be made: %w", err)
+		}
+		made.invoices = pkg
+		return nil
+	}
+	if counter == nil {
+		return made, change(&invoiceCounterData{})
+	}
+	return made, counter.update(change)
+}
+
+// copyTotals copies the totals and their location split, so the invoices can be made again
+func copyTotals(totals map[string]PaymentTotals) map[string]PaymentTotals {
+	copied := make(map[string]PaymentTotals, len(totals))
+	for provider, details := range totals {
+		details.LocationSplit = maps.Clone(details.LocationSplit)
+		copied[provider] = details
+	}
+	return copied
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// How the service code of a line was found
+const (
+	matchExact       = "exact"       // the item number, or the description as given in the CodeMap
+	matchRange       = "range"       // an item number range, "80000-80170"
+	matchPrefix      = "prefix"      // an item number prefix, "800*"
+	matchDescription = "description" // the description, ignoring case, spaces and punctuation
+	matchFuzzy       = "fuzzy"       // a description which is close to one in the CodeMap
+)
+
+const (
+	defaultMatchConfidence = 0.85 // fuzzy matches below it are reported for confirmation rather than applied
+	minMatchConfidence     = 0.5  // fuzzy matches below it are no match at all
+)
+
+var itemRangePattern = regexp.MustCompile(`^(\d+)\s*-\s*(\d+)$`)
+
+// ItemMatch is the service code found for the item number or description of a line
+type ItemMatch struct {
+	Item        string  `json:"item"`        // the item number, or the description of a line without one
+	ServiceCode string  `json:"serviceCode"` // the service code of the closest match
+	MatchedBy   string  `json:"matchedBy"`   // exact, range, prefix, description or fuzzy
+	Entry       string  `json:"entry"`       // the CodeMap entry it matched
+	Confidence  float64 `json:"confidence"`  // 1 except for fuzzy matches
+	Applied     bool    `json:"applied"`     // false if the match needs to be confirmed
+}
+
+type itemRange struct {
+	from  int64
+	to    int64
+	entry string
+	code  string
+}
+
+type itemPrefix struct {
+	prefix string
+	entry  string
+	code   string
+}
+
+type itemDescription struct {
+	normalized string
+	entry      string
+	code       string
+}
+
+// itemMatcher finds the service code of an item number, or of the description of a line without one.
+// The entries of the CodeMap are item numbers, ranges of item numbers, prefixes ending in "*" or descriptions.
+type itemMatcher struct {
+	exact        map[string]string
+	ranges       []itemRange  // narrowest first
+	prefixes     []itemPrefix // longest first
+	descriptions []itemDescription
+}
+
+// newItemMatcher sorts the entries of the item map, as made by createItemMap, by how they match
+func newItemMatcher(itemMap map[string]string) itemMatcher {
+	matcher := itemMatcher{exact: itemMap}
+	for entry, code := range itemMap {
+		text := strings.TrimSpace(entry)
+		if bounds := itemRangePattern.FindStringSubmatch(text); bounds != nil {
+			from, errFrom := strconv.ParseInt(bounds[1], 10, 64)
+			to, errTo := strconv.ParseInt(bounds[2], 10, 64)
+			if errFrom == nil && errTo == nil && from <= to {
+				matcher.ranges = append(matcher.ranges, itemRange{from: from, to: to, entry: entry, code: code})
+				continue
+			}
+		}
+		if strings.HasSuffix(text, "*") {
+			matcher.prefixes = append(matcher.prefixes, itemPrefix{prefix: strings.TrimSuffix(text, "*"), entry: entry, code: code})
+			continue
+		}
+		if normalized := normalizeDescription(text); normalized != "" && !isItemNumber(text) {
+			matcher.descriptions = append(matcher.descriptions, itemDescription{normalized: normalized, entry: entry, code: code})
+		}
+	}
+	// the most specific entry wins, ties are broken by the entry so the result does not depend on the map order
+	sort.Slice(matcher.ranges, func(i, j int) bool {
+		a, b := matcher.ranges[i], matcher.ranges[j]
+		if a.to-a.from != b.to-b.from {
+			return a.to-a.from < b.to-b.from
+		}
+		return a.entry < b.entry
+	})
+	sort.Slice(matcher.prefixes, func(i, j int) bool {
+		a, b := matcher.prefixes[i], matcher.prefixes[j]
+		if len(a.prefix) != len(b.prefix) {
+			return len(a.prefix) > len(b.prefix)
+		}
+		return a.entry < b.entry
+	})
+	sort.Slice(matcher.descriptions, func(i, j int) bool {
+		return matcher.descriptions[i].entry < matcher.descriptions[j].entry
+	})
+	return matcher
+}
+
+// match returns the service code of the item number, or of the description if there is no item number.
+// The match is not applied if it is a fuzzy match with a confidence below the one required, it is
+// returned to be confirmed. Without any match the ServiceCode is blank.
+func (m itemMatcher) match(itemNr string, description string, confidence float64) (ItemMatch, bool) {
+	if itemNr != "" {
+		result := ItemMatch{Item: itemNr, Entry: itemNr, Confidence: 1, Applied: true}
+		if code, ok := m.exact[itemNr]; ok {
+			result.ServiceCode, result.MatchedBy = code, matchExact
+			return result, true
+		}
+		if number, err := strconv.ParseInt(itemNr, 10, 64); err == nil && isItemNumber(itemNr) {
+			for _, r := range m.ranges {
+				if number >= r.from && number <= r.to {
+					result.ServiceCode, result.MatchedBy, result.Entry = r.code, matchRange, r.entry
+					return result, true
+				}
+			}
+		}
+		for _, p := range m.prefixes {
+			if strings.HasPrefix(itemNr, p.prefix) {
+				result.ServiceCode, result.MatchedBy, result.Entry = p.code, matchPrefix, p.entry
+				return result, true
+			}
+		}
+		return ItemMatch{Item: itemNr}, false
+	}
+	result := ItemMatch{Item: description, Entry: description, Confidence: 1, Applied: true}
+	if code, ok := m.exact[description]; ok && description != "" {
+		result.ServiceCode, result.MatchedBy = code, matchExact
+		return result, true
+	}
+	normalized := normalizeDescription(description)
+	if normalized == "" {
+		return ItemMatch{Item: description}, false
+	}
+	best := ItemMatch{Item: description}
+	for _, d := range m.descriptions {
+		if d.normalized == normalized {
+			result.ServiceCode, result.MatchedBy, result.Entry = d.code, matchDescription, d.entry
+			return result, true
+		}
+		if score := similarity(normalized, d.normalized); score > best.Confidence {
+			best = ItemMatch{Item: description, ServiceCode: d.code, MatchedBy: matchFuzzy, Entry: d.entry, Confidence: score}
+		}
+	}
+	if best.Confidence < minMatchConfidence {
+		return ItemMatch{Item: description}, false
+	}
+	best.Applied = best.Confidence >= confidence
+	return best, best.Applied
+}
+
+// isItemNumber returns true for item numbers, which are digits only
+func isItemNumber(text string) bool {
+	return text != "" && strings.TrimFunc(text, unicode.IsDigit) == ""
+}
+
+// normalizeDescription returns the words of the description in lower case, without punctuation
+func normalizeDescription(description string) string {
+	words := strings.FieldsFunc(strings.ToLower(description), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(words, " ")
+}
+
+// similarity is the Sørensen-Dice coefficient of the letter pairs of the descriptions,
+// from 0 for nothing in common to 1 for the same letters in the same order
+func similarity(a string, b string) float64 {
+	pairsA, pairsB := letterPairs(a), letterPairs(b)
+	if len(pairsA)+len(pairsB) == 0 {
+		return 0
+	}
+	counts := map[string]int{}
+	for _, pair := range pairsA {
+		counts[pair]++
+	}
+	common := 0
+	for _, pair := range pairsB {
+		if counts[pair] > 0 {
+			counts[pair]--
+			common++
+		}
+	}
+	return float64(2*common) / float64(len(pairsA)+len(pairsB))
+}
+
+// letterPairs returns the adjacent letter pairs of every word
+func letterPairs(text string) []string {
+	pairs := []string{}
+	for _, word := range strings.Fields(text) {
+		runes := []rune(word)
+		for i := 0; i+1 < len(runes); i++ {
+			pairs = append(pairs, string(runes[i:i+2]))
+		}
+	}
+	return pairs
+}
+
+// validMatchConfidence checks the confidence a fuzzy match needs to be applied, 0 for the default
+func validMatchConfidence(confidence float64) (float64, error) {
+	if confidence == 0 {
+		return defaultMatchConfidence, nil
+	}
+	if confidence < minMatchConfidence || confidence > 1 {
+		return 0, fmt.Errorf("must be between %v and 1: %v", minMatchConfidence, confidence)
+	}
+	return confidence, nil
+}
@@ -6,6 +6,8 @@ import (
 	"errors"
 	"fmt"
 	"image"
+	"slices"
+	"sort"
 	"strings"
 	"time"
 
@@ -57,50 +59,131 @@ func decodeBase64Image(base64Image string) ([]byte, string, error) {
 	return imageData, format, nil
 }
 
-func makePdf(reportPeriod string, companyName string, provider string, details PaymentTotals,
-	adjustments []Adjustments, companyDetails Address, providerAddr Address,
-	imageData []byte, logoType string) ([]byte, error) {
-	pdf := gofpdf.New("P", "mm", "A4", "")
-	pdf.AddPage()
-	pdf.SetMargins(10, 10, 30)
+// invoiceSettings are the company settings that apply to every invoice of a file
+type invoiceSettings struct {
+	rounding RoundingPolicy
+	tax      TaxConfig
+	layout   invoiceLayout // of the company's invoice template
+	created  time.Time     // the creation date of the PDF, now if zero
+}
+
+// invoicePdf is the PDF of an invoice, drawn with the fonts and colours of the layout
+type invoicePdf struct {
+	*gofpdf.Fpdf
+	layout    invoiceLayout
+	translate func(string) string // the text for the font, see addFonts
+	fallback  bool                // the fallback font is added, see setFont
+}
+
+// newInvoicePdf starts an invoice with the lines of the footer and "Page X of Y" at the bottom of every page
+func newInvoicePdf(layout invoiceLayout, footer []string) *invoicePdf {
+	pdf := &invoicePdf{Fpdf: gofpdf.New("P", "mm", "A4", ""), layout: layout}
+	pdf.AliasNbPages("{nb}")
+	pdf.SetCatalogSort(true) // fonts and images in the same order every time
+	pdf.addFonts()
+	pdf.SetFooterFunc(func() {
+		font := layout.font(Font{"Arial", "I", 8})
+		pdf.SetTextColor(layout.text.r, layout.text.g, layout.text.b)
+		for i, line := range footer {
+			pdf.SetY(-15 - float64(4*(len(footer)-1-i)))
+			pdf.CellFormat(0, 10, pdf.setFont(font, line), "", 0, "C", false, 0, "")
+		}
+		pdf.SetFont(font.face, font.style, font.size)
+		pdf.SetY(-15)
+		pdf.CellFormat(0, 10, fmt.Sprintf("Page %d of {nb}", pdf.PageNo()), "", 0, "R", false, 0, "")
+	})
+	pdf.SetTextColor(layout.text.r, layout.text.g, layout.text.b)
+	pdf.SetDrawColor(layout.line.r, layout.line.g, layout.line.b)
+	return pdf
+}
 
-	pdf.SetTitle("TAX INVOICE", false)
-	pdf.SetFont("Arial", "B", 16)
-	pdf.Text(10, 20, "TAX INVOICE")
-	if len(imageData) > 0 && strings.TrimSpace(logoType) != "" {
-		imageReader := bytes.NewReader(imageData)
-		pdf.RegisterImageOptionsReader("logo", gofpdf.ImageOptions{ImageType: logoType}, imageReader)
-		pdf.ImageOptions("logo", 150, 20, 35, 35, false, gofpdf.ImageOptions{ImageType: logoType, ReadDpi: true}, 0, "")
-	}
-	pdf.SetXY(10, 29)
-	addAddress(pdf, companyName, companyDetails)
-	pdf.Ln(10)
-	addAddressDate(pdf, providerAddr, time.Now().Format("02-01-06"))
-	pdf.Ln(10)
-	addInvoiceDetails(pdf, provider, providerAddr.Email, reportPeriod, "JG20240505")
-	pdf.Ln(10)
-	addTotal(pdf, details.ServiceCutTotal, details.AdjustmentTotal)
-	pdf.Ln(10)
-	addAdjustments(pdf, adjustments, details.AdjustmentTotal)
-	pdf.Ln(10)
-	addPaymentSummary(pdf, details.PaymentTotalWithGST, details.PaymentTotalNoGST)
+// heading writes a page title at the position
+func (pdf *invoicePdf) heading(x float64, y float64, text string) {
+	font := pdf.layout.font(Font{"Arial", "B", 16})
+	pdf.SetTextColor(pdf.layout.accent.r, pdf.layout.accent.g, pdf.layout.accent.b)
+	pdf.Text(x, y, pdf.setFont(font, text))
+	pdf.SetTextColor(pdf.layout.text.r, pdf.layout.text.g, pdf.layout.text.b)
+}
 
+// makePdf creates the invoice of a provider. With a location the invoice only covers that location,
+// without one a provider working at more than one location gets a location breakdown page.
+// The sections of the first page and the pages after it are those of the layout, in its order.
+func makePdf(reportPeriod ReportPeriod, companyName string, provider string, location string, details PaymentTotals,
+	companyDetails Address, providerAddr Address,
+	imageData []byte, logoType string, settings invoiceSettings) ([]byte, error) {
+	layout := settings.layout
+	if layout.face == "" {
+		layout, _ = InvoiceTemplate{}.layout() // the standard layout is valid
+	}
+	pdf := newInvoicePdf(layout, layout.footerLines(settings.rounding))
+	if !settings.created.IsZero() {
+		pdf.SetCreationDate(settings.created)
+		pdf.SetModificationDate(settings.created)
+	}
 	pdf.AddPage()
 	pdf.SetMargins(10, 10, 30)
-	pdf.SetFont("Arial", "B", 16)
-	pdf.Text(10, 20, "Service Fee Calculations")
-	pdf.SetXY(10, 29)
-	addServiceFeeCalculation(pdf, details)
-	pdf.Ln(3)
-	addTotalCalc(pdf, details)
 
-	pdf.AddPage()
-	pdf.SetMargins(20, 10, 30)
-	//drawGrid(pdf)
-	pdf.SetFont("Arial", "B", 16)
-	pdf.Text(20, 20, "Service Fee Breakdown")
-	pdf.SetXY(20, 29)
-	addServiceFeeBreakdown(pdf, details.ServiceCodeSplit)
+	title := settings.tax.title()
+	if details.Document == documentCreditNote {
+		title = "CREDIT NOTE"
+	}
+	pdf.SetTitle(title, false)
+	for _, section := range layout.sections {
+		switch section {
+		case sectionHeader:
+			pdf.heading(10, 20, title)
+			if len(imageData) > 0 && strings.TrimSpace(logoType) != "" {
+				imageReader := bytes.NewReader(imageData)
+				pdf.RegisterImageOptionsReader("logo", gofpdf.ImageOptions{ImageType: logoType}, imageReader)
+				pdf.ImageOptions("logo", layout.logo.X, layout.logo.Y, layout.logo.Width, layout.logo.Height, false,
+					gofpdf.ImageOptions{ImageType: logoType, ReadDpi: true}, 0, "")
+			}
+			pdf.SetXY(10, 29)
+			continue
+		case sectionFrom:
+			addAddress(pdf, companyName, companyDetails)
+		case sectionTo:
+			addAddressDate(pdf, providerAddr, reportPeriod.invoiceDate(settings.created).Format("02-01-06"))
+		case sectionDetails:
+			addInvoiceDetails(pdf, provider, location, providerAddr.Email, reportPeriod.String(), details.InvoiceNumber)
+		case sectionTotal:
+			addTotal(pdf, details, settings.tax)
+		case sectionAdjustments:
+			addAdjustments(pdf, details.Adjustments, details.AdjustmentTotal)
+		case sectionTaxStatement:
+			addPaymentSummary(pdf, details.PaymentTotalWithGST, details.PaymentTotalNoGST, details.DepositTotal)
+		}
+		pdf.Ln(10)
+	}
+
+	for _, page := range layout.pages {
+		switch page {
+		case pageCalculation:
+			pdf.AddPage()
+			pdf.SetMargins(10, 10, 30)
+			pdf.heading(10, 20, "Service Fee Calculations")
+			pdf.SetXY(10, 29)
+			addServiceFeeCalculation(pdf, details)
+			pdf.Ln(3)
+			addTotalCalc(pdf, details)
+		case pageBreakdown:
+			pdf.AddPage()
+			pdf.SetMargins(20, 10, 30)
+			//drawGrid(pdf)
+			pdf.heading(20, 20, "Service Fee Breakdown")
+			pdf.SetXY(20, 29)
+			addServiceFeeBreakdown(pdf, details.ServiceCodeSplit)
+			addContractBreakdown(pdf, details.Contracts, details.ServiceCutTotal)
+		case pageLocations:
+			if location == "" && len(details.LocationSplit) > 1 {
+				pdf.AddPage()
+				pdf.SetMargins(20, 10, 30)
+				pdf.heading(20, 20, "Location Breakdown")
+				pdf.SetXY(20, 29)
+				addLocationBreakdown(pdf, details.LocationSplit)
+			}
+		}
+	}
 
 	var buf bytes.Buffer
 	err := pdf.Output(&buf)
@@ -124,7 +207,7 @@ func makePdf(reportPeriod string, companyName string, provider string, details P
 		Rate		int    `json:"rate"`
 	}
 */
-func addServiceFeeBreakdown(pdf *gofpdf.Fpdf, serviceTotals map[string]ServiceTotals) {
+func addServiceFeeBreakdown(pdf *invoicePdf, serviceTotals map[string]ServiceTotals) {
 	columns := []float64{50, 30, 30, 50}
 	tableData := [][]TableText{
 		{blankCell,
@@ -134,28 +217,123 @@ func addServiceFeeBreakdown(pdf *gofpdf.Fpdf, serviceTotals map[string]ServiceTo
 	}
 	addTable(pdf, tableData, columns, 4)
 	tableData = [][]TableText{}
-	serviceFeeTotal := 0
-	exGstTotal := 0
-	for code, service := range serviceTotals {
-		tableData = append(tableData, []TableText{
-			{text: code},
-			{text: cents2DStr(service.ExGstFees), align: "R"},
-			{text: service.Rate, align: "R"},
-			{text: cents2DStr(service.ServiceFees), align: "R"},
-		})
-		serviceFeeTotal += service.ServiceFees
-		exGstTotal += service.ExGstFees
+	serviceFeeTotal := Money{}
+	exGstTotal := Money{}
+	for _, code := range pdf.layout.serviceCodeOrder(sortedServiceCodes(serviceTotals)) {
+		service := serviceTotals[code]
+		if len(service.RateSplit) > 1 {
+			// the rate changed during the period, one line per rate
+			for _, rate := range sortedServiceCodes(service.RateSplit) {
+				rateTotals := service.RateSplit[rate]
+				tableData = append(tableData, []TableText{
+					{text: code},
+					{text: rateTotals.ExGstFees.String(), align: "R"},
+					{text: rate, align: "R"},
+					{text: rateTotals.ServiceFees.String(), align: "R"},
+				})
+			}
+		} else {
+			tableData = append(tableData, []TableText{
+				{text: code},
+				{text: service.ExGstFees.String(), align: "R"},
+				{text: service.Rate, align: "R"},
+				{text: service.ServiceFees.String(), align: "R"},
+			})
+		}
+		serviceFeeTotal = sumAmounts(pdf, serviceFeeTotal, service.ServiceFees)
+		exGstTotal = sumAmounts(pdf, exGstTotal, service.ExGstFees)
 	}
 	addTable(pdf, tableData, columns, 5)
 
 	tableData = [][]TableText{{blankCell, blankCell, blankCell}}
 	addTable(pdf, tableData, columns, 1)
 
-	tableData = [][]TableText{{{text: "Total"}, {text: cents2DStr(serviceFeeTotal), align: "R", border: "T"},
-		blankCell, {text: cents2DStr(exGstTotal), align: "R", border: "T"}}}
+	tableData = [][]TableText{{{text: "Total"}, {text: exGstTotal.String(), align: "R", border: "T"},
+		blankCell, {text: serviceFeeTotal.String(), align: "R", border: "T"}}}
 	addTable(pdf, tableData, columns, 7)
 }
 
+// addLocationBreakdown lists the payments and service fees per location, sorted by location
+func addLocationBreakdown(pdf *invoicePdf, locationTotals map[string]PaymentTotals) {
+	columns := []float64{70, 40, 40}
+	tableData := [][]TableText{
+		{blankCell,
+			{text: "Payments", align: "R", font: Arial12B},
+			{text: "Service Fees ex GST", align: "R", font: Arial12B}},
+	}
+	addTable(pdf, tableData, columns, 4)
+	tableData = [][]TableText{}
+	paymentTotal := Money{}
+	serviceFeeTotal := Money{}
+	for _, location := range sortedLocations(locationTotals) {
+		totals := locationTotals[location]
+		name := location
+		if name == "" {
+			name = "No location"
+		}
+		payments := sumAmounts(pdf, totals.PaymentTotalWithGST, totals.PaymentTotalNoGST)
+		tableData = append(tableData, []TableText{
+			{text: name},
+			{text: payments.String(), align: "R"},
+			{text: totals.ServiceCutTotal.String(), align: "R"},
+		})
+		paymentTotal = sumAmounts(pdf, paymentTotal, payments)
+		serviceFeeTotal = sumAmounts(pdf, serviceFeeTotal, totals.ServiceCutTotal)
+	}
+	tableData = append(tableData, []TableText{{text: "Total"},
+		{text: paymentTotal.String(), align: "R", border: "T"},
+		{text: serviceFeeTotal.String(), align: "R", border: "T"}})
+	addTable(pdf, tableData, columns, 5)
+}
+
+// addContractBreakdown shows how the fee of each contract was worked out: the tiers,
+// the fees per consultation and the minimum or cap, which replace the fees of the lines
+func addContractBreakdown(pdf *invoicePdf, contracts []ContractFee, serviceFeeTotal Money) {
+	if len(contracts) == 0 {
+		return
+	}
+	columns := []float64{80, 30, 20, 30}
+	for _, contract := range contracts {
+		codes := strings.Join(contract.ServiceCodes, ", ")
+		if codes == "" {
+			codes = "no services"
+		}
+		lineFees := "Fees by line"
+		if len(contract.Tiers) > 0 {
+			lineFees = "Fees by line, replaced by the tiers"
+		}
+		pdf.Ln(5)
+		addTable(pdf, [][]TableText{{{text: "Contract: " + codes, font: Arial12B}}}, columns, 7)
+		tableData := [][]TableText{{{text: lineFees}, {text: contract.Base.String(), align: "R"},
+			blankCell, {text: contract.LineFees.String(), align: "R"}}}
+		for _, tier := range contract.Tiers {
+			text := "Payments above " + tier.From.String()
+			if !tier.UpTo.IsZero() {
+				text = fmt.Sprintf("Payments %v to %v", tier.From.String(), tier.UpTo.String())
+			}
+			tableData = append(tableData, []TableText{{text: text}, {text: tier.Base.String(), align: "R"},
+				{text: tier.Percentage, align: "R"}, {text: tier.Fee.String(), align: "R"}})
+		}
+		if !contract.ConsultFees.IsZero() {
+			tableData = append(tableData, []TableText{{text: fmt.Sprintf("%v consultations", contract.Consults)},
+				blankCell, blankCell, {text: contract.ConsultFees.String(), align: "R"}})
+		}
+		if contract.Limit.Sign() > 0 {
+			tableData = append(tableData, []TableText{{text: "Minimum fee for the period"}, blankCell, blankCell,
+				{text: contract.Limit.String(), align: "R"}})
+		} else if contract.Limit.Sign() < 0 {
+			tableData = append(tableData, []TableText{{text: "Maximum fee for the period"}, blankCell, blankCell,
+				{text: contract.Limit.String(), align: "R"}})
+		}
+		tableData = append(tableData, []TableText{{text: "Contract fee"}, blankCell, blankCell,
+			{text: contract.Fee.String(), align: "R", border: "T"}})
+		addTable(pdf, tableData, columns, 5)
+	}
+	pdf.Ln(3)
+	addTable(pdf, [][]TableText{{{text: "Service Fee total", font: Arial12B}, blankCell, blankCell,
+		{text: serviceFeeTotal.String(), align: "R", border: "T"}}}, columns, 7)
+}
+
 /*
 Patient    string     `json:"patient"`
 InvoiceNo  string     `json:"invoiceNo"`
@@ -165,55 +343,174 @@ Payment    string     `json:"payment"`
 GST        string     `json:"gst"`
 ServiceFee string     `json:"serviceFee"`
 */
-func addServiceFeeCalculation(pdf *gofpdf.Fpdf, details PaymentTotals) {
-	columns := []float64{25, 30, 17, 30, 30, 17, 10, 30}
-	tableData := [][]TableText{
-		{
-			TableText{text: "Date", font: Arial12B},
-			TableText{text: "Patient", font: Arial12B},
-			TableText{text: "ItemNo", font: Arial12B},
-			TableText{text: "Payment", align: "R", font: Arial12B},
-			TableText{text: "with GST", align: "R", font: Arial12B},
-			TableText{text: "Code", align: "R", font: Arial12B},
-			TableText{text: "%", align: "R", font: Arial12B},
-			TableText{text: "Service Fee", align: "R", font: Arial12B}},
+func addServiceFeeCalculation(pdf *invoicePdf, details PaymentTotals) {
+	columns := pdf.layout.columns
+	header := []TableText{}
+	for _, column := range columns {
+		header = append(header, TableText{text: column.Title, align: columnAlign(column.Field), font: Arial12B})
 	}
-	addTable(pdf, tableData, columns, 7)
-	tableData = [][]TableText{}
-	for _, payments := range details.PaymentDetails {
-		itemNo := fmt.Sprintf("%.8s", payments.ItemNo)
-		name := fmt.Sprintf("%.12s", payments.Patient)
-		lineData := []TableText{{text: payments.TransDate}, {text: name}, {text: itemNo}}
-		if payments.GST == 0 {
-			lineData = append(lineData, TableText{text: payments.Payment, align: "R"}, blankCell)
+	payments := []PaymentFileResponse{}
+	reversals := []PaymentFileResponse{}
+	for _, payment := range sortedPayments(details.PaymentDetails) {
+		if isReversal(payment.Status) {
+			reversals = append(reversals, payment)
 		} else {
-			lineData = append(lineData, blankCell, TableText{text: payments.Payment, align: "R"})
+			payments = append(payments, payment)
+		}
+	}
+	addLongTable(pdf, calculationRows(columns, payments), columnWidths(columns), 5,
+		tableBreak{header: [][]TableText{header}, columns: columns, running: runningTotals(pdf, payments)})
+	if len(reversals) == 0 {
+		return
+	}
+	//
+	// Reversals get their own block, so it is clear where the negative lines come from
+	//
+	pdf.Ln(3)
+	addLongTable(pdf, calculationRows(columns, reversals), columnWidths(columns), 5,
+		tableBreak{header: [][]TableText{{TableText{text: "Reversed", font: Arial12B}}, header}, columns: columns,
+			running: runningTotals(pdf, reversals)})
+	reversedFees := Money{}
+	for _, payment := range reversals {
+		reversedFees = sumAmounts(pdf, reversedFees, payment.ServiceFee)
+	}
+	addTable(pdf, [][]TableText{totalRow(columns, TableText{text: "Reversed total"}, map[string]Money{columnServiceFee: reversedFees},
+		Font{})}, columnWidths(columns), 5)
+}
+
+// calculationRows formats payments as rows of the service fee calculation table
+func calculationRows(columns []TemplateColumn, payments []PaymentFileResponse) [][]TableText {
+	tableData := [][]TableText{}
+	for _, payment := range payments {
+		lineData := []TableText{}
+		for _, column := range columns {
+			lineData = append(lineData, TableText{text: calculationText(column.Field, payment), align: columnAlign(column.Field)})
 		}
-		lineData = append(lineData, TableText{text: payments.Service.Code, align: "R"},
-			TableText{text: payments.Service.Percentage, align: "R"},
-			TableText{text: payments.ServiceFee, align: "R"})
 		tableData = append(tableData, lineData)
 	}
-	addTable(pdf, tableData, columns, 5)
+	return tableData
 }
 
-func addTotalCalc(pdf *gofpdf.Fpdf, details PaymentTotals) {
-	columns := []float64{25, 30, 17, 30, 30, 17, 10, 30}
+// sortedPayments returns the payments by date and patient, payments on the same day to the same patient
+// stay in the order of the file
+func sortedPayments(payments []PaymentFileResponse) []PaymentFileResponse {
+	sorted := slices.Clone(payments)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, errA := parseDate(sorted[i].TransDate)
+		b, errB := parseDate(sorted[j].TransDate)
+		if errA == nil && errB == nil && !a.Equal(b) {
+			return a.Before(b)
+		}
+		if (errA == nil) != (errB == nil) {
+			return errA == nil // payments without a valid date last
+		}
+		return sorted[i].Patient < sorted[j].Patient
+	})
+	return sorted
+}
 
-	tableData := [][]TableText{
-		{TableText{text: "Totals:", font: Arial12B},
-			blankCell,
-			blankCell,
-			TableText{text: cents2DStr(details.PaymentTotalNoGST), align: "R", font: Arial12B, border: "T"},
-			TableText{text: cents2DStr(details.PaymentTotalWithGST), align: "R", font: Arial12B, border: "T"},
-			blankCell,
-			blankCell,
-			TableText{text: cents2DStr(details.ServiceCutTotal), align: "R", font: Arial12B, border: "T"}},
+// runningTotals are the totals of the payment, GST and service fee columns up to and including each payment
+func runningTotals(pdf *invoicePdf, payments []PaymentFileResponse) []map[string]Money {
+	running := []map[string]Money{}
+	totals := map[string]Money{}
+	for _, payment := range payments {
+		paymentColumn := columnPayment
+		if !payment.GST.IsZero() {
+			paymentColumn = columnPaymentWithGST
+		}
+		next := map[string]Money{
+			columnPayment:        totals[columnPayment],
+			columnPaymentWithGST: totals[columnPaymentWithGST],
+			columnGST:            sumAmounts(pdf, totals[columnGST], payment.GST),
+			columnServiceFee:     sumAmounts(pdf, totals[columnServiceFee], payment.ServiceFee),
+		}
+		next[paymentColumn] = sumAmounts(pdf, totals[paymentColumn], payment.Payment)
+		running = append(running, next)
+		totals = next
 	}
-	addTable(pdf, tableData, columns, 7)
+	return running
+}
+
+// calculationText is the text of a payment in a column of the service fee calculation
+func calculationText(field string, payment PaymentFileResponse) string {
+	switch field {
+	case columnDate:
+		return payment.TransDate
+	case columnPatient:
+		return truncate(payment.Patient, 12)
+	case columnItemNo:
+		return truncate(payment.ItemNo, 8)
+	case columnInvoiceNo:
+		return payment.InvoiceNo
+	case columnLocation:
+		return payment.Location
+	case columnAccountType:
+		return payment.AccountType
+	case columnPaymentMethod:
+		return payment.PaymentMethod
+	case columnPayment:
+		if payment.GST.IsZero() {
+			return payment.Payment.String()
+		}
+	case columnPaymentWithGST:
+		if !payment.GST.IsZero() {
+			return payment.Payment.String()
+		}
+	case columnGST:
+		return payment.GST.String()
+	case columnCode:
+		return payment.Service.Code
+	case columnPercentage:
+		return payment.Service.Percentage
+	case columnServiceFee:
+		return payment.ServiceFee.String()
+	}
+	return ""
+}
+
+// totalRow puts the label in the first column and the totals under their columns
+func totalRow(columns []TemplateColumn, label TableText, totals map[string]Money, font Font) []TableText {
+	row := []TableText{}
+	for i, column := range columns {
+		cell := blankCell
+		if total, ok := totals[column.Field]; ok {
+			cell = TableText{text: total.String(), align: "R", font: font, border: "T"}
+		} else if i == 0 {
+			cell = label
+		}
+		row = append(row, cell)
+	}
+	return row
+}
+
+func columnAlign(field string) string {
+	if columnTitles[field].right {
+		return "R"
+	}
+	return ""
+}
+
+func columnWidths(columns []TemplateColumn) []float64 {
+	widths := []float64{}
+	for _, column := range columns {
+		widths = append(widths, column.Width)
+	}
+	return widths
 }
 
-func addAddress(pdf *gofpdf.Fpdf, companyName string, address Address) {
+func addTotalCalc(pdf *invoicePdf, details PaymentTotals) {
+	columns := pdf.layout.columns
+	totals := map[string]Money{
+		columnPayment:        details.PaymentTotalNoGST,
+		columnPaymentWithGST: details.PaymentTotalWithGST,
+		columnGST:            details.GSTTotal,
+		columnServiceFee:     details.ServiceCutTotal,
+	}
+	addTable(pdf, [][]TableText{totalRow(columns, TableText{text: "Totals:", font: Arial12B}, totals, Arial12B)},
+		columnWidths(columns), 7)
+}
+
+func addAddress(pdf *invoicePdf, companyName string, address Address) {
 	if companyName == "" {
 		companyName = address.Name
 	}
@@ -225,7 +522,7 @@ func addAddress(pdf *gofpdf.Fpdf, companyName string, address Address) {
 	}
 	addTable(pdf, tableData, []float64{40, 150}, 5)
 }
-func addAddressDate(pdf *gofpdf.Fpdf, address Address, date string) {
+func addAddressDate(pdf *invoicePdf, address Address, date string) {
 	toName := address.Name
 	if len(strings.TrimSpace(address.Entity)) > 0 {
 		toName = strings.TrimSpace(address.Entity)
@@ -238,83 +535,200 @@ func addAddressDate(pdf *gofpdf.Fpdf, address Address, date string) {
 	}
 	addTable(pdf, tableData, []float64{40, 150, 0}, 5)
 }
-func addInvoiceDetails(pdf *gofpdf.Fpdf, prac string, email string, invoicePeriod string, invoiceNo string) {
+func addInvoiceDetails(pdf *invoicePdf, prac string, location string, email string, invoicePeriod string, invoiceNo string) {
 	tableData := [][]TableText{
 		{TableText{text: "Practitioner:", font: Arial12B}, TableText{text: prac}, TableText{text: "Invoice Number", font: Arial12B, align: "R"}},
 		{TableText{text: "Period:", font: Arial12B}, TableText{text: invoicePeriod}, TableText{text: invoiceNo, align: "R"}},
-		{TableText{text: "Email", font: Arial12B}, TableText{text: email}, blankCell},
 	}
+	if location != "" {
+		tableData = append(tableData, []TableText{{text: "Location:", font: Arial12B}, {text: location}, blankCell})
+	}
+	tableData = append(tableData, []TableText{{text: "Email", font: Arial12B}, {text: email}, blankCell})
 	addTable(pdf, tableData, []float64{40, 150, 0}, 5)
 }
 
-func addTotal(pdf *gofpdf.Fpdf, serviceFeeTotal int, adjustments int) {
+func addTotal(pdf *invoicePdf, details PaymentTotals, tax TaxConfig) {
+	serviceFeeTotal := details.ServiceCutTotal
+	adjustments := details.AdjustmentTotal
 	tableData := [][]TableText{
-		{blankCell, TableText{text: "Service Fee (see calculation sheet)"}, TableText{text: cents2DStr(serviceFeeTotal), align: "R"}}}
-	if adjustments != 0 {
+		{blankCell, TableText{text: "Service Fee (see calculation sheet)"}, TableText{text: serviceFeeTotal.String(), align: "R"}}}
+	subtotal := sumAmounts(pdf, serviceFeeTotal, adjustments)
+	if !adjustments.IsZero() {
 		tableData = append(tableData, []TableText{blankCell, {text: "Adjustments"},
-			{text: cents2DStr(adjustments), align: "R"},
+			{text: adjustments.String(), align: "R"},
 		})
 	}
 	tableData = append(tableData, []TableText{blankCell, {text: "Subtotal"},
-		{text: cents2DStr(serviceFeeTotal + adjustments), align: "R", border: "T"},
+		{text: subtotal.String(), align: "R", border: "T"},
 	})
 
-	gst := calcGST(serviceFeeTotal, adjustments)
-	tableData = append(tableData, []TableText{blankCell, {text: "GST"},
-		{text: cents2DStr(gst), align: "R", border: "B"},
-	})
+	gst := details.InvoiceGST
+	if tax.NotRegistered {
+		tableData = append(tableData, []TableText{blankCell, {text: "No GST, the supplier is not registered for GST"}, blankCell})
+	} else {
+		if !details.GSTFreeTotal.IsZero() {
+			tableData = append(tableData, []TableText{blankCell, {text: "of which GST-free"},
+				{text: details.GSTFreeTotal.String(), align: "R"}})
+		}
+		if !details.InputTaxedTotal.IsZero() {
+			tableData = append(tableData, []TableText{blankCell, {text: "of which input taxed"},
+				{text: details.InputTaxedTotal.String(), align: "R"}})
+		}
+		tableData = append(tableData, []TableText{blankCell, {text: "GST " + tax.rateText()},
+			{text: gst.String(), align: "R", border: "B"},
+		})
+	}
 
 	tableData = append(tableData, []TableText{blankCell, {text: "Total"},
-		{text: cents2DStr(serviceFeeTotal + adjustments + gst), align: "R", border: "B"}})
+		{text: sumAmounts(pdf, subtotal, gst).String(), align: "R", border: "B"}})
+	if !details.BroughtForward.IsZero() {
+		tableData = append(tableData, []TableText{blankCell, {text: "Balance brought forward"},
+			{text: details.BroughtForward.String(), align: "R"}})
+	}
+	if details.Document == documentCreditNote {
+		tableData = append(tableData, []TableText{blankCell, {text: "Amount credited", font: Arial12B},
+			{text: details.AmountDue.Neg().String(), align: "R", font: Arial12B, border: "B"}})
+	} else if !details.BroughtForward.IsZero() {
+		tableData = append(tableData, []TableText{blankCell, {text: "Amount due", font: Arial12B},
+			{text: details.AmountDue.String(), align: "R", font: Arial12B, border: "B"}})
+	}
 	addTable(pdf, tableData, []float64{40, 110, 0}, 5)
 }
 
-func addAdjustments(pdf *gofpdf.Fpdf, adjustments []Adjustments, total int) {
+// addAdjustments lists the adjustments ex GST, with how they were worked out
+func addAdjustments(pdf *invoicePdf, adjustments []AdjustmentLine, total Money) {
 
 	if len(adjustments) == 0 {
 		return
 	}
 	tableData := [][]TableText{
 		{TableText{text: "Adjustments"}, blankCell, blankCell}}
-	for _, payments := range adjustments {
-		amount := cents2DStr(payments.Amount)
+	for _, adjustment := range adjustments {
 		tableData = append(tableData, []TableText{
 			blankCell,
-			{text: payments.Description},
-			{text: amount, align: "R"},
+			{text: adjustmentText(adjustment)},
+			{text: adjustment.Amount.String(), align: "R"},
 		})
 	}
 	tableData = append(tableData, []TableText{blankCell, {text: "Total"},
-		{text: cents2DStr(total), align: "R", border: "T"}})
+		{text: total.String(), align: "R", border: "T"}})
 	addTable(pdf, tableData, []float64{40, 110, 0}, 5)
 }
 
-func addPaymentSummary(pdf *gofpdf.Fpdf, paymentTotalWithGST int, paymentTotalNoGST int) {
+// adjustmentText is the description of the adjustment with its type and GST treatment,
+// e.g. "Room rent (3 x monthly, 330.00 incl. GST)"
+func adjustmentText(adjustment AdjustmentLine) string {
+	notes := []string{}
+	if adjustment.Recurrence != recurOnce {
+		notes = append(notes, fmt.Sprintf("%v x %v", adjustment.Times, adjustment.Recurrence))
+	}
+	switch adjustment.Type {
+	case adjustCredit:
+		notes = append(notes, "credit")
+	case adjustPercentage:
+		notes = append(notes, fmt.Sprintf("%v%% of the service fees", strings.TrimSuffix(adjustment.Percentage, "%")))
+	}
+	switch {
+	case adjustment.Tax == taxGSTFree:
+		notes = append(notes, "GST-free")
+	case adjustment.Tax == taxInputTaxed:
+		notes = append(notes, "input taxed")
+	case !adjustment.GST.IsZero():
+		withGST, _ := adjustment.Amount.Add(adjustment.GST) // the amount as given, in range
+		notes = append(notes, withGST.String()+" incl. GST")
+	}
+	if len(notes) == 0 {
+		return adjustment.Description
+	}
+	return fmt.Sprintf("%v (%v)", adjustment.Description, strings.Join(notes, ", "))
+}
+
+func addPaymentSummary(pdf *invoicePdf, paymentTotalWithGST Money, paymentTotalNoGST Money, depositTotal Money) {
 	tableData := [][]TableText{
 		{TableText{text: "Tax Statement"}, blankCell, blankCell},
-		{blankCell, TableText{text: "Services without GST"}, TableText{text: cents2DStr(paymentTotalNoGST), align: "R"}},
-		{blankCell, TableText{text: "Services with GST"}, TableText{text: cents2DStr(paymentTotalWithGST), align: "R"}},
-		{blankCell, TableText{text: "Total"}, TableText{text: cents2DStr(paymentTotalWithGST + paymentTotalNoGST), align: "R", border: "T"}}}
+		{blankCell, TableText{text: "Services without GST"}, TableText{text: paymentTotalNoGST.String(), align: "R"}},
+		{blankCell, TableText{text: "Services with GST"}, TableText{text: paymentTotalWithGST.String(), align: "R"}},
+		{blankCell, TableText{text: "Total"}, TableText{text: sumAmounts(pdf, paymentTotalWithGST, paymentTotalNoGST).String(), align: "R", border: "T"}}}
+	if !depositTotal.IsZero() {
+		tableData = append(tableData, []TableText{blankCell, {text: "Deposits held (no service fee)"},
+			{text: depositTotal.String(), align: "R"}})
+	}
 	addTable(pdf, tableData, []float64{40, 110, 0}, 5)
 }
 
-func addTable(pdf *gofpdf.Fpdf, data [][]TableText, colWidths []float64, height float64) {
-	for _, row := range data {
-		for i, value := range row {
-			//
-			// set default font if there is some text
-			//
-			var font = value.font
-			if font.face == "" || value.text != "" {
-				font = Arial12
+// sumAmounts adds up the amounts of a table, an amount out of range fails the invoice
+func sumAmounts(pdf *invoicePdf, amounts ...Money) Money {
+	total, err := sumMoney(amounts...)
+	if err != nil {
+		pdf.SetError(err)
+	}
+	return total
+}
+
+// tableHeaderHeight is the height of the header rows of a table
+const tableHeaderHeight = 7
+
+// tableBreak is what a table repeats when it runs over the end of a page
+type tableBreak struct {
+	header  [][]TableText      // rows at the top of the table, repeated at the top of every page it continues on
+	columns []TemplateColumn   // of the running subtotals
+	running []map[string]Money // the totals per column up to and including each row, no subtotals if nil
+}
+
+// addTable writes the rows, a row which does not fit on the page goes on the next page
+func addTable(pdf *invoicePdf, data [][]TableText, colWidths []float64, height float64) {
+	addLongTable(pdf, data, colWidths, height, tableBreak{})
+}
+
+// addLongTable writes the rows after the header. When a row does not fit on the page, the page ends with
+// the subtotal so far and the next page starts with the header and the subtotal brought over.
+func addLongTable(pdf *invoicePdf, data [][]TableText, colWidths []float64, height float64, brk tableBreak) {
+	_, pageHeight := pdf.GetPageSize()
+	_, bottomMargin := pdf.GetAutoPageBreak()
+	subtotalHeight := 0.0
+	if brk.running != nil {
+		subtotalHeight = height
+	}
+	// the header is not left at the bottom of a page without a row under it
+	headerHeight := float64(len(brk.header)) * tableHeaderHeight
+	if len(data) > 0 && pdf.GetY()+headerHeight+height+subtotalHeight > pageHeight-bottomMargin {
+		pdf.AddPage()
+	}
+	for _, row := range brk.header {
+		addRow(pdf, row, colWidths, tableHeaderHeight)
+	}
+	for i, row := range data {
+		if i > 0 && pdf.GetY()+height+subtotalHeight > pageHeight-bottomMargin {
+			if brk.running != nil {
+				addRow(pdf, totalRow(brk.columns, TableText{text: "Subtotal"}, brk.running[i-1], Font{}), colWidths, height)
 			}
-			if font.face != "" {
-				pdf.SetFont(value.font.face, value.font.style, value.font.size)
+			pdf.AddPage()
+			for _, row := range brk.header {
+				addRow(pdf, row, colWidths, tableHeaderHeight)
 			}
-			pdf.CellFormat(colWidths[i], height, value.text, value.border, 0, value.align, false, 0, "")
+			if brk.running != nil {
+				addRow(pdf, totalRow(brk.columns, TableText{text: "Brought over"}, brk.running[i-1], Font{}), colWidths, height)
+			}
+		}
+		addRow(pdf, row, colWidths, height)
+	}
+}
+
+func addRow(pdf *invoicePdf, row []TableText, colWidths []float64, height float64) {
+	for i, value := range row {
+		//
+		// the font of the layout, headings in bold are in the accent colour
+		//
+		font := pdf.layout.font(value.font)
+		color := pdf.layout.text
+		if strings.Contains(font.style, "B") {
+			color = pdf.layout.accent
 		}
-		pdf.Ln(-1)
+		pdf.SetTextColor(color.r, color.g, color.b)
+		text := pdf.setFont(font, value.text)
+		pdf.CellFormat(colWidths[i], height, text, value.border, 0, value.align, false, 0, "")
 	}
+	pdf.Ln(-1)
 }
 
 func drawGrid(pdf *gofpdf.Fpdf) {
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// the notes of a location in square brackets, like "[no bulk-billing]"
+var locationNotes = regexp.MustCompile(`\[[^\]]*\]`)
+
+// createLocationPracMap keys the providers of each location by the standardised provider name
+func createLocationPracMap(locationPracMap map[string]map[string]map[string]string) map[string]map[string]map[string]string {
+	result := make(map[string]map[string]map[string]string)
+	for location, pracMap := range locationPracMap {
+		result[location] = createProviderMap(pracMap)
+	}
+	return result
+}
+
+// locationPercentage returns the percentage of the provider's service code at the location.
+// Locations match by name ignoring case, spaces and the notes in square brackets, so "Vermont Medical Clinic"
+// covers "Vermont Medical Clinic [no bulk-billing]" but not "Vermont South". A location given with its
+// notes wins over one without.
+func locationPercentage(locationPracMap map[string]map[string]map[string]string, location string, provider string,
+	serviceCode string) (string, bool) {
+	percentage, found := "", false
+	for name, providers := range locationPracMap {
+		exact := standardString(name) == standardString(location)
+		if !exact && standardString(name) != locationName(location) {
+			continue
+		}
+		if perc, ok := providers[standardString(provider)][serviceCode]; ok {
+			if exact {
+				return perc, true
+			}
+			percentage, found = perc, true
+		}
+	}
+	return percentage, found
+}
+
+// locationName is the standardised name of the location without its notes
+func locationName(location string) string {
+	return standardString(locationNotes.ReplaceAllString(location, " "))
+}
+
+// locationTotals returns the totals of the provider at a location, creating them if this is the first line
+func (p *PaymentTotals) locationTotals(location string) PaymentTotals {
+	if p.LocationSplit == nil {
+		p.LocationSplit = make(map[string]PaymentTotals)
+	}
+	totals, exists := p.LocationSplit[location]
+	if !exists {
+		totals = PaymentTotals{Provider: p.Provider, Location: location}
+		totals.ServiceCodeSplit = make(map[string]ServiceTotals)
+	}
+	return totals
+}
+
+// sortedLocations returns the locations of the split in alphabetical order
+func sortedLocations(locationTotals map[string]PaymentTotals) []string {
+	locations := make([]string, 0, len(locationTotals))
+	for location := range locationTotals {
+		locations = append(locations, location)
+	}
+	sort.Strings(locations)
+	return locations
+}
+
+// fileNameReplacer keeps the names in the package flat, a "/" or "\\" would be a folder
+var fileNameReplacer = strings.NewReplacer(" ", "_", "/", "-", "\\", "-")
+
+// invoiceFileName is the name of a provider's invoice in the invoice package
+func invoiceFileName(provider string, location string, invoiceNumber string, period ReportPeriod) string {
+	name := fileNameReplacer.Replace(provider)
+	if location != "" {
+		name += "_" + fileNameReplacer.Replace(location)
+	}
+	name += "_Invoice"
+	if invoiceNumber != "" {
+		name += "_" + fileNameReplacer.Replace(invoiceNumber)
+	}
+	return name + period.fileSuffix() + ".pdf"
+}
+
+// hasInvoice is true if an invoice was created for the provider or any of the provider's locations
+func hasInvoice(details PaymentTotals) bool {
+	if len(details.PdfFile) > 0 {
+		return true
+	}
+	for _, location := range details.LocationSplit {
+		if len(location.PdfFile) > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+const defaultCurrency = "AUD"
+
+var (
+	ErrOverflow = errors.New("amount out of range")
+	ErrCurrency = errors.New("currency mismatch")
+)
+
+// Money is an amount in minor units (cents) of a currency. Adding and multiplying is checked,
+// an amount too large for an int64 is an error rather than a wrong total. A blank currency
+// takes the currency of the amount it is added to, so adjustments and contract amounts given
+// as plain cents can be added to the totals of the file.
+type Money struct {
+	Amount   int64  `firestore:"amount"`   // cents, negative for money going back
+	Currency string `firestore:"currency"` // ISO 4217 code, the currency of the file if blank
+}
+
+// newMoney returns the cents in the currency
+func newMoney(cents int64, currency string) Money {
+	return Money{Amount: cents, Currency: currency}
+}
+
+func (m Money) currency(o Money) (string, error) {
+	switch {
+	case m.Currency == "" || m.Currency == o.Currency:
+		return o.Currency, nil
+	case o.Currency == "":
+		return m.Currency, nil
+	}
+	return "", fmt.Errorf("%w: %v and %v", ErrCurrency, m.Currency, o.Currency)
+}
+
+func (m Money) Add(o Money) (Money, error) {
+	currency, err := m.currency(o)
+	if err != nil {
+		return m, err
+	}
+	sum := m.Amount + o.Amount
+	// math.MinInt64 is out of range too, so that every amount can be negated
+	if (o.Amount > 0 && sum < m.Amount) || (o.Amount < 0 && sum > m.Amount) || sum == math.MinInt64 {
+		return m, fmt.Errorf("%w: %v plus %v", ErrOverflow, m, o)
+	}
+	return Money{Amount: sum, Currency: currency}, nil
+}
+
+func (m Money) Sub(o Money) (Money, error) {
+	return m.Add(o.Neg())
+}
+
+func (m Money) Neg() Money {
+	return Money{Amount: -m.Amount, Currency: m.Currency}
+}
+
+// Mul returns the amount n times, e.g. a fee per consultation
+func (m Money) Mul(n int64) (Money, error) {
+	product := new(big.Int).Mul(big.NewInt(m.Amount), big.NewInt(n))
+	if !product.IsInt64() || product.Int64() == math.MinInt64 {
+		return m, fmt.Errorf("%w: %v times %v", ErrOverflow, m, n)
+	}
+	return Money{Amount: product.Int64(), Currency: m.Currency}, nil
+}
+
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+func (m Money) Sign() int {
+	switch {
+	case m.Amount < 0:
+		return -1
+	case m.Amount > 0:
+		return 1
+	}
+	return 0
+}
+
+// rat returns the amount in cents, for the exact fee calculations
+func (m Money) rat() *big.Rat {
+	return new(big.Rat).SetInt64(m.Amount)
+}
+
+// String formats the amount with thousand separators and brackets for negative amounts,
+// e.g. "1,234.56" and "(224.50)". The currency is not shown.
+func (m Money) String() string {
+	// uint64 so that the largest negative amount does not overflow
+	abs := uint64(m.Amount)
+	if m.Amount < 0 {
+		abs = -abs
+	}
+	digits := strconv.FormatUint(abs/100, 10)
+	var b strings.Builder
+	for i, digit := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(digit)
+	}
+	text := fmt.Sprintf("%v.%02d", b.String(), abs%100)
+	if m.Amount < 0 {
+		return "(" + text + ")"
+	}
+	return text
+}
+
+type moneyJSON struct {
+	Amount    int64  `json:"amount"` // cents
+	Currency  string `json:"currency,omitempty"`
+	Formatted string `json:"formatted"`
+}
+
+// MarshalJSON gives the amount in cents and formatted, e.g. {"amount":123456,"currency":"AUD","formatted":"1,234.56"}
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(moneyJSON{Amount: m.Amount, Currency: m.Currency, Formatted: m.String()})
+}
+
+// UnmarshalJSON reads the object written by MarshalJSON or a plain number of cents,
+// as the adjustments and contracts have always been sent
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	if len(data) > 0 && data[0] == '{' {
+		var value moneyJSON
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+		if value.Amount == math.MinInt64 {
+			return fmt.Errorf("%w: %s", ErrOverflow, data)
+		}
+		*m = Money{Amount: value.Amount, Currency: value.Currency}
+		return nil
+	}
+	var cents int64
+	if err := json.Unmarshal(data, &cents); err != nil {
+		return fmt.Errorf("invalid amount in cents: %s", data)
+	}
+	if cents == math.MinInt64 {
+		return fmt.Errorf("%w: %s", ErrOverflow, data)
+	}
+	*m = Money{Amount: cents}
+	return nil
+}
+
+// sumMoney adds up the amounts
+func sumMoney(amounts ...Money) (Money, error) {
+	total := Money{}
+	for _, amount := range amounts {
+		var err error
+		if total, err = total.Add(amount); err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// moneySum adds amounts to totals and keeps the first error,
+// so a run of additions is checked once at the end
+type moneySum struct {
+	err error
+}
+
+func (s *moneySum) add(total *Money, amount Money) {
+	if s.err == nil {
+		*total, s.err = total.Add(amount)
+	}
+}
+
+func (s *moneySum) sub(total *Money, amount Money) {
+	s.add(total, amount.Neg())
+}
+
+// validCurrency checks the currency is a three letter code
+func validCurrency(currency string) error {
+	if len(currency) != 3 || strings.Trim(currency, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+		return fmt.Errorf("currency must be a three letter code like AUD: %v", currency)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const dateLayout = "02/01/2006"
+
+// Layouts of the Transaction Date and the report period dates, day first as in the exports
+var dateLayouts = []string{dateLayout, "2/1/2006", "02/01/2006 15:04", "2/1/2006 15:04", "02/01/2006 15:04:05", "2006-01-02"}
+
+// ReportPeriod is the period a file covers, both dates inclusive. Text is the period as found in the file.
+type ReportPeriod struct {
+	Text  string
+	Start time.Time
+	End   time.Time
+}
+
+var periodPattern = regexp.MustCompile(`^(\S+)\s*(?:-|to)\s*(\S+)$`)
+
+// parseReportPeriod reads a period like "26/02/2024 - 03/03/2024"
+func parseReportPeriod(text string) (ReportPeriod, error) {
+	period := ReportPeriod{Text: strings.TrimSpace(text)}
+	match := periodPattern.FindStringSubmatch(strings.ToLower(period.Text))
+	if match == nil {
+		return period, fmt.Errorf("report period is not two dates: %v", text)
+	}
+	start, err := parseDate(match[1])
+	if err != nil {
+		return period, fmt.Errorf("report period has an invalid start date: %w", err)
+	}
+	end, err := parseDate(match[2])
+	if err != nil {
+		return period, fmt.Errorf("report period has an invalid end date: %w", err)
+	}
+	if end.Before(start) {
+		return period, fmt.Errorf("report period ends before it starts: %v", text)
+	}
+	period.Start = start
+	period.End = end
+	return period, nil
+}
+
+// parseDate returns the day of a DD/MM/YYYY date, any time of day is dropped
+func parseDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range dateLayouts {
+		if date, err := time.Parse(layout, s); err == nil {
+			return time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("date is not DD/MM/YYYY: %v", s)
+}
+
+// isSet is false when the file had no period or it could not be read
+func (p ReportPeriod) isSet() bool {
+	return !p.Start.IsZero()
+}
+
+func (p ReportPeriod) contains(date time.Time) bool {
+	return !date.Before(p.Start) && !date.After(p.End)
+}
+
+// String is the period as printed on the invoice
+func (p ReportPeriod) String() string {
+	if !p.isSet() {
+		return p.Text
+	}
+	return p.Start.Format(dateLayout) + " - " + p.End.Format(dateLayout)
+}
+
+// invoiceDate is the end of the period. If the period is not known it is the creation date
+// of the invoices, or today if that is not given either.
+func (p ReportPeriod) invoiceDate(created time.Time) time.Time {
+	if p.isSet() {
+		return p.End
+	}
+	if !created.IsZero() {
+		return created
+	}
+	return time.Now()
+}
+
+// fileSuffix is added to the invoice file names so invoices of different periods do not clash
+func (p ReportPeriod) fileSuffix() string {
+	if !p.isSet() {
+		return ""
+	}
+	return "_" + p.Start.Format("2006-01-02") + "_" + p.End.Format("2006-01-02")
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// Rounding modes
+const (
+	roundHalfUp   = "halfUp"   // halves away from zero, 0.5 cent is 1 cent and -0.5 cent is -1 cent
+	roundBankers  = "bankers"  // halves to the even cent
+	roundTruncate = "truncate" // drops the fraction of a cent
+)
+
+// What is rounded
+const (
+	roundOnLine  = "line"  // every fee is rounded and the rounded fees are added up
+	roundOnTotal = "total" // the exact fees are added up and only the totals are rounded
+)
+
+// RoundingPolicy is how the service fees and the GST are rounded to the cent.
+// The default is half up on every line.
+type RoundingPolicy struct {
+	Mode string `json:"mode"`
+	On   string `json:"on"`
+}
+
+// withDefaults fills in the defaults and checks the values are known
+func (r RoundingPolicy) withDefaults() (RoundingPolicy, error) {
+	r.Mode = strings.TrimSpace(r.Mode)
+	r.On = strings.TrimSpace(r.On)
+	if r.Mode == "" {
+		r.Mode = roundHalfUp
+	}
+	if r.On == "" {
+		r.On = roundOnLine
+	}
+	switch r.Mode {
+	case roundHalfUp, roundBankers, roundTruncate:
+	default:
+		return r, fmt.Errorf("unknown rounding mode: %v", r.Mode)
+	}
+	if r.On != roundOnLine && r.On != roundOnTotal {
+		return r, fmt.Errorf("unknown rounding on: %v", r.On)
+	}
+	return r, nil
+}
+
+// round returns the value rounded to an integer under the mode
+func (r RoundingPolicy) round(v *big.Rat) *big.Int {
+	quo, rem := new(big.Int).QuoRem(v.Num(), v.Denom(), new(big.Int))
+	// rem has the sign of the numerator, the denominator is always positive
+	half := rem.Abs(rem).Lsh(rem, 1).Cmp(v.Denom())
+	switch {
+	case r.Mode == roundTruncate || half < 0:
+	case half > 0 || r.Mode != roundBankers || quo.Bit(0) == 1:
+		quo.Add(quo, big.NewInt(int64(v.Sign())))
+	}
+	return quo
+}
+
+// money rounds the exact amount in cents to the cent
+func (r RoundingPolicy) money(v *big.Rat, currency string) (Money, error) {
+	cents := r.round(v)
+	if !cents.IsInt64() || cents.Int64() == math.MinInt64 {
+		return Money{}, fmt.Errorf("%w: %v cents", ErrOverflow, cents)
+	}
+	return newMoney(cents.Int64(), currency), nil
+}
+
+// String describes the policy for the invoice footer
+func (r RoundingPolicy) String() string {
+	mode := map[string]string{
+		roundHalfUp:   "half up",
+		roundBankers:  "half to even (banker's rounding)",
+		roundTruncate: "down (truncated)",
+	}[r.Mode]
+	if r.On == roundOnTotal {
+		return fmt.Sprintf("Service fees are rounded %v on the totals, line fees are shown rounded to the cent.", mode)
+	}
+	return fmt.Sprintf("Service fees are rounded %v on every line.", mode)
+}
+
+// roundTotals replaces the service fee totals by the rounded sum of the exact fees
+func (p *PaymentTotals) roundTotals(rounding RoundingPolicy) error {
+	var err error
+	if p.exactFees != nil {
+		if p.ServiceCutTotal, err = rounding.money(p.exactFees, p.ServiceCutTotal.Currency); err != nil {
+			return err
+		}
+	}
+	for code, service := range p.ServiceCodeSplit {
+		if service.ServiceFees, err = rounding.money(service.exactFees, service.ServiceFees.Currency); err != nil {
+			return err
+		}
+		for rate, rateTotals := range service.RateSplit {
+			if rateTotals.ServiceFees, err = rounding.money(rateTotals.exactFees, rateTotals.ServiceFees.Currency); err != nil {
+				return err
+			}
+			service.RateSplit[rate] = rateTotals
+		}
+		p.ServiceCodeSplit[code] = service
+	}
+	for location, totals := range p.LocationSplit {
+		if err := totals.roundTotals(rounding); err != nil {
+			return err
+		}
+		p.LocationSplit[location] = totals
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RateSchedule is a CodeMap and PracMap in effect from one date to another, both inclusive
+// and blank for no limit. Each line uses the schedule of its Transaction Date, so a rate can change
+// in the middle of a period. A schedule only needs the providers, service codes and items that change,
+// everything else comes from the CodeMap and PracMap of the request.
+type RateSchedule struct {
+	EffectiveFrom string                       `json:"effectiveFrom" firestore:"effectiveFrom"` // DD/MM/YYYY
+	EffectiveTo   string                       `json:"effectiveTo" firestore:"effectiveTo"`     // DD/MM/YYYY
+	CodeMap       map[string][]string          `json:"codeMap" firestore:"codeMap"`
+	PracMap       map[string]map[string]string `json:"pracMap" firestore:"pracMap"`
+}
+
+// rateMaps are the item map and the provider map of a schedule, merged with the ones of the request
+type rateMaps struct {
+	from      time.Time
+	to        time.Time
+	items     itemMatcher
+	providers map[string]map[string]string
+}
+
+func (r RateSchedule) dates() (time.Time, time.Time, error) {
+	var from, to time.Time
+	var err error
+	if strings.TrimSpace(r.EffectiveFrom) != "" {
+		if from, err = parseDate(r.EffectiveFrom); err != nil {
+			return from, to, fmt.Errorf("invalid effective from: %w", err)
+		}
+	}
+	if strings.TrimSpace(r.EffectiveTo) != "" {
+		if to, err = parseDate(r.EffectiveTo); err != nil {
+			return from, to, fmt.Errorf("invalid effective to: %w", err)
+		}
+		if to.Before(from) {
+			return from, to, fmt.Errorf("effective to: %v is before effective from: %v", r.EffectiveTo, r.EffectiveFrom)
+		}
+	}
+	return from, to, nil
+}
+
+// createScheduleMaps merges every schedule with the maps of the request
+func createScheduleMaps(schedules []RateSchedule, itemMap map[string]string,
+	providerMap map[string]map[string]string) ([]rateMaps, error) {
+	result := []rateMaps{}
+	for i, schedule := range schedules {
+		from, to, err := schedule.dates()
+		if err != nil {
+			return nil, fmt.Errorf("rate schedule %v: %w", i+1, err)
+		}
+		maps := rateMaps{from: from, to: to, providers: map[string]map[string]string{}}
+		items := map[string]string{}
+		for item, code := range itemMap {
+			items[item] = code
+		}
+		for item, code := range createItemMap(schedule.CodeMap) {
+			items[item] = code
+		}
+		maps.items = newItemMatcher(items)
+		for provider, codes := range providerMap {
+			maps.providers[provider] = codes
+		}
+		for provider, codes := range createProviderMap(schedule.PracMap) {
+			merged := map[string]string{}
+			for code, perc := range providerMap[provider] {
+				merged[code] = perc
+			}
+			for code, perc := range codes {
+				merged[code] = perc
+			}
+			maps.providers[provider] = merged
+		}
+		result = append(result, maps)
+	}
+	return result, nil
+}
+
+func (m rateMaps) contains(date time.Time) bool {
+	return (m.from.IsZero() || !date.Before(m.from)) && (m.to.IsZero() || !date.After(m.to))
+}
+
+// scheduleFor returns the maps of the schedule in effect on the date. If schedules overlap,
+// the one which started last wins.
+func scheduleFor(schedules []rateMaps, date time.Time) (rateMaps, bool) {
+	found := false
+	var result rateMaps
+	for _, schedule := range schedules {
+		if schedule.contains(date) && (!found || schedule.from.After(result.from)) {
+			result = schedule
+			found = true
+		}
+	}
+	return result, found
+}
@@ -0,0 +1,60 @@
+package main
+
+import "strings"
+
+// Categories of the Status column
+const (
+	statusPayment  = "payment"
+	statusReversal = "reversal"
+	statusRefund   = "refund"
+	statusVoid     = "void"
+)
+
+// Status values as written by the exports, compared after standardString
+var statusCategories = map[string]string{
+	"":                 statusPayment, // layouts without a status column only list payments
+	"payment":          statusPayment,
+	"paid":             statusPayment,
+	"reversed payment": statusReversal,
+	"reversal":         statusReversal,
+	"reversed":         statusReversal,
+	"refund":           statusRefund,
+	"refunded":         statusRefund,
+	"refunded payment": statusRefund,
+	"void":             statusVoid,
+	"voided":           statusVoid,
+	"voided payment":   statusVoid,
+}
+
+// classifyStatus returns the category of a status, false if the status is unknown
+func classifyStatus(status string) (string, bool) {
+	category, ok := statusCategories[standardString(status)]
+	return category, ok
+}
+
+// isReversal is true for lines taking back money received earlier
+func isReversal(category string) bool {
+	return category == statusReversal || category == statusRefund
+}
+
+// paymentKey identifies the original payment a reversal belongs to: the Payment ID
+// and if there is none, the Invoice No. and item
+func paymentKey(line PaymentLine) string {
+	if id := strings.TrimSpace(line.PaymentID); id != "" {
+		return "payment:" + id
+	}
+	return "invoice:" + strings.TrimSpace(line.InvoiceNo) + "/" + strings.TrimSpace(line.ItemNo)
+}
+
+// originalPayments maps the payment key of every plain payment line to that line
+func originalPayments(lines []PaymentLine) map[string]PaymentLine {
+	payments := map[string]PaymentLine{}
+	for _, line := range lines {
+		if category, ok := classifyStatus(line.Status); ok && category == statusPayment {
+			if _, exists := payments[paymentKey(line)]; !exists {
+				payments[paymentKey(line)] = line
+			}
+		}
+	}
+	return payments
+}
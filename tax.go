@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Tax treatment of a service code or an adjustment
+const (
+	taxTaxable    = ""
+	taxGSTFree    = "gstFree"
+	taxInputTaxed = "inputTaxed"
+)
+
+const defaultGSTRate = "10"
+
+// TaxConfig is the GST setup of a company. Service fees and adjustments are taxable unless
+// their service code or tax treatment says otherwise.
+type TaxConfig struct {
+	NotRegistered   bool     `json:"notRegistered"`   // not registered for GST, no GST is charged and the invoice is not a tax invoice
+	GSTRate         string   `json:"gstRate"`         // percentage, 10 if not set
+	GSTFreeCodes    []string `json:"gstFreeCodes"`    // service codes whose fees are GST-free
+	InputTaxedCodes []string `json:"inputTaxedCodes"` // service codes whose fees are input taxed
+}
+
+// rate returns the GST rate as a percentage
+func (t TaxConfig) rate() (*big.Rat, error) {
+	rate := t.GSTRate
+	if strings.TrimSpace(rate) == "" {
+		rate = defaultGSTRate
+	}
+	r, err := parseRate(rate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid GST rate: %w", err)
+	}
+	if r.Sign() < 0 {
+		return nil, fmt.Errorf("GST rate must not be negative: %v", rate)
+	}
+	return r, nil
+}
+
+// validate checks the rate and the tax treatment of the adjustments
+func (t TaxConfig) validate(adjustMap map[string][]Adjustments) error {
+	if _, err := t.rate(); err != nil {
+		return err
+	}
+	for provider, adjustments := range adjustMap {
+		for _, adj := range adjustments {
+			switch adj.Tax {
+			case taxTaxable, taxGSTFree, taxInputTaxed:
+			default:
+				return fmt.Errorf("adjustment: %v of provider: %v has unknown tax: %v", adj.Description, provider, adj.Tax)
+			}
+		}
+	}
+	return nil
+}
+
+// codeTax returns the tax treatment of a service code
+func (t TaxConfig) codeTax(serviceCode string) string {
+	for _, code := range t.GSTFreeCodes {
+		if strings.EqualFold(strings.TrimSpace(code), serviceCode) {
+			return taxGSTFree
+		}
+	}
+	for _, code := range t.InputTaxedCodes {
+		if strings.EqualFold(strings.TrimSpace(code), serviceCode) {
+			return taxInputTaxed
+		}
+	}
+	return taxTaxable
+}
+
+func (t TaxConfig) title() string {
+	if t.NotRegistered {
+		return "INVOICE"
+	}
+	return "TAX INVOICE"
+}
+
+// rateText is the rate as written on the invoice, "10%"
+func (t TaxConfig) rateText() string {
+	rate := strings.TrimSpace(strings.ReplaceAll(t.GSTRate, "%", ""))
+	if rate == "" {
+		rate = defaultGSTRate
+	}
+	return rate + "%"
+}
+
+// totalTax splits the service fees and the adjustments of an invoice by tax treatment
+// and works out the GST charged on the taxable part
+func (t TaxConfig) totalTax(details *PaymentTotals, rounding RoundingPolicy) error {
+	var sum moneySum
+	currency := details.ServiceCutTotal.Currency
+	details.TaxableTotal = newMoney(0, currency)
+	details.GSTFreeTotal = newMoney(0, currency)
+	details.InputTaxedTotal = newMoney(0, currency)
+	details.InvoiceGST = newMoney(0, currency)
+	sum.add(&details.TaxableTotal, details.ServiceCutTotal)
+	sum.add(&details.TaxableTotal, details.AdjustmentTotal)
+	exempt := func(tax string, amount Money) {
+		switch tax {
+		case taxGSTFree:
+			sum.add(&details.GSTFreeTotal, amount)
+		case taxInputTaxed:
+			sum.add(&details.InputTaxedTotal, amount)
+		default:
+			return
+		}
+		sum.sub(&details.TaxableTotal, amount)
+	}
+	for code, service := range details.ServiceCodeSplit {
+		exempt(t.codeTax(code), service.ServiceFees)
+	}
+	// contracts replace the line fees, the difference is split by the codes they cover
+	for _, contract := range details.Contracts {
+		exempt(taxGSTFree, contract.GSTFree)
+		exempt(taxInputTaxed, contract.InputTaxed)
+	}
+	// the GST included in GST-inclusive adjustments is charged as it is, not worked out again
+	inclusive := newMoney(0, currency)
+	included := newMoney(0, currency)
+	for _, adj := range details.Adjustments {
+		exempt(adj.Tax, adj.Amount)
+		if adj.GSTInclusive && adj.Tax == taxTaxable {
+			sum.add(&inclusive, adj.Amount)
+			sum.add(&included, adj.GST)
+		}
+	}
+	charged := details.TaxableTotal
+	sum.sub(&charged, inclusive)
+	if sum.err != nil || t.NotRegistered {
+		return sum.err
+	}
+	rate, err := t.rate()
+	if err != nil {
+		return err
+	}
+	gst, err := calcGST(charged, rate, rounding)
+	if err != nil {
+		return err
+	}
+	details.InvoiceGST, err = gst.Add(included)
+	return err
+}
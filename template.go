@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// The invoice templates a company can start from
+const (
+	templateStandard = "standard" // every section and page, DejaVu Sans 12
+	templateSummary  = "summary"  // the first page and the service fee breakdown, in a smaller font
+)
+
+// The sections of the first page of an invoice
+const (
+	sectionHeader       = "header"       // the title and the logo
+	sectionFrom         = "from"         // the address of the company
+	sectionTo           = "to"           // the address of the provider and the invoice date
+	sectionDetails      = "details"      // provider, period, invoice number, location and email
+	sectionTotal        = "total"        // service fees, adjustments, GST and the amount due
+	sectionAdjustments  = "adjustments"  // how the adjustments were worked out
+	sectionTaxStatement = "taxStatement" // payments with and without GST and the deposits held
+)
+
+// The pages after the first page of an invoice
+const (
+	pageCalculation = "calculation" // the service fee of every payment
+	pageBreakdown   = "breakdown"   // the service fees per service code and contract
+	pageLocations   = "locations"   // payments and service fees per location, for providers at more than one
+)
+
+// The columns of the service fee calculation
+const (
+	columnDate           = "date"
+	columnPatient        = "patient"
+	columnItemNo         = "itemNo"
+	columnInvoiceNo      = "invoiceNo"
+	columnLocation       = "location"
+	columnAccountType    = "accountType"
+	columnPaymentMethod  = "paymentMethod"
+	columnPayment        = "payment"        // payments without GST
+	columnPaymentWithGST = "paymentWithGst" // payments with GST
+	columnGST            = "gst"
+	columnCode           = "code"
+	columnPercentage     = "percentage"
+	columnServiceFee     = "serviceFee"
+)
+
+// the titles of the columns and whether they are right aligned
+var columnTitles = map[string]struct {
+	title string
+	right bool
+}{
+	columnDate:           {"Date", false},
+	columnPatient:        {"Patient", false},
+	columnItemNo:         {"ItemNo", false},
+	columnInvoiceNo:      {"Invoice", false},
+	columnLocation:       {"Location", false},
+	columnAccountType:    {"Account", false},
+	columnPaymentMethod:  {"Method", false},
+	columnPayment:        {"Payment", true},
+	columnPaymentWithGST: {"with GST", true},
+	columnGST:            {"GST", true},
+	columnCode:           {"Code", true},
+	columnPercentage:     {"%", true},
+	columnServiceFee:     {"Service Fee", true},
+}
+
+var (
+	allSections = []string{sectionHeader, sectionFrom, sectionTo, sectionDetails, sectionTotal, sectionAdjustments,
+		sectionTaxStatement}
+	allPages = []string{pageCalculation, pageBreakdown, pageLocations}
+	// the sections every invoice needs, they hold the invoice number, the GST and the amount due
+	requiredSections = []string{sectionDetails, sectionTotal}
+	standardColumns  = []TemplateColumn{{Field: columnDate, Width: 25}, {Field: columnPatient, Width: 30},
+		{Field: columnItemNo, Width: 17}, {Field: columnPayment, Width: 30}, {Field: columnPaymentWithGST, Width: 30},
+		{Field: columnCode, Width: 17}, {Field: columnPercentage, Width: 10}, {Field: columnServiceFee, Width: 30}}
+	standardLogo = LogoPlacement{X: 150, Y: 20, Width: 35, Height: 35}
+	// the core fonts of the PDF, which need no font file but only have the letters of Windows-1252
+	coreFonts = []string{"Arial", "Helvetica", "Times", "Courier"}
+)
+
+const (
+	pageWidth  = 210.0 // A4 in mm
+	pageHeight = 297.0
+	leftMargin = 10.0
+)
+
+// InvoiceTemplate is the layout of the invoices of a company, so they look like its own stationery.
+// It starts from the standard or summary template, everything set replaces what the template has.
+type InvoiceTemplate struct {
+	Base        string           `json:"base" firestore:"base"`               // standard (default) or summary
+	Sections    []string         `json:"sections" firestore:"sections"`       // of the first page in order, see sectionHeader
+	Pages       []string         `json:"pages" firestore:"pages"`             // after the first page in order, see pageCalculation
+	Columns     []TemplateColumn `json:"columns" firestore:"columns"`         // of the service fee calculation
+	Font        string           `json:"font" firestore:"font"`               // DejaVu Sans (default), Arial, Helvetica, Times or Courier
+	FontSize    float64          `json:"fontSize" firestore:"fontSize"`       // of the text, the titles scale with it
+	TextColor   string           `json:"textColor" firestore:"textColor"`     // "#RRGGBB", black if not set
+	AccentColor string           `json:"accentColor" firestore:"accentColor"` // of the titles and headings, the text colour if not set
+	LineColor   string           `json:"lineColor" firestore:"lineColor"`     // of the lines under the totals, black if not set
+	Logo        LogoPlacement    `json:"logo" firestore:"logo"`               // top right if not set
+	Footer      string           `json:"footer" firestore:"footer"`           // {rounding} is replaced with the rounding policy, else it follows on its own line
+	// the order of the service codes in the breakdown, the codes not given follow in alphabetical order
+	ServiceCodes []string `json:"serviceCodes" firestore:"serviceCodes"`
+}
+
+// TemplateColumn is a column of the service fee calculation
+type TemplateColumn struct {
+	Field string  `json:"field" firestore:"field"` // see columnDate
+	Title string  `json:"title" firestore:"title"` // the standard title if not set
+	Width float64 `json:"width" firestore:"width"` // mm
+}
+
+// LogoPlacement is where the logo goes on the first page, in mm from the top left corner
+type LogoPlacement struct {
+	X      float64 `json:"x" firestore:"x"`
+	Y      float64 `json:"y" firestore:"y"`
+	Width  float64 `json:"width" firestore:"width"`
+	Height float64 `json:"height" firestore:"height"`
+}
+
+type rgb struct {
+	r, g, b int
+}
+
+// invoiceLayout is a template with everything not set taken from its base
+type invoiceLayout struct {
+	sections []string
+	pages    []string
+	columns  []TemplateColumn
+	face     string
+	size     float64
+	text     rgb
+	accent   rgb
+	line     rgb
+	logo     LogoPlacement
+	footer   string
+	codes    []string
+}
+
+// layout checks the template and fills in what is not set from the base template
+func (t InvoiceTemplate) layout() (invoiceLayout, error) {
+	layout := invoiceLayout{sections: allSections, pages: allPages, columns: standardColumns, face: defaultFont, size: 12,
+		logo: standardLogo, footer: "{rounding}"}
+	switch t.Base {
+	case "", templateStandard:
+	case templateSummary:
+		layout.pages = []string{pageBreakdown}
+		layout.size = 10
+	default:
+		return layout, fmt.Errorf("unknown base template: %v", t.Base)
+	}
+	if t.Sections != nil {
+		if err := checkNames("section", t.Sections, allSections); err != nil {
+			return layout, err
+		}
+		for _, section := range requiredSections {
+			if !slices.Contains(t.Sections, section) {
+				return layout, fmt.Errorf("the invoice needs the %v section", section)
+			}
+		}
+		layout.sections = t.Sections
+	}
+	if t.Pages != nil {
+		if err := checkNames("page", t.Pages, allPages); err != nil {
+			return layout, err
+		}
+		layout.pages = t.Pages
+	}
+	if len(t.Columns) > 0 {
+		width := leftMargin
+		columns := make([]TemplateColumn, len(t.Columns))
+		for i, column := range t.Columns {
+			if _, ok := columnTitles[column.Field]; !ok {
+				return layout, fmt.Errorf("unknown column: %v", column.Field)
+			}
+			if column.Width <= 0 {
+				return layout, fmt.Errorf("column: %v needs a width", column.Field)
+			}
+			width += column.Width
+			columns[i] = column
+		}
+		if width > pageWidth {
+			return layout, fmt.Errorf("the columns are %vmm wide, wider than the page", width-leftMargin)
+		}
+		layout.columns = columns
+	}
+	if strings.TrimSpace(t.Font) != "" {
+		fonts := fontNames()
+		index := slices.IndexFunc(fonts, func(font string) bool { return strings.EqualFold(font, strings.TrimSpace(t.Font)) })
+		if index < 0 {
+			return layout, fmt.Errorf("unknown font: %v, use one of %v", t.Font, strings.Join(fonts, ", "))
+		}
+		layout.face = fonts[index]
+	}
+	if t.FontSize != 0 {
+		if t.FontSize < 6 || t.FontSize > 16 {
+			return layout, fmt.Errorf("font size must be between 6 and 16: %v", t.FontSize)
+		}
+		layout.size = t.FontSize
+	}
+	var err error
+	if layout.text, err = parseColor(t.TextColor); err != nil {
+		return layout, fmt.Errorf("invalid text colour: %w", err)
+	}
+	layout.accent = layout.text
+	if strings.TrimSpace(t.AccentColor) != "" {
+		if layout.accent, err = parseColor(t.AccentColor); err != nil {
+			return layout, fmt.Errorf("invalid accent colour: %w", err)
+		}
+	}
+	if layout.line, err = parseColor(t.LineColor); err != nil {
+		return layout, fmt.Errorf("invalid line colour: %w", err)
+	}
+	if t.Logo != (LogoPlacement{}) {
+		if t.Logo.Width <= 0 || t.Logo.Height <= 0 || t.Logo.X < 0 || t.Logo.Y < 0 ||
+			t.Logo.X+t.Logo.Width > pageWidth || t.Logo.Y+t.Logo.Height > pageHeight {
+			return layout, fmt.Errorf("the logo must have a size and be on the page: %+v", t.Logo)
+		}
+		layout.logo = t.Logo
+	}
+	if strings.TrimSpace(t.Footer) != "" {
+		layout.footer = t.Footer
+	}
+	seen := map[string]bool{}
+	for _, code := range t.ServiceCodes {
+		if strings.TrimSpace(code) == "" {
+			return layout, fmt.Errorf("service code order has a blank code")
+		}
+		if seen[code] {
+			return layout, fmt.Errorf("service code: %v is given twice", code)
+		}
+		seen[code] = true
+	}
+	layout.codes = t.ServiceCodes
+	layout.columns = slices.Clone(layout.columns)
+	for i, column := range layout.columns {
+		if strings.TrimSpace(column.Title) == "" {
+			layout.columns[i].Title = columnTitles[column.Field].title
+		}
+	}
+	return layout, nil
+}
+
+func (t InvoiceTemplate) validate() error {
+	_, err := t.layout()
+	return err
+}
+
+// checkNames checks the sections or pages are known and given once
+func checkNames(kind string, names []string, known []string) error {
+	seen := map[string]bool{}
+	for _, name := range names {
+		if !slices.Contains(known, name) {
+			return fmt.Errorf("unknown %v: %v, use %v", kind, name, strings.Join(known, ", "))
+		}
+		if seen[name] {
+			return fmt.Errorf("%v: %v is given twice", kind, name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// parseColor reads a "#RRGGBB" colour, black if blank
+func parseColor(color string) (rgb, error) {
+	hex := strings.TrimPrefix(strings.TrimSpace(color), "#")
+	if hex == "" {
+		return rgb{}, nil
+	}
+	value, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 6 || err != nil {
+		return rgb{}, fmt.Errorf("colour must be like #1A2B3C: %v", color)
+	}
+	return rgb{r: int(value >> 16), g: int(value >> 8 & 0xff), b: int(value & 0xff)}, nil
+}
+
+// font returns the font of the layout for a font of the standard layout, which is Arial 12
+func (l invoiceLayout) font(font Font) Font {
+	if font.face == "" {
+		font = Arial12
+	}
+	return Font{face: l.face, style: font.style, size: font.size * l.size / 12}
+}
+
+// serviceCodeOrder returns the codes, which are sorted, in the order of the layout
+func (l invoiceLayout) serviceCodeOrder(codes []string) []string {
+	ordered := []string{}
+	for _, code := range l.codes {
+		if slices.Contains(codes, code) {
+			ordered = append(ordered, code)
+		}
+	}
+	for _, code := range codes {
+		if !slices.Contains(l.codes, code) {
+			ordered = append(ordered, code)
+		}
+	}
+	return ordered
+}
+
+// footerLines are the lines of the footer with the rounding policy filled in. Every invoice states
+// the rounding policy, a footer without {rounding} gets it on a line of its own.
+func (l invoiceLayout) footerLines(rounding RoundingPolicy) []string {
+	if !strings.Contains(l.footer, "{rounding}") {
+		return []string{l.footer, rounding.String()}
+	}
+	return []string{strings.ReplaceAll(l.footer, "{rounding}", rounding.String())}
+}
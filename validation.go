@@ -0,0 +1,61 @@
+package main
+
+// Severity of a validation issue. An error means the line could not be charged,
+// a warning means the line was handled but should be checked.
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// Codes of the validation issues
+const (
+	issueShortRow           = "SHORT_ROW"
+	issueUnknownStatus      = "UNKNOWN_STATUS"
+	issueDuplicate          = "DUPLICATE"
+	issueMissingProvider    = "MISSING_PROVIDER"
+	issueNoItemNr           = "NO_ITEM_NUMBER"
+	issueMissingItemNr      = "MISSING_ITEM_NUMBER"
+	issueLowConfidenceMatch = "LOW_CONFIDENCE_MATCH"
+	issueMissingServiceCode = "MISSING_SERVICE_CODE"
+	issueInvalidAmount      = "INVALID_AMOUNT"
+	issueAmbiguousAmount    = "AMBIGUOUS_AMOUNT"
+	issueAmountRange        = "AMOUNT_OUT_OF_RANGE"
+	issueInvalidPercentage  = "INVALID_PERCENTAGE"
+	issueCalculation        = "CALCULATION_FAILED"
+	issueInvalidPeriod      = "INVALID_PERIOD"
+	issueInvalidDate        = "INVALID_DATE"
+	issueOutOfPeriod        = "OUT_OF_PERIOD"
+	issueNegativeTotal      = "NEGATIVE_TOTAL"
+	issueBelowMinimum       = "BELOW_MINIMUM"
+	issueInvoiceNumber      = "INVOICE_NUMBER_FAILED"
+	issueInvoiceNotMade     = "INVOICE_NOT_MADE"
+	issueNotNumbered        = "INVOICE_NOT_NUMBERED"
+)
+
+// ValidationIssue is one problem found in the file, so all of them can be fixed in one go
+// Line is the 1-based line of the original file the record starts on. FieldLine and FieldColumn
+// are where the field itself starts, as given by csv.Reader.FieldPos or the workbook cell.
+type ValidationIssue struct {
+	Line        int    `json:"line"`
+	Column      string `json:"column"` // the field, see columns.go, or pracMap for the provider percentages
+	FieldLine   int    `json:"fieldLine"`
+	FieldColumn int    `json:"fieldColumn"`
+	Value       string `json:"value"`
+	Code        string `json:"code"`
+	Severity    string `json:"severity"`
+	Message     string `json:"message"`
+}
+
+func (f *FileProcessingResponse) addIssue(line PaymentLine, column string, value string, code string, severity string, message string) {
+	pos := line.positions[column]
+	f.Issues = append(f.Issues, ValidationIssue{
+		Line:        line.LineNum,
+		Column:      column,
+		FieldLine:   pos.line,
+		FieldColumn: pos.column,
+		Value:       value,
+		Code:        code,
+		Severity:    severity,
+		Message:     message,
+	})
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	fileTypeCsv  = "csv"
+	fileTypeXlsx = "xlsx"
+)
+
+// The parts of the workbook we need, see ECMA-376 part 1 (SpreadsheetML)
+type xlsxWorkbook struct {
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+		RID  string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxRelationships struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+type xlsxText struct {
+	T    string `xml:"t"`
+	Runs []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxText) String() string {
+	if len(t.Runs) == 0 {
+		return t.T
+	}
+	var sb strings.Builder
+	for _, run := range t.Runs {
+		sb.WriteString(run.T)
+	}
+	return sb.String()
+}
+
+type xlsxSharedStrings struct {
+	Items []xlsxText `xml:"si"`
+}
+
+type xlsxStyles struct {
+	NumFmts []struct {
+		ID   int    `xml:"numFmtId,attr"`
+		Code string `xml:"formatCode,attr"`
+	} `xml:"numFmts>numFmt"`
+	CellXfs []struct {
+		NumFmtID int `xml:"numFmtId,attr"`
+	} `xml:"cellXfs>xf"`
+}
+
+type xlsxSheet struct {
+	Rows []struct {
+		R     int `xml:"r,attr"`
+		Cells []struct {
+			R      string   `xml:"r,attr"`
+			T      string   `xml:"t,attr"`
+			S      int      `xml:"s,attr"`
+			V      string   `xml:"v"`
+			Inline xlsxText `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+// readXlsx reads a base64 encoded workbook and returns the cell text of the sheet as records,
+// the way the same sheet saved as CSV would look, with the row and column of every cell.
+// If sheet is blank the first sheet is used.
+// Merged cells keep their value in the top left cell only, same as the CSV export.
+func readXlsx(content string, sheet string) ([][]string, [][]fieldPos, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(content))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode base64 workbook: %w", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("file is not an xlsx workbook: %w", err)
+	}
+	files := map[string]*zip.File{}
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	var workbook xlsxWorkbook
+	if err := readXlsxPart(files, "xl/workbook.xml", &workbook, true); err != nil {
+		return nil, nil, err
+	}
+	var rels xlsxRelationships
+	if err := readXlsxPart(files, "xl/_rels/workbook.xml.rels", &rels, true); err != nil {
+		return nil, nil, err
+	}
+	var sharedStrings xlsxSharedStrings
+	if err := readXlsxPart(files, "xl/sharedStrings.xml", &sharedStrings, false); err != nil {
+		return nil, nil, err
+	}
+	var styles xlsxStyles
+	if err := readXlsxPart(files, "xl/styles.xml", &styles, false); err != nil {
+		return nil, nil, err
+	}
+
+	if len(workbook.Sheets) == 0 {
+		return nil, nil, fmt.Errorf("workbook has no sheets")
+	}
+	rID := ""
+	for _, s := range workbook.Sheets {
+		if strings.TrimSpace(sheet) == "" || strings.EqualFold(s.Name, strings.TrimSpace(sheet)) {
+			rID = s.RID
+			break
+		}
+	}
+	if rID == "" {
+		return nil, nil, fmt.Errorf("workbook has no sheet: %v", sheet)
+	}
+	sheetPath := ""
+	for _, rel := range rels.Relationships {
+		if rel.ID == rID {
+			sheetPath = path.Join("xl", rel.Target)
+			if strings.HasPrefix(rel.Target, "/") {
+				sheetPath = strings.TrimPrefix(rel.Target, "/")
+			}
+		}
+	}
+	var ws xlsxSheet
+	if err := readXlsxPart(files, sheetPath, &ws, true); err != nil {
+		return nil, nil, err
+	}
+
+	numFmts := map[int]string{}
+	for _, nf := range styles.NumFmts {
+		numFmts[nf.ID] = nf.Code
+	}
+	records := [][]string{}
+	width := 0
+	for _, row := range ws.Rows {
+		// empty rows are left out of the sheet xml, but they are blank lines in the CSV
+		for row.R > len(records)+1 {
+			records = append(records, []string{})
+		}
+		record := []string{}
+		for _, cell := range row.Cells {
+			// the reference is optional, without it the cell follows the one before
+			col := len(record)
+			if cell.R != "" {
+				var err error
+				if col, err = xlsxColumn(cell.R); err != nil {
+					return nil, nil, err
+				}
+			}
+			for len(record) < col {
+				record = append(record, "")
+			}
+			value := cell.V
+			switch cell.T {
+			case "s":
+				idx, err := strconv.Atoi(cell.V)
+				if err != nil || idx < 0 || idx >= len(sharedStrings.Items) {
+					return nil, nil, fmt.Errorf("cell %v has an invalid shared string", cell.R)
+				}
+				value = sharedStrings.Items[idx].String()
+			case "inlineStr":
+				value = cell.Inline.String()
+			case "b":
+				value = strings.ToUpper(strconv.FormatBool(cell.V == "1"))
+			case "", "n":
+				numFmt := 0
+				if cell.S >= 0 && cell.S < len(styles.CellXfs) {
+					numFmt = styles.CellXfs[cell.S].NumFmtID
+				}
+				value = formatXlsxNumber(cell.V, numFmt, numFmts[numFmt])
+			}
+			record = append(record, value)
+		}
+		if len(record) > width {
+			width = len(record)
+		}
+		records = append(records, record)
+	}
+	if width == 0 {
+		return nil, nil, fmt.Errorf("no header found, sheet %v has no cells", sheetPath)
+	}
+	positions := make([][]fieldPos, len(records))
+	for i := range records {
+		for len(records[i]) < width {
+			records[i] = append(records[i], "")
+		}
+		positions[i] = make([]fieldPos, width)
+		for col := range positions[i] {
+			positions[i][col] = fieldPos{line: i + 1, column: col + 1}
+		}
+	}
+	return records, positions, nil
+}
+
+func readXlsxPart(files map[string]*zip.File, name string, v any, required bool) error {
+	f, ok := files[name]
+	if !ok {
+		if required {
+			return fmt.Errorf("workbook is missing %v", name)
+		}
+		return nil
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	if err := xml.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse %v: %w", name, err)
+	}
+	return nil
+}
+
+// xlsxColumn returns the zero based column of a cell reference like "AB12"
+func xlsxColumn(ref string) (int, error) {
+	col := 0
+	for _, r := range ref {
+		if r >= 'A' && r <= 'Z' {
+			col = col*26 + int(r-'A') + 1
+		} else {
+			break
+		}
+	}
+	if col == 0 {
+		return 0, fmt.Errorf("invalid cell reference: %v", ref)
+	}
+	return col - 1, nil
+}
+
+// formatXlsxNumber renders a numeric cell the way Excel writes it to CSV for the formats
+// found in the exports: dates as DD/MM/YYYY, amounts with two decimals and accounting brackets
+func formatXlsxNumber(value string, numFmtID int, formatCode string) string {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return value
+	}
+	if isDateFormat(numFmtID, formatCode) {
+		// the 1900 date system, including Excel's phantom 29/02/1900
+		epoch := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+		return epoch.AddDate(0, 0, int(math.Floor(v))).Format("02/01/2006")
+	}
+	decimals := -1
+	code := formatCode
+	switch numFmtID {
+	case 2:
+		code = "0.00"
+	case 4:
+		code = "#,##0.00"
+	case 39:
+		code = "#,##0.00_);(#,##0.00)"
+	case 40:
+		code = "#,##0.00_);[Red](#,##0.00)"
+	}
+	if idx := strings.Index(code, "0."); idx >= 0 {
+		decimals = 0
+		for _, c := range code[idx+2:] {
+			if c != '0' {
+				break
+			}
+			decimals++
+		}
+	}
+	text := strconv.FormatFloat(math.Abs(v), 'f', decimals, 64)
+	if v < 0 {
+		if strings.Contains(code, "(") {
+			return "(" + text + ")"
+		}
+		return "-" + text
+	}
+	return text
+}
+
+func isDateFormat(numFmtID int, formatCode string) bool {
+	if (numFmtID >= 14 && numFmtID <= 22) || (numFmtID >= 45 && numFmtID <= 47) {
+		return true
+	}
+	// skip quoted text and bracketed colours or locales like [Red] and [$-409]
+	inQuote, inBracket := false, false
+	for _, c := range strings.ToLower(formatCode) {
+		switch {
+		case c == '"':
+			inQuote = !inQuote
+		case inQuote:
+		case c == '[':
+			inBracket = true
+		case c == ']':
+			inBracket = false
+		case inBracket:
+		case c == 'd' || c == 'y' || c == 'm':
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// makeXlsx builds a minimal workbook. Strings are shared, numbers ("=") use the general format,
+// amounts ("$") the accounting format and dates ("#") a date format, like the Payments Export saved from Excel.
+func makeXlsx(t *testing.T, sheetName string, rows [][]string) string {
+	shared := []string{}
+	var sheet strings.Builder
+	sheet.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	for r, row := range rows {
+		if len(row) == 0 {
+			continue // leave out empty rows like Excel does
+		}
+		fmt.Fprintf(&sheet, `<row r="%d">`, r+1)
+		for c, value := range row {
+			ref := fmt.Sprintf("%c%d", 'A'+c, r+1)
+			switch {
+			case value == "":
+			case strings.HasPrefix(value, "#"):
+				fmt.Fprintf(&sheet, `<c r="%s" s="2"><v>%s</v></c>`, ref, value[1:])
+			case strings.HasPrefix(value, "$"):
+				fmt.Fprintf(&sheet, `<c r="%s" s="1"><v>%s</v></c>`, ref, value[1:])
+			case strings.HasPrefix(value, "="):
+				fmt.Fprintf(&sheet, `<c r="%s"><v>%s</v></c>`, ref, value[1:])
+			default:
+				fmt.Fprintf(&sheet, `<c r="%s" t="s"><v>%d</v></c>`, ref, len(shared))
+				shared = append(shared, value)
+			}
+		}
+		sheet.WriteString(`</row>`)
+	}
+	// the report title is merged down over the empty row below it and the blank cells of its row are merged
+	sheet.WriteString(`</sheetData><mergeCells count="2"><mergeCell ref="A2:A3"/><mergeCell ref="C2:O2"/></mergeCells></worksheet>`)
+
+	var sst strings.Builder
+	sst.WriteString(`<sst xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	escape := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	for _, s := range shared {
+		sst.WriteString(`<si><t xml:space="preserve">` + escape.Replace(s) + `</t></si>`)
+	}
+	sst.WriteString(`</sst>`)
+
+	parts := map[string]string{
+		"xl/workbook.xml": `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+			`<sheets><sheet name="` + sheetName + `" sheetId="1" r:id="rId1"/><sheet name="Other" sheetId="2" r:id="rId2"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Target="worksheets/sheet1.xml"/><Relationship Id="rId2" Target="/xl/worksheets/sheet2.xml"/></Relationships>`,
+		"xl/styles.xml": `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+			`<numFmts count="1"><numFmt numFmtId="164" formatCode="#,##0.00_);[Red](#,##0.00)"/></numFmts>` +
+			`<cellXfs count="3"><xf numFmtId="0"/><xf numFmtId="164"/><xf numFmtId="14"/></cellXfs></styleSheet>`,
+		"xl/sharedStrings.xml":     sst.String(),
+		"xl/worksheets/sheet1.xml": sheet.String(),
+		"xl/worksheets/sheet2.xml": `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData/></worksheet>`,
+	}
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for name, content := range parts {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestXlsxMatchesCsv(t *testing.T) {
+	configureLogging()
+	drName := "Dr Aha"
+	csvContent := ",,,,,,,,,,,,,,,\n" +
+		"\"Payments Export \nReport\nReport Period: 26/02/2024 - 03/03/2024\",Report version: 1.10,,,,,,,,,,,,,,A Practice\n" +
+		",,,,,,,,,,,,,,,\n" +
+		"Location,Provider,Billed To,Patient Name,Invoice No.,Service ID,Payment ID,Item No.,Description,Status,Transaction Date,Payment Method,Account Type,\"GST\n($ incl GST)\",\"Payment\n($ incl GST)\",\"Deposit\n($ incl GST)\"\n" +
+		"A Practice,Dr Aha,Irrelevant,Sick Patient,162307,174545,71756,80010,\"Clinical psychologist consultation, >50 min\",Reversed payment,01/03/2024,EFT,Private,0.00,(224.50),0.00\n" +
+		"A Practice,Dr Aha,Irrelevant,Sick Patient,162308,174546,71757,80010,\"Clinical psychologist consultation, >50 min\",Payment,01/03/2024,EFT,Private,0.00,224.50,0.00\n"
+	rows := [][]string{
+		{},
+		{"Payments Export \nReport\nReport Period: 26/02/2024 - 03/03/2024", "Report version: 1.10", "", "", "", "", "", "", "", "", "", "", "", "", "", "A Practice"},
+		{},
+		{"Location", "Provider", "Billed To", "Patient Name", "Invoice No.", "Service ID", "Payment ID", "Item No.", "Description", "Status", "Transaction Date", "Payment Method", "Account Type", "GST\n($ incl GST)", "Payment\n($ incl GST)", "Deposit\n($ incl GST)"},
+		{"A Practice", drName, "Irrelevant", "Sick Patient", "=162307", "=174545", "=71756", "80010", "Clinical psychologist consultation, >50 min", "Reversed payment", "#45352", "EFT", "Private", "$0", "$-224.5", "$0"},
+		{"A Practice", drName, "Irrelevant", "Sick Patient", "=162308", "=174546", "=71757", "80010", "Clinical psychologist consultation, >50 min", "Payment", "#45352", "EFT", "Private", "$0", "$224.5", "$0"},
+	}
+	paymentFile := PaymentFile{
+		FileContent: csvContent,
+		CodeMap:     map[string][]string{"code1": {"80010"}},
+		PracMap:     map[string]map[string]string{drName: {"code1": "30"}},
+	}
+	csvRes, err := processFileContent(paymentFile)
+	require.NoError(t, err)
+
+	paymentFile.FileContent = makeXlsx(t, "Payments", rows)
+	paymentFile.FileType = fileTypeXlsx
+	paymentFile.Sheet = "Payments"
+	xlsxRes, err := processFileContent(paymentFile)
+	require.NoError(t, err)
+
+	csvDetail, xlsxDetail := csvRes.ChargeDetail[drName], xlsxRes.ChargeDetail[drName]
+	require.NotEmpty(t, xlsxDetail.PdfFile)
+	csvDetail.PdfFile, xlsxDetail.PdfFile = nil, nil
+	require.Equal(t, csvDetail, xlsxDetail)
+	require.Equal(t, "(224.50)", xlsxDetail.PaymentDetails[0].Payment.String())
+	require.Equal(t, "01/03/2024", xlsxDetail.PaymentDetails[0].TransDate)
+
+	// cells without a reference follow the cell before them
+	paymentFile.FileContent = makeXlsx(t, "Payments", rows)
+	paymentFile.FileContent = withoutCellRefs(t, paymentFile.FileContent, regexp.MustCompile(`<c r="[A-Z]+[4-6]"`))
+	xlsxRes, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	xlsxDetail = xlsxRes.ChargeDetail[drName]
+	xlsxDetail.PdfFile = nil
+	require.Equal(t, csvDetail, xlsxDetail)
+
+	paymentFile.Sheet = "Missing"
+	_, err = processFileContent(paymentFile)
+	require.Error(t, err)
+	// the sheet is found by name, the other sheet is empty
+	paymentFile.Sheet = "other"
+	_, err = processFileContent(paymentFile)
+	require.ErrorContains(t, err, "no header found")
+	// a blank sheet is the first one
+	paymentFile.Sheet = ""
+	xlsxRes, err = processFileContent(paymentFile)
+	require.NoError(t, err)
+	xlsxDetail = xlsxRes.ChargeDetail[drName]
+	xlsxDetail.PdfFile = nil
+	require.Equal(t, csvDetail, xlsxDetail)
+	records, _, err := readRecords(paymentFile)
+	require.NoError(t, err)
+	require.Len(t, records, 6)
+	require.Equal(t, "Location", records[3][0])
+	require.Equal(t, []string{"", "", "", ""}, records[2][:4]) // not filled from the merged title above
+	paymentFile.FileContent = "not base64"
+	_, err = processFileContent(paymentFile)
+	require.ErrorContains(t, err, "Reading xlsx file failed")
+	// a sheet with only empty rows has no header
+	paymentFile.FileContent = makeXlsx(t, "Payments", [][]string{{""}, {""}})
+	paymentFile.Sheet = "Payments"
+	_, err = processFileContent(paymentFile)
+	require.ErrorContains(t, err, "no header found")
+}
+
+// withoutCellRefs removes the references of the cells matching the pattern from the sheets of the workbook
+func withoutCellRefs(t *testing.T, workbook string, pattern *regexp.Regexp) string {
+	data, err := base64.StdEncoding.DecodeString(workbook)
+	require.NoError(t, err)
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+	for _, f := range zr.File {
+		r, err := f.Open()
+		require.NoError(t, err)
+		content, err := io.ReadAll(r)
+		require.NoError(t, err)
+		w, err := zw.Create(f.Name)
+		require.NoError(t, err)
+		_, err = w.Write(pattern.ReplaceAll(content, []byte("<c")))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+func TestFormatXlsxNumber(t *testing.T) {
+	tests := []struct {
+		value  string
+		numFmt int
+		code   string
+		output string
+	}{
+		{"80010", 0, "", "80010"},
+		{"224.5", 2, "", "224.50"},
+		{"-224.5", 39, "", "(224.50)"},
+		{"-224.5", 164, "0.00", "-224.50"},
+		{"-224.5", 164, "#,##0.00_);[Red](#,##0.00)", "(224.50)"},
+		{"45352", 14, "", "01/03/2024"},
+		{"45352.5", 164, "dd/mm/yyyy", "01/03/2024"},
+		{"12", 164, "[Red]0", "12"},
+	}
+	for _, test := range tests {
+		require.Equal(t, test.output, formatXlsxNumber(test.value, test.numFmt, test.code))
+	}
+}